@@ -0,0 +1,171 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// CommonLog returns an AccessLogger which writes each
+// entry to w in the Common Log Format.
+func CommonLog(w io.Writer) common.AccessLogger {
+	out := &logWriter{w: w}
+	return func(entry *common.AccessLogEntry) {
+		out.write([]byte(commonLogLine(entry) + "\n"))
+	}
+}
+
+// CombinedLog returns an AccessLogger which writes each
+// entry to w in the Combined Log Format, which adds the
+// referer and user agent to the Common Log Format.
+func CombinedLog(w io.Writer) common.AccessLogger {
+	out := &logWriter{w: w}
+	return func(entry *common.AccessLogEntry) {
+		line := fmt.Sprintf("%s %s %s\n", commonLogLine(entry), logQuote(entry.Referer), logQuote(entry.UserAgent))
+		out.write([]byte(line))
+	}
+}
+
+// JSONLog returns an AccessLogger which writes each entry
+// to w as a JSON object on its own line. Unlike the other
+// formats, this includes the SPDY details of the stream,
+// such as its version, stream ID and priority.
+func JSONLog(w io.Writer) common.AccessLogger {
+	out := &logWriter{w: w}
+	return func(entry *common.AccessLogEntry) {
+		j := jsonLogEntry{
+			Time:       entry.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+			RemoteAddr: entry.RemoteAddr,
+			Method:     entry.Method,
+			Host:       entry.Host,
+			Path:       entry.Path,
+			Proto:      entry.Proto,
+			Referer:    entry.Referer,
+			UserAgent:  entry.UserAgent,
+			Status:     entry.Status,
+			BytesIn:    entry.BytesIn,
+			BytesOut:   entry.BytesOut,
+			Duration:   float64(entry.Duration.Microseconds()) / 1000,
+			Version:    entry.Version,
+			Subversion: entry.Subversion,
+			StreamID:   uint32(entry.StreamID),
+			Priority:   int(entry.Priority),
+			Pushed:     entry.Pushed,
+		}
+		if entry.Reset != 0 {
+			j.Reset = entry.Reset.String()
+		}
+		if entry.Goaway {
+			j.Goaway = goawayStatusText[entry.GoawayStatus]
+		}
+
+		b, err := json.Marshal(j)
+		if err != nil {
+			log.Printf("Failed to encode access log entry: %v\n", err)
+			return
+		}
+		out.write(append(b, '\n'))
+	}
+}
+
+// jsonLogEntry is the form in which JSONLog
+// writes an AccessLogEntry.
+type jsonLogEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	Path       string  `json:"path"`
+	Proto      string  `json:"proto"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+	Status     int     `json:"status"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	Duration   float64 `json:"duration_ms"`
+	Version    int     `json:"version"`
+	Subversion int     `json:"subversion"`
+	StreamID   uint32  `json:"stream_id"`
+	Priority   int     `json:"priority"`
+	Pushed     bool    `json:"pushed"`
+	Reset      string  `json:"reset,omitempty"`
+	Goaway     string  `json:"goaway,omitempty"`
+}
+
+var goawayStatusText = map[common.StatusCode]string{
+	common.GOAWAY_OK:                 "OK",
+	common.GOAWAY_PROTOCOL_ERROR:     "PROTOCOL_ERROR",
+	common.GOAWAY_INTERNAL_ERROR:     "INTERNAL_ERROR",
+	common.GOAWAY_FLOW_CONTROL_ERROR: "FLOW_CONTROL_ERROR",
+}
+
+// commonLogLine formats the entry in the Common
+// Log Format, without a trailing newline.
+func commonLogLine(entry *common.AccessLogEntry) string {
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err != nil {
+		host = entry.RemoteAddr
+	}
+	if host == "" {
+		host = "-"
+	}
+
+	status := "-"
+	if entry.Status != 0 {
+		status = strconv.Itoa(entry.Status)
+	}
+	size := "-"
+	if entry.BytesOut != 0 {
+		size = strconv.FormatInt(entry.BytesOut, 10)
+	}
+
+	request := entry.Method + " " + entry.Path + " " + entry.Proto
+	return fmt.Sprintf("%s - - [%s] %s %s %s", host, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		logQuote(request), status, size)
+}
+
+// logQuote quotes s for the access log, escaping
+// quotes, backslashes and non-printable characters.
+// An empty string is logged as "-".
+func logQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	buf := make([]byte, 0, len(s)+2)
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20 || c >= 0x7f:
+			buf = append(buf, fmt.Sprintf("\\x%02x", c)...)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return string(append(buf, '"'))
+}
+
+// logWriter serialises the lines written
+// by concurrent streams.
+type logWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *logWriter) write(b []byte) {
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.w.Write(b); err != nil {
+		debug.Printf("Failed to write access log: %v\n", err)
+	}
+}
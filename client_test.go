@@ -5,18 +5,29 @@
 package spdy_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
 )
 
 func init() {
@@ -90,6 +101,470 @@ func TestClientInGoroutines(t *testing.T) {
 	wg.Wait()
 }
 
+func TestClientResponseHeaderTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	client := newClient()
+	client.Transport.(*spdy.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+
+	_, err := client.Get(ts.URL)
+	var timeout *common.TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("Expected a TimeoutError, got %v", err)
+	}
+	if timeout.Op != "awaiting response headers" {
+		t.Errorf("Expected response header timeout, got %q", timeout.Op)
+	}
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	client := newClient()
+	client.Transport.(*spdy.Transport).RequestTimeout = 50 * time.Millisecond
+
+	_, err := client.Get(ts.URL)
+	var timeout *common.TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("Expected a TimeoutError, got %v", err)
+	}
+	if timeout.Op != "completing request" {
+		t.Errorf("Expected request timeout, got %q", timeout.Op)
+	}
+}
+
+func TestClientTrailers(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Server-Trailer-A")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "request trailer: %s", r.Trailer.Get("Client-Trailer"))
+		w.Header().Set("Server-Trailer-A", "valuea")
+		w.Header().Set(http.TrailerPrefix+"Server-Trailer-B", "valueb")
+	}))
+	defer ts.Close()
+
+	client := newClient()
+
+	req, err := http.NewRequest("POST", ts.URL, strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Trailer = http.Header{"Client-Trailer": {"clientvalue"}}
+
+	r, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "request trailer: clientvalue" {
+		t.Errorf("Incorrect page body: %q", s)
+	}
+	if got := r.Trailer.Get("Server-Trailer-A"); got != "valuea" {
+		t.Errorf("Expected declared trailer %q, got %q", "valuea", got)
+	}
+	if got := r.Trailer.Get("Server-Trailer-B"); got != "valueb" {
+		t.Errorf("Expected prefixed trailer %q, got %q", "valueb", got)
+	}
+	if got := r.Header.Get("Server-Trailer-A"); got != "" {
+		t.Errorf("Trailer leaked into header: %q", got)
+	}
+}
+
+func TestClientHTTPKeepAlive(t *testing.T) {
+	var m sync.Mutex
+	conns := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path: %s", r.URL.Path)
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			m.Lock()
+			conns++
+			m.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	tr := &spdy.Transport{IdleConnTimeout: 100 * time.Millisecond}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	get := func(path string) *http.Response {
+		r, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	check := func(r *http.Response, path string) {
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "path: "+path {
+			t.Errorf("Incorrect page body: %q", s)
+		}
+	}
+	numConns := func() int {
+		m.Lock()
+		defer m.Unlock()
+		return conns
+	}
+
+	// A connection is not reused until its response
+	// body has been read.
+	r1 := get("/a")
+	r2 := get("/b")
+	check(r2, "/b")
+	check(r1, "/a")
+	if n := numConns(); n != 2 {
+		t.Errorf("Expected 2 connections, got %d", n)
+	}
+
+	// Once the bodies have been read, the connections
+	// are reused.
+	check(get("/c"), "/c")
+	check(get("/d"), "/d")
+	if n := numConns(); n != 2 {
+		t.Errorf("Expected 2 connections after reuse, got %d", n)
+	}
+
+	// Idle connections are closed after the idle timeout.
+	time.Sleep(200 * time.Millisecond)
+	check(get("/e"), "/e")
+	if n := numConns(); n != 3 {
+		t.Errorf("Expected 3 connections after idle timeout, got %d", n)
+	}
+}
+
+func TestClientConnLimit(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "path: %s", r.URL.Path)
+	})
+	ts1 := httptest.NewServer(handler)
+	defer ts1.Close()
+	ts2 := httptest.NewServer(handler)
+	defer ts2.Close()
+
+	tr := &spdy.Transport{MaxIdleConnsPerHost: 1}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	// Use the only connection to the first server.
+	r1, err := client.Get(ts1.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request waiting for a connection gives up when
+	// its context ends.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", ts1.URL+"/b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req.WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// A request waiting for a connection to the first
+	// server does not delay requests to the second.
+	done := make(chan *http.Response, 1)
+	go func() {
+		r, err := client.Get(ts1.URL + "/c")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- r
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	errc := make(chan error, 1)
+	go func() {
+		r, err := client.Get(ts2.URL + "/d")
+		if err == nil {
+			r.Body.Close()
+		}
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request to second server was blocked by first server's connection limit")
+	}
+
+	// Freeing the connection lets the waiting request proceed.
+	r1.Body.Close()
+	select {
+	case r := <-done:
+		if r != nil {
+			r.Body.Close()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting request did not proceed")
+	}
+}
+
+func TestClientPriorKnowledge(t *testing.T) {
+	versions := []spdy.KnownVersion{{2, 0}, {3, 0}, {3, 1}}
+	for _, v := range versions {
+		// Serve SPDY over an in-memory connection.
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "SPDY/%v: %s", spdy.SPDYversion(w), r.URL.Path)
+		})}
+		tr := &spdy.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				client, srv := net.Pipe()
+				conn, err := spdy.NewServerConn(srv, server, v.Version, v.Subversion)
+				if err != nil {
+					return nil, err
+				}
+				go conn.Run()
+				return client, nil
+			},
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}
+		client := &http.Client{Transport: tr}
+
+		r, err := client.Get("http://example.com/test")
+		if err != nil {
+			t.Fatalf("SPDY/%d.%d: %v", v.Version, v.Subversion, err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		version := fmt.Sprint(float64(v.Version) + float64(v.Subversion)/10)
+		if s := string(b); s != "SPDY/"+version+": /test" {
+			t.Errorf("Incorrect page body: %q", s)
+		}
+	}
+}
+
+// newCertificate returns a self-signed certificate with
+// the given common name, covering the given hosts.
+func newCertificate(t *testing.T, name string, hosts ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCredentials(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certs, err := spdy.GetCredentials(w)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(certs) == 0 {
+			io.WriteString(w, "none")
+			return
+		}
+		io.WriteString(w, certs[0].Subject.CommonName)
+	}))
+	defer ts.Close()
+
+	// Use more origins than the server's
+	// credential vector has slots.
+	certs := make(map[string]tls.Certificate)
+	for i := 0; i < 10; i++ {
+		host := fmt.Sprintf("host%d.example", i)
+		certs["https://"+host] = newCertificate(t, host)
+	}
+	tr := &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3"},
+		},
+		ClientCredentials: func(origin string) (*tls.Certificate, error) {
+			if cert, ok := certs[origin]; ok {
+				return &cert, nil
+			}
+			return nil, nil
+		},
+	}
+	client := &http.Client{Transport: tr}
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i <= 10; i++ {
+			host := fmt.Sprintf("host%d.example", i)
+			expect := host
+			if i == 10 {
+				expect = "none"
+			}
+
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = host
+			r, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(b); s != expect {
+				t.Errorf("%s: got certificate %q, expected %q", host, s, expect)
+			}
+		}
+	}
+}
+
+func TestClientCoalesce(t *testing.T) {
+	for _, covered := range []bool{true, false} {
+		hosts := []string{"127.0.0.1"}
+		if covered {
+			hosts = append(hosts, "localhost")
+		}
+		server := &spdy.Server{Server: &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.RemoteAddr)
+			}),
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{newCertificate(t, "server", hosts...)}},
+		}}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(l, "", "")
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+
+		client := &http.Client{Transport: &spdy.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"spdy/3.1"},
+			},
+			Coalesce: true,
+		}}
+		var addrs []string
+		for _, host := range []string{"127.0.0.1", "localhost"} {
+			r, err := client.Get("https://" + net.JoinHostPort(host, port) + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs = append(addrs, string(b))
+		}
+
+		if shared := addrs[0] == addrs[1]; shared != covered {
+			t.Errorf("certificate covering %v: shared connection is %v, expected %v", hosts, shared, covered)
+		}
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestClientCoalesceMisdirected(t *testing.T) {
+	// The server only serves localhost on connections
+	// made to localhost.
+	server := &spdy.Server{Server: &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.Host)
+			if host == "localhost" && (r.TLS == nil || r.TLS.ServerName != host) {
+				w.WriteHeader(http.StatusMisdirectedRequest)
+				return
+			}
+			io.WriteString(w, r.RemoteAddr)
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{newCertificate(t, "server", "127.0.0.1", "localhost")}},
+	}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(l, "", "")
+	defer server.Shutdown(context.Background())
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	client := &http.Client{Transport: &spdy.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"spdy/3.1"},
+		},
+		Coalesce: true,
+	}}
+	get := func(host string) string {
+		r, err := client.Get("https://" + net.JoinHostPort(host, port) + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", host, r.StatusCode)
+		}
+		return string(b)
+	}
+
+	// The request to localhost is first sent on the shared
+	// connection, then retried on its own connection, which
+	// is used from then on.
+	first := get("127.0.0.1")
+	second := get("localhost")
+	if first == second {
+		t.Errorf("expected misdirected request to be retried on a new connection")
+	}
+	if third := get("localhost"); third != second {
+		t.Errorf("expected later requests to use the new connection, got %s and %s", second, third)
+	}
+}
+
 // FIXME: Fails
 // func TestClientRedirects(t *testing.T) {
 // 	defer afterTest(t)
@@ -0,0 +1,150 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// AccessLogEntry describes a stream served by a SPDY
+// server. An entry is passed to the server's AccessLogger
+// once each stream has ended.
+type AccessLogEntry struct {
+	Time       time.Time     // when the stream was opened.
+	Duration   time.Duration // how long the stream was open.
+	RemoteAddr string
+	Method     string
+	Host       string
+	Path       string // the request URI.
+	Proto      string
+	Referer    string
+	UserAgent  string
+	Status     int   // the response status, or zero if none was sent.
+	BytesIn    int64 // bytes of request body received.
+	BytesOut   int64 // bytes of response body sent.
+	Version    int
+	Subversion int
+	StreamID   StreamID
+	Priority   Priority
+	Pushed     bool // whether the stream was a server push.
+
+	// If the stream ended abnormally, Reset is the status
+	// of the RST_STREAM sent or received. If instead it was
+	// ended by the connection closing, Goaway is set, along
+	// with the status of any GOAWAY sent or received.
+	Reset        StatusCode
+	Goaway       bool
+	GoawayStatus StatusCode
+}
+
+// AccessLogger is called with an entry for each stream
+// served. It may be called concurrently, and should not
+// block.
+type AccessLogger func(entry *AccessLogEntry)
+
+// AccessLogRecord is used to build an AccessLogEntry
+// while a stream is served. A nil AccessLogRecord
+// records nothing, so streams can record their
+// details whether or not access logging is enabled.
+type AccessLogRecord struct {
+	lock   sync.Mutex
+	log    AccessLogger
+	entry  AccessLogEntry
+	logged bool
+}
+
+// NewAccessLogRecord starts recording a stream, with the
+// details already known in entry. If log is nil, the
+// returned record is nil.
+func NewAccessLogRecord(log AccessLogger, entry AccessLogEntry) *AccessLogRecord {
+	if log == nil {
+		return nil
+	}
+	out := new(AccessLogRecord)
+	out.log = log
+	out.entry = entry
+	out.entry.Time = time.Now()
+	return out
+}
+
+// Status records the response status. Only the first
+// status is recorded.
+func (r *AccessLogRecord) Status(code int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	if r.entry.Status == 0 {
+		r.entry.Status = code
+	}
+	r.lock.Unlock()
+}
+
+// BytesIn records n bytes of request body received.
+func (r *AccessLogRecord) BytesIn(n int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.entry.BytesIn += int64(n)
+	r.lock.Unlock()
+}
+
+// BytesOut records n bytes of response body sent.
+func (r *AccessLogRecord) BytesOut(n int) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.entry.BytesOut += int64(n)
+	r.lock.Unlock()
+}
+
+// Reset records that the stream was reset with the
+// given status. Only the first reset is recorded.
+func (r *AccessLogRecord) Reset(status StatusCode) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	if r.entry.Reset == 0 && !r.entry.Goaway {
+		r.entry.Reset = status
+	}
+	r.lock.Unlock()
+}
+
+// Goaway records that the stream was ended by the
+// connection closing, with the given GOAWAY status.
+func (r *AccessLogRecord) Goaway(status StatusCode) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	if r.entry.Reset == 0 && !r.entry.Goaway {
+		r.entry.Goaway = true
+		r.entry.GoawayStatus = status
+	}
+	r.lock.Unlock()
+}
+
+// Finish passes the entry to the AccessLogger. Only
+// the first call has any effect.
+func (r *AccessLogRecord) Finish() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	if r.logged {
+		r.lock.Unlock()
+		return
+	}
+	r.logged = true
+	r.entry.Duration = time.Since(r.entry.Time)
+	entry := r.entry
+	r.lock.Unlock()
+
+	r.log(&entry)
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitBurst is the time for which a RateLimiter
+// can save unused bandwidth, to absorb small bursts.
+const rateLimitBurst = 100 * time.Millisecond
+
+// RateLimiter limits the rate at which data is sent,
+// using a token bucket. The bucket fills at the rate
+// given, and data sent is taken from the bucket. Data
+// can be taken even when the bucket has too little, so
+// that frames of any size can be sent, but the sender
+// must then wait until the bucket has refilled.
+//
+// A RateLimiter is safe for concurrent use. The zero
+// value, and a nil *RateLimiter, have no limit.
+type RateLimiter struct {
+	l      sync.Mutex
+	rate   int64     // bytes per second; zero means no limit.
+	tokens int64     // data which can be sent, or the debt if negative.
+	last   time.Time // when tokens was last refilled.
+}
+
+// NewRateLimiter returns a RateLimiter which allows
+// rate bytes per second. A rate of zero means no
+// limit.
+func NewRateLimiter(rate int64) *RateLimiter {
+	r := new(RateLimiter)
+	r.SetRate(rate)
+	return r
+}
+
+// Rate returns the limit in bytes per second,
+// or zero if there is no limit.
+func (r *RateLimiter) Rate() int64 {
+	if r == nil {
+		return 0
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.rate
+}
+
+// SetRate changes the limit to rate bytes per second.
+// A rate of zero or less means no limit.
+func (r *RateLimiter) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.refill(time.Now())
+	r.rate = rate
+	if max := r.burst(); r.tokens > max {
+		r.tokens = max
+	}
+}
+
+// Reserve takes n bytes from the bucket, returning
+// how long the caller must wait before sending them.
+func (r *RateLimiter) Reserve(n int) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.rate == 0 {
+		return 0
+	}
+
+	r.refill(time.Now())
+	r.tokens -= int64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens * int64(time.Second) / r.rate)
+}
+
+// refill adds the tokens accrued since the last
+// refill. This must be called with r.l held.
+func (r *RateLimiter) refill(now time.Time) {
+	if r.rate > 0 && !r.last.IsZero() {
+		r.tokens += int64(now.Sub(r.last).Seconds() * float64(r.rate))
+		if max := r.burst(); r.tokens > max {
+			r.tokens = max
+		}
+	}
+	r.last = now
+}
+
+// burst returns the size of the bucket. This
+// must be called with r.l held.
+func (r *RateLimiter) burst() int64 {
+	return int64(rateLimitBurst.Seconds() * float64(r.rate))
+}
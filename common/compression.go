@@ -323,6 +323,9 @@ func (c *compressor) Compress(h http.Header) ([]byte, error) {
 }
 
 func (c *compressor) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
 	if c.w == nil {
 		return nil
 	}
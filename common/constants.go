@@ -88,6 +88,15 @@ const MAX_FRAME_SIZE = 0xffffff
 
 const MAX_DATA_SIZE = 0xffffff
 
+// Default maximum payload of each DATA frame sent. Larger
+// writes are split into several frames, so that frames
+// from concurrent streams can be interleaved.
+const DEFAULT_MAX_DATA_SIZE = 16 << 10
+
+// Default maximum data buffered while waiting for flow
+// control, after which writes block until it is sent.
+const DEFAULT_MAX_BUFFERED_DATA = 1 << 20
+
 // Maximum stream ID (2 ** 31 -1).
 const MAX_STREAM_ID = 0x7fffffff
 
@@ -100,6 +109,10 @@ const DEFAULT_INITIAL_WINDOW_SIZE = 65535
 // The default initial transfer window sent by the client.
 const DEFAULT_INITIAL_CLIENT_WINDOW_SIZE = 10485760
 
+// The default ceiling on transfer windows grown by
+// adaptive flow control.
+const DEFAULT_MAX_ADAPTIVE_WINDOW_SIZE = 16 << 20
+
 // Maximum delta window size field for WINDOW_UPDATE.
 const MAX_DELTA_WINDOW_SIZE = 0x7fffffff
 
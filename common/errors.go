@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"time"
 )
 
 // MaxBenignErrors is the maximum number of minor errors each
@@ -36,6 +37,16 @@ var (
 	// ErrNotConnected indicates that a SPDY-specific feature was
 	// attempted with a Client not connected to the given server.
 	ErrNotConnected = errors.New("Error: Not connected to given server.")
+
+	// ErrPushRefused is returned when writing to a push stream
+	// which the client has refused or cancelled.
+	ErrPushRefused = errors.New("Error: Push refused by client.")
+
+	// ErrStreamRefused is returned when the server refuses a
+	// request stream without processing it, such as when its
+	// limit on concurrent handlers has been reached. The
+	// request may be retried.
+	ErrStreamRefused = errors.New("Error: Stream refused by server.")
 )
 
 type incorrectDataLength struct {
@@ -84,6 +95,32 @@ var StreamIdTooLarge = errors.New("Error: Stream ID is too large.")
 
 var StreamIdIsZero = errors.New("Error: Stream ID is zero.")
 
+// TimeoutError is returned when a request exceeds one of
+// the deadlines set on it, such as spdy.Transport's
+// ResponseHeaderTimeout. It satisfies the net.Error
+// interface.
+type TimeoutError struct {
+	Op    string        // The stage of the request that timed out.
+	Limit time.Duration // The timeout that was exceeded, if known.
+}
+
+func (t *TimeoutError) Error() string {
+	if t.Limit == 0 {
+		return fmt.Sprintf("Error: Timed out %s.", t.Op)
+	}
+	return fmt.Sprintf("Error: Timed out %s after %v.", t.Op, t.Limit)
+}
+
+// Timeout always returns true.
+func (t *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary always returns true.
+func (t *TimeoutError) Temporary() bool {
+	return true
+}
+
 type UnsupportedVersion uint16
 
 func (u UnsupportedVersion) Error() string {
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"time"
 )
 
 // Connection represents a SPDY connection. The connection should
@@ -124,6 +125,16 @@ type Receiver interface {
 	ReceiveRequest(request *http.Request) bool
 }
 
+// Objects conforming to the AbortReceiver interface are
+// also told when an accepted server push ends before it
+// is complete, such as when the server resets the push
+// or the connection is closed. ReceiveAbort is called
+// instead of the final call to ReceiveData.
+type AbortReceiver interface {
+	Receiver
+	ReceiveAbort(request *http.Request)
+}
+
 // Objects conforming to the FlowControl interface can be
 // used to provide the flow control mechanism for a
 // connection using SPDY version 3 and above.
@@ -147,3 +158,21 @@ type FlowControl interface {
 	InitialWindowSize() uint32
 	ReceiveData(streamID StreamID, initialWindowSize uint32, newWindowSize int64) (deltaSize uint32)
 }
+
+// Objects conforming to the AdaptiveFlowControl interface
+// are FlowControls which adapt the transfer windows to the
+// connection's round-trip time.
+//
+// MeasureRTT is called as data is received, and should
+// return true when a new measurement of the round-trip
+// time is wanted. The connection then sends a PING and
+// passes the time taken for the reply to ReceiveRTT.
+//
+// StreamClosed is called when a stream is closed, so
+// any state kept for the stream can be released.
+type AdaptiveFlowControl interface {
+	FlowControl
+	MeasureRTT() bool
+	ReceiveRTT(rtt time.Duration)
+	StreamClosed(streamID StreamID)
+}
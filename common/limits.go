@@ -58,3 +58,127 @@ func (s *StreamLimit) Close() {
 	s.current--
 	s.lock.Unlock()
 }
+
+// HandlerLimit is used to limit the number of
+// handlers executing concurrently. Streams waiting
+// for a handler are started in priority order, and
+// in order of arrival within each priority. A nil
+// HandlerLimit imposes no limit.
+type HandlerLimit struct {
+	lock    sync.Mutex
+	limit   int
+	current int
+	waiting [8][]chan struct{} // waiting streams, by priority.
+}
+
+func NewHandlerLimit(limit int) *HandlerLimit {
+	out := new(HandlerLimit)
+	out.limit = limit
+	return out
+}
+
+// Limit returns the current limit.
+func (h *HandlerLimit) Limit() int {
+	if h == nil {
+		return 0
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.limit
+}
+
+// Waiting returns the number of handlers
+// waiting to start.
+func (h *HandlerLimit) Waiting() int {
+	if h == nil {
+		return 0
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	n := 0
+	for _, waiting := range h.waiting {
+		n += len(waiting)
+	}
+	return n
+}
+
+// Add is called when a handler is to be started
+// without waiting. Add returns a bool indicating
+// whether the handler may start.
+func (h *HandlerLimit) Add() bool {
+	if h == nil {
+		return true
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.current >= h.limit {
+		return false
+	}
+	h.current++
+	return true
+}
+
+// Wait is called when a handler is to be started,
+// blocking until it may start or stop is closed.
+// Wait returns a bool indicating whether the
+// handler may start.
+func (h *HandlerLimit) Wait(priority Priority, stop <-chan bool) bool {
+	if h == nil {
+		return true
+	}
+	h.lock.Lock()
+	if h.current < h.limit {
+		h.current++
+		h.lock.Unlock()
+		return true
+	}
+	p := priority & 7
+	ready := make(chan struct{})
+	h.waiting[p] = append(h.waiting[p], ready)
+	h.lock.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-stop:
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, c := range h.waiting[p] {
+		if c == ready {
+			h.waiting[p] = append(h.waiting[p][:i], h.waiting[p][i+1:]...)
+			return false
+		}
+	}
+
+	// The handler was started as stop was closed,
+	// so the slot is passed on.
+	h.release()
+	return false
+}
+
+// Close is called when a handler finishes; thus
+// starting the next waiting handler, if any.
+func (h *HandlerLimit) Close() {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	h.release()
+	h.lock.Unlock()
+}
+
+// release passes the slot to the highest-priority
+// waiting handler, or frees it if there is none.
+// The lock must be held.
+func (h *HandlerLimit) release() {
+	for p, waiting := range h.waiting {
+		if len(waiting) > 0 {
+			close(waiting[0])
+			h.waiting[p] = waiting[1:]
+			return
+		}
+	}
+	h.current--
+}
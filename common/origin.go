@@ -0,0 +1,67 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// OriginPolicy restricts the hosts for which a server
+// connection serves requests. Since a client chooses the
+// :host of each request, a connection could otherwise be
+// used for any host, regardless of the certificate the
+// server presented. A nil OriginPolicy allows every host.
+type OriginPolicy struct {
+	// Certificate is the certificate presented by the
+	// server, and any host it covers is allowed.
+	Certificate *x509.Certificate
+
+	// Hosts are further hosts which are allowed. A host
+	// beginning with "*." allows any of its subdomains.
+	Hosts []string
+}
+
+// Allow returns whether requests for the given
+// host, which may include a port, are served.
+func (p *OriginPolicy) Allow(host string) bool {
+	if p == nil {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return false
+	}
+
+	if p.Certificate != nil && p.Certificate.VerifyHostname(host) == nil {
+		return true
+	}
+
+	for _, allowed := range p.Hosts {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "."))
+		if allowed == host {
+			return true
+		}
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MisdirectedRequest replies to requests for hosts
+// which are not allowed by a connection's OriginPolicy,
+// so that the client can retry on another connection.
+func MisdirectedRequest(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Pipe is used to stream a request body to a handler as
+// it is received. Data written to the Pipe is buffered
+// until it is read, and reads block until data is
+// available or the Pipe is closed by the writer.
+type Pipe struct {
+	m      sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error     // error returned once buffered data is read.
+	closed bool      // whether the reader has closed the Pipe.
+	onRead func(int) // called with the number of bytes consumed.
+
+	trailer http.Header // filled in from pending once the reader reaches io.EOF.
+	pending http.Header // trailers received but not yet read.
+}
+
+// NewPipe creates a Pipe. If onRead is non-nil, it is
+// called with the number of bytes consumed whenever data
+// is read, or discarded after the reader closes the Pipe.
+// This is used to regrow flow control windows.
+func NewPipe(onRead func(int)) *Pipe {
+	out := new(Pipe)
+	out.cond = sync.NewCond(&out.m)
+	out.onRead = onRead
+	return out
+}
+
+// Write adds data to the Pipe. If the reader has closed
+// the Pipe, the data is discarded.
+func (p *Pipe) Write(b []byte) (int, error) {
+	p.m.Lock()
+	if p.err != nil {
+		p.m.Unlock()
+		return 0, errors.New("Error: Write to closed pipe.")
+	}
+	if p.closed {
+		p.m.Unlock()
+		p.consumed(len(b))
+		return len(b), nil
+	}
+	n, err := p.buf.Write(b)
+	p.cond.Broadcast()
+	p.m.Unlock()
+	return n, err
+}
+
+// CloseWithError ends the Pipe. Once any buffered data has
+// been read, reads will return err. CloseWithError should
+// be called with io.EOF once the body is complete. Only
+// the first call has any effect.
+func (p *Pipe) CloseWithError(err error) {
+	p.m.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+	p.m.Unlock()
+}
+
+// SetTrailer sets the Header which receives the trailers
+// added with AddTrailer. It is filled in by the reader once
+// it reaches io.EOF, so the reader may safely inspect the
+// trailer before then.
+func (p *Pipe) SetTrailer(trailer http.Header) {
+	p.m.Lock()
+	p.trailer = trailer
+	p.m.Unlock()
+}
+
+// AddTrailer adds header to the trailers and, if final is
+// true, ends the Pipe with io.EOF.
+func (p *Pipe) AddTrailer(header http.Header, final bool) {
+	p.m.Lock()
+	if p.pending == nil {
+		p.pending = make(http.Header)
+	}
+	UpdateHeader(p.pending, header)
+	if final && p.err == nil {
+		p.err = io.EOF
+	}
+	p.cond.Broadcast()
+	p.m.Unlock()
+}
+
+// Read reads data from the Pipe, blocking until data is
+// available or the Pipe has been closed.
+func (p *Pipe) Read(b []byte) (int, error) {
+	p.m.Lock()
+	for p.buf.Len() == 0 && p.err == nil && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		p.m.Unlock()
+		return 0, errors.New("Error: Read on closed body.")
+	}
+	if p.buf.Len() == 0 {
+		err := p.err
+		if err == io.EOF && p.trailer != nil && p.pending != nil {
+			UpdateHeader(p.trailer, p.pending)
+			p.pending = nil
+		}
+		p.m.Unlock()
+		return 0, err
+	}
+	n, _ := p.buf.Read(b)
+	p.m.Unlock()
+	p.consumed(n)
+	return n, nil
+}
+
+// Close closes the reading end of the Pipe. Any buffered
+// or later data is discarded.
+func (p *Pipe) Close() error {
+	p.m.Lock()
+	if p.closed {
+		p.m.Unlock()
+		return nil
+	}
+	p.closed = true
+	n := p.buf.Len()
+	p.buf.Reset()
+	p.cond.Broadcast()
+	p.m.Unlock()
+	p.consumed(n)
+	return nil
+}
+
+func (p *Pipe) consumed(n int) {
+	if n > 0 && p.onRead != nil {
+		p.onRead(n)
+	}
+}
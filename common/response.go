@@ -30,8 +30,11 @@ import (
 type Response struct {
 	StatusCode int
 
-	headerM sync.Mutex
-	Header  http.Header
+	headerM        sync.Mutex
+	Header         http.Header
+	Trailer        http.Header
+	headerReceived chan struct{}
+	bodyStarted    bool
 
 	dataM sync.Mutex
 	data  *hybridBuffer
@@ -44,6 +47,7 @@ func NewResponse(request *http.Request, receiver Receiver) *Response {
 	resp := new(Response)
 	resp.Request = request
 	resp.Receiver = receiver
+	resp.headerReceived = make(chan struct{})
 	if receiver == nil {
 		resp.data = newHybridBuffer()
 	}
@@ -51,6 +55,11 @@ func NewResponse(request *http.Request, receiver Receiver) *Response {
 }
 
 func (r *Response) ReceiveData(req *http.Request, data []byte, finished bool) {
+	if len(data) > 0 {
+		r.headerM.Lock()
+		r.bodyStarted = true
+		r.headerM.Unlock()
+	}
 	if r.Receiver != nil {
 		r.Receiver.ReceiveData(req, data, finished)
 	} else {
@@ -62,11 +71,30 @@ func (r *Response) ReceiveData(req *http.Request, data []byte, finished bool) {
 
 func (r *Response) ReceiveHeader(req *http.Request, header http.Header) {
 	r.headerM.Lock()
+
+	// Headers sent after the body, or which have
+	// been declared as trailers, are trailers.
+	if r.bodyStarted || declaredTrailers(r.Header, header) {
+		if r.Trailer == nil {
+			r.Trailer = make(http.Header)
+		}
+		UpdateHeader(r.Trailer, header)
+		if r.Receiver != nil {
+			r.Receiver.ReceiveHeader(req, header)
+		}
+		r.headerM.Unlock()
+		return
+	}
+
 	if r.Header == nil {
 		r.Header = make(http.Header)
 	}
 	UpdateHeader(r.Header, header)
-	if status := r.Header.Get(":status"); status != "" {
+	status := r.Header.Get(":status")
+	if status == "" {
+		status = r.Header.Get("Status") // SPDY/2
+	}
+	if status != "" {
 		status = strings.TrimSpace(status)
 		if i := strings.Index(status, " "); i >= 0 {
 			status = status[:i]
@@ -79,9 +107,37 @@ func (r *Response) ReceiveHeader(req *http.Request, header http.Header) {
 	if r.Receiver != nil {
 		r.Receiver.ReceiveHeader(req, header)
 	}
+	select {
+	case <-r.headerReceived:
+	default:
+		close(r.headerReceived)
+	}
 	r.headerM.Unlock()
 }
 
+// declaredTrailers indicates whether every name in
+// header has been declared as a trailer in the given
+// response headers.
+func declaredTrailers(response, header http.Header) bool {
+	keys := TrailerKeys(response)
+	if len(keys) == 0 || len(header) == 0 {
+		return false
+	}
+	for name := range header {
+		if !IsTrailer(name, keys) {
+			return false
+		}
+	}
+	return true
+}
+
+// HeaderReceived returns a channel which is closed
+// once the first set of response headers has been
+// received.
+func (r *Response) HeaderReceived() <-chan struct{} {
+	return r.headerReceived
+}
+
 func (r *Response) ReceiveRequest(req *http.Request) bool {
 	if r.Receiver != nil {
 		return r.Receiver.ReceiveRequest(req)
@@ -96,6 +152,13 @@ func (r *Response) Response() *http.Response {
 	out.Status = fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode))
 	out.StatusCode = r.StatusCode
 	out.Header = r.Header
+	out.Trailer = make(http.Header)
+	for _, key := range TrailerKeys(r.Header) {
+		out.Trailer[key] = nil
+	}
+	for key, values := range r.Trailer {
+		out.Trailer[http.CanonicalHeaderKey(key)] = values
+	}
 	r.headerM.Unlock()
 
 	out.Proto = "HTTP/1.1"
@@ -123,7 +186,6 @@ func (r *Response) Response() *http.Response {
 
 	out.TransferEncoding = nil
 	out.Close = true
-	out.Trailer = make(http.Header)
 	out.Request = r.Request
 	return out
 }
@@ -0,0 +1,252 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+// ScheduledFrame is a frame waiting to be sent, with
+// the details used by a Scheduler to order it.
+type ScheduledFrame struct {
+	Frame    Frame
+	StreamID StreamID // zero for frames about the whole connection.
+	Priority Priority // the priority of the output channel used.
+	Size     int      // approximate size of the frame in bytes.
+}
+
+// Scheduler decides the order in which a connection sends
+// its frames. Frames waiting to be sent are pushed to the
+// scheduler, which pops the next frame to send each time
+// the connection is ready to write.
+//
+// A Scheduler is used only by the goroutine sending frames
+// on a single connection, so need not be safe for concurrent
+// use, but must not be shared between connections.
+//
+// A stream's frames are pushed in the order the stream sent
+// them, but not always with the same priority. For example,
+// a server push's SYN_STREAM is sent with priority 0 and its
+// DATA with priority 7. A Scheduler must never pop a frame
+// before one pushed earlier on the same stream with the same
+// or a higher priority (a smaller number), so the SYN_STREAM
+// is always sent before the DATA it precedes.
+type Scheduler interface {
+	// Push adds a frame to be sent.
+	Push(frame ScheduledFrame)
+
+	// Pop removes and returns the next frame to
+	// send, or nil if there are no frames waiting.
+	Pop() Frame
+
+	// Len returns the number of frames waiting.
+	Len() int
+}
+
+// priorityIndex returns the queue used for a priority.
+func priorityIndex(priority Priority) int {
+	if priority > 7 {
+		return 7
+	}
+	return int(priority)
+}
+
+// NewPriorityScheduler returns a Scheduler which always
+// sends the waiting frame with the highest priority (the
+// smallest number), in the order they were pushed. Frames
+// with low priority are sent only when no others are
+// waiting, so can be starved by a busy connection.
+func NewPriorityScheduler() Scheduler {
+	return new(priorityScheduler)
+}
+
+type priorityScheduler struct {
+	queues [8][]Frame
+	n      int
+}
+
+func (s *priorityScheduler) Push(frame ScheduledFrame) {
+	i := priorityIndex(frame.Priority)
+	s.queues[i] = append(s.queues[i], frame.Frame)
+	s.n++
+}
+
+func (s *priorityScheduler) Pop() Frame {
+	for i, queue := range s.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		frame := queue[0]
+		queue[0] = nil
+		s.queues[i] = queue[1:]
+		s.n--
+		return frame
+	}
+	return nil
+}
+
+func (s *priorityScheduler) Len() int {
+	return s.n
+}
+
+// weightedCost scales frame sizes so that dividing by
+// any of the weights 1 to 8 gives a whole number.
+const weightedCost = 840
+
+// NewWeightedScheduler returns a Scheduler which shares the
+// connection between streams using weighted fair queueing.
+// Each stream receives bandwidth in proportion to its weight,
+// which is 8 for priority 0, down to 1 for priority 7, so busy
+// high-priority streams cannot starve those with low priority,
+// and streams with the same priority take turns. Frames about
+// the whole connection are treated as a single stream. This is
+// the default Scheduler.
+func NewWeightedScheduler() Scheduler {
+	return &weightedScheduler{
+		flows: make(map[StreamID]*weightedFlow),
+	}
+}
+
+type weightedFrame struct {
+	frame Frame
+	start uint64 // virtual time at which the frame starts sending.
+	seq   uint64 // order in which the frame was pushed.
+}
+
+type weightedFlow struct {
+	queue  []weightedFrame
+	finish uint64 // virtual time at which the last frame pushed finishes sending.
+}
+
+type weightedScheduler struct {
+	flows   map[StreamID]*weightedFlow
+	virtual uint64 // start time of the last frame popped.
+	seq     uint64
+	n       int
+}
+
+func (s *weightedScheduler) Push(frame ScheduledFrame) {
+	weight := uint64(8 - priorityIndex(frame.Priority))
+	size := frame.Size
+	if size < 1 {
+		size = 1
+	}
+
+	flow := s.flows[frame.StreamID]
+	if flow == nil {
+		flow = new(weightedFlow)
+		s.flows[frame.StreamID] = flow
+	}
+
+	// A stream which has been idle does not build up
+	// credit, so starts from the current virtual time.
+	start := flow.finish
+	if start < s.virtual {
+		start = s.virtual
+	}
+	flow.finish = start + uint64(size)*weightedCost/weight
+
+	flow.queue = append(flow.queue, weightedFrame{frame: frame.Frame, start: start, seq: s.seq})
+	s.seq++
+	s.n++
+}
+
+func (s *weightedScheduler) Pop() Frame {
+	var next *weightedFlow
+	for id, flow := range s.flows {
+		if len(flow.queue) == 0 {
+			// Forget idle streams once they
+			// no longer affect the schedule.
+			if flow.finish <= s.virtual {
+				delete(s.flows, id)
+			}
+			continue
+		}
+
+		// Frames starting at the same time are
+		// sent in the order they were pushed.
+		head := flow.queue[0]
+		if next == nil || head.start < next.queue[0].start ||
+			(head.start == next.queue[0].start && head.seq < next.queue[0].seq) {
+			next = flow
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	frame := next.queue[0]
+	next.queue[0] = weightedFrame{}
+	next.queue = next.queue[1:]
+	if frame.start > s.virtual {
+		s.virtual = frame.start
+	}
+	s.n--
+	return frame.frame
+}
+
+func (s *weightedScheduler) Len() int {
+	return s.n
+}
+
+// NewRoundRobinScheduler returns a Scheduler which takes
+// turns between streams, sending one frame from each stream
+// with frames waiting, regardless of priority. Frames about
+// the whole connection, such as SETTINGS and PING, are sent
+// before any others. Each stream's frames are sent in the
+// order they were pushed.
+func NewRoundRobinScheduler() Scheduler {
+	return &roundRobinScheduler{
+		queues: make(map[StreamID][]Frame),
+	}
+}
+
+type roundRobinScheduler struct {
+	control []Frame              // frames about the whole connection.
+	queues  map[StreamID][]Frame // frames waiting on each stream.
+	turns   []StreamID           // streams with frames waiting, in turn order.
+	n       int
+}
+
+func (s *roundRobinScheduler) Push(frame ScheduledFrame) {
+	s.n++
+	if frame.StreamID == 0 {
+		s.control = append(s.control, frame.Frame)
+		return
+	}
+
+	queue := s.queues[frame.StreamID]
+	if len(queue) == 0 {
+		s.turns = append(s.turns, frame.StreamID)
+	}
+	s.queues[frame.StreamID] = append(queue, frame.Frame)
+}
+
+func (s *roundRobinScheduler) Pop() Frame {
+	if len(s.control) > 0 {
+		frame := s.control[0]
+		s.control[0] = nil
+		s.control = s.control[1:]
+		s.n--
+		return frame
+	}
+	if len(s.turns) == 0 {
+		return nil
+	}
+
+	id := s.turns[0]
+	s.turns = s.turns[1:]
+	queue := s.queues[id]
+	frame := queue[0]
+	queue[0] = nil
+	if queue = queue[1:]; len(queue) > 0 {
+		s.queues[id] = queue
+		s.turns = append(s.turns, id)
+	} else {
+		delete(s.queues, id)
+	}
+	s.n--
+	return frame
+}
+
+func (s *roundRobinScheduler) Len() int {
+	return s.n
+}
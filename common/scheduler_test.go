@@ -0,0 +1,144 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+type push struct {
+	stream   common.StreamID
+	priority common.Priority
+	size     int
+}
+
+// schedule pushes the frames to the scheduler, then
+// pops them all, returning the order they were sent.
+// Each frame records its stream and its position in
+// the stream.
+func schedule(t *testing.T, name string, scheduler common.Scheduler, pushes []push) []string {
+	counts := make(map[common.StreamID]int)
+	for _, p := range pushes {
+		data := []byte(fmt.Sprintf("%d.%d", p.stream, counts[p.stream]))
+		counts[p.stream]++
+		frame := &frames.DATA{StreamID: p.stream, Data: data}
+		scheduler.Push(common.ScheduledFrame{Frame: frame, StreamID: p.stream, Priority: p.priority, Size: p.size})
+	}
+	if n := scheduler.Len(); n != len(pushes) {
+		t.Errorf("%s: Len is %d, expected %d", name, n, len(pushes))
+	}
+
+	var order []string
+	for frame := scheduler.Pop(); frame != nil; frame = scheduler.Pop() {
+		order = append(order, string(frame.(*frames.DATA).Data))
+	}
+	if n := scheduler.Len(); n != 0 {
+		t.Errorf("%s: Len is %d after popping all frames", name, n)
+	}
+	return order
+}
+
+func TestSchedulers(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduler common.Scheduler
+		pushes    []push
+		expect    []string
+	}{
+		{
+			name:      "priority",
+			scheduler: common.NewPriorityScheduler(),
+			pushes:    []push{{1, 3, 10}, {3, 0, 10}, {5, 7, 10}, {3, 0, 10}, {1, 3, 10}, {0, 0, 0}},
+			expect:    []string{"3.0", "3.1", "0.0", "1.0", "1.1", "5.0"},
+		},
+		{
+			// Priority 0 has 8 times the weight of priority 7.
+			name:      "weighted",
+			scheduler: common.NewWeightedScheduler(),
+			pushes: []push{
+				{1, 0, 100}, {1, 0, 100}, {1, 0, 100}, {1, 0, 100}, {1, 0, 100}, {1, 0, 100},
+				{1, 0, 100}, {1, 0, 100}, {1, 0, 100}, {1, 0, 100}, {3, 7, 100}, {3, 7, 100},
+			},
+			expect: []string{"1.0", "3.0", "1.1", "1.2", "1.3", "1.4", "1.5", "1.6", "1.7", "1.8", "3.1", "1.9"},
+		},
+		{
+			// Priority 1 has weight 7, so sends 700 bytes
+			// in the time priority 0 sends 800.
+			name:      "weighted sizes",
+			scheduler: common.NewWeightedScheduler(),
+			pushes:    []push{{1, 0, 800}, {1, 0, 800}, {3, 1, 700}, {3, 1, 700}, {3, 1, 700}},
+			expect:    []string{"1.0", "3.0", "1.1", "3.1", "3.2"},
+		},
+		{
+			// Streams with the same priority take turns.
+			name:      "weighted streams",
+			scheduler: common.NewWeightedScheduler(),
+			pushes:    []push{{1, 2, 100}, {1, 2, 100}, {1, 2, 100}, {3, 2, 100}, {3, 2, 100}, {0, 0, 0}},
+			expect:    []string{"1.0", "3.0", "0.0", "1.1", "3.1", "1.2"},
+		},
+		{
+			name:      "round robin",
+			scheduler: common.NewRoundRobinScheduler(),
+			pushes:    []push{{1, 0, 10}, {1, 0, 10}, {1, 0, 10}, {3, 7, 10}, {5, 2, 10}, {0, 0, 0}, {5, 2, 10}},
+			expect:    []string{"0.0", "1.0", "3.0", "5.0", "1.1", "5.1", "1.2"},
+		},
+	}
+
+	for _, test := range tests {
+		order := schedule(t, test.name, test.scheduler, test.pushes)
+		if fmt.Sprint(order) != fmt.Sprint(test.expect) {
+			t.Errorf("%s: sent %v, expected %v", test.name, order, test.expect)
+		}
+	}
+}
+
+// TestSchedulerStreamOrder checks that no scheduler sends
+// a frame before one pushed earlier on the same stream with
+// the same or a higher priority, such as a server push's
+// SYN_STREAM, sent with priority 0, and its DATA, sent with
+// priority 7.
+func TestSchedulerStreamOrder(t *testing.T) {
+	pushes := []push{
+		{1, 0, 1000}, {1, 0, 1000}, {2, 0, 8}, {1, 0, 1000}, {2, 7, 1000},
+		{1, 0, 1000}, {2, 7, 1000}, {4, 0, 8}, {2, 0, 8}, {4, 7, 1000},
+		{1, 3, 1000}, {4, 7, 1000}, {0, 0, 8}, {2, 7, 1000}, {1, 0, 1000},
+	}
+
+	schedulers := map[string]func() common.Scheduler{
+		"priority":    common.NewPriorityScheduler,
+		"weighted":    common.NewWeightedScheduler,
+		"round robin": common.NewRoundRobinScheduler,
+	}
+	for name, scheduler := range schedulers {
+		order := schedule(t, name, scheduler(), pushes)
+		sent := make(map[string]int)
+		for i, label := range order {
+			sent[label] = i
+		}
+
+		// Compare each pair of frames on the same stream.
+		counts := make(map[common.StreamID]int)
+		labels := make([]string, len(pushes))
+		for i, p := range pushes {
+			labels[i] = fmt.Sprintf("%d.%d", p.stream, counts[p.stream])
+			counts[p.stream]++
+		}
+		for i, early := range pushes {
+			for j := i + 1; j < len(pushes); j++ {
+				late := pushes[j]
+				if late.stream != early.stream || late.priority < early.priority {
+					continue
+				}
+				if sent[labels[j]] < sent[labels[i]] {
+					t.Errorf("%s: sent %s before %s: %v", name, labels[j], labels[i], order)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package common
+
+import (
+	"sync"
+)
+
+// StreamStats describes an active stream, such as when
+// debugging a stalled response. The transfer windows are
+// only used with SPDY/3 and later, so are zero otherwise.
+type StreamStats struct {
+	StreamID      StreamID
+	State         StreamStatus // the stream's state when the stats were taken.
+	Priority      Priority
+	SendWindow    int64 // transfer window for data sent.
+	ReceiveWindow int64 // transfer window for data received.
+	Buffered      int64 // data waiting for the send window.
+	BytesSent     int64 // data sent in DATA frames.
+	BytesReceived int64 // data received in DATA frames.
+}
+
+// ConnStats describes a connection and its active
+// streams. The connection-level transfer windows are
+// only used with SPDY/3.1 and later, so are zero
+// otherwise.
+type ConnStats struct {
+	Version       int
+	Subversion    int
+	SendWindow    int64         // connection-level transfer window for data sent.
+	ReceiveWindow int64         // connection-level transfer window for data received.
+	Buffered      int64         // data waiting for the connection-level send window.
+	Streams       []StreamStats // active streams, in order of stream ID.
+}
+
+// Transferred counts the data sent and
+// received on a stream.
+type Transferred struct {
+	l        sync.Mutex
+	sent     int64
+	received int64
+}
+
+// Sent records that n bytes were sent.
+func (t *Transferred) Sent(n int) {
+	t.l.Lock()
+	t.sent += int64(n)
+	t.l.Unlock()
+}
+
+// Received records that n bytes were received.
+func (t *Transferred) Received(n int) {
+	t.l.Lock()
+	t.received += int64(n)
+	t.l.Unlock()
+}
+
+// Counts returns the bytes sent and received.
+func (t *Transferred) Counts() (sent, received int64) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.sent, t.received
+}
@@ -8,12 +8,49 @@ import (
 	"sync"
 )
 
+// StreamStatus is a stream's state at a given moment,
+// as reported in StreamStats.
+type StreamStatus uint8
+
+// Stream states.
+const (
+	StreamOpen StreamStatus = iota
+	StreamHalfClosedHere
+	StreamHalfClosedThere
+	StreamClosed
+)
+
+// Check whether the stream was half-closed at the other endpoint.
+func (s StreamStatus) ClosedThere() bool {
+	return s == StreamClosed || s == StreamHalfClosedThere
+}
+
+// Check whether the stream was half-closed locally.
+func (s StreamStatus) ClosedHere() bool {
+	return s == StreamClosed || s == StreamHalfClosedHere
+}
+
+// State description.
+func (s StreamStatus) String() string {
+	switch s {
+	case StreamOpen:
+		return "open"
+	case StreamHalfClosedHere:
+		return "half-closed here"
+	case StreamHalfClosedThere:
+		return "half-closed there"
+	case StreamClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 // State variables used internally in StreamState.
 const (
-	stateOpen uint8 = iota
-	stateHalfClosedHere
-	stateHalfClosedThere
-	stateClosed
+	stateOpen            = uint8(StreamOpen)
+	stateHalfClosedHere  = uint8(StreamHalfClosedHere)
+	stateHalfClosedThere = uint8(StreamHalfClosedThere)
+	stateClosed          = uint8(StreamClosed)
 )
 
 // StreamState is used to store and query the stream's state. The active methods
@@ -66,6 +103,14 @@ func (s *StreamState) OpenHere() bool {
 	return !s.ClosedHere()
 }
 
+// Status returns the stream's current state.
+func (s *StreamState) Status() StreamStatus {
+	s.l.Lock()
+	status := StreamStatus(s.s)
+	s.l.Unlock()
+	return status
+}
+
 // Closes the stream.
 func (s *StreamState) Close() {
 	s.l.Lock()
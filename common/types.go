@@ -153,8 +153,6 @@ func (r StatusCode) IsFatal() bool {
 	switch r {
 	case RST_STREAM_PROTOCOL_ERROR:
 		return true
-	case RST_STREAM_INTERNAL_ERROR:
-		return true
 	case RST_STREAM_FRAME_TOO_LARGE:
 		return true
 	case RST_STREAM_UNSUPPORTED_VERSION:
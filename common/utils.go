@@ -7,6 +7,8 @@ package common
 import (
 	"io"
 	"net/http"
+	"sort"
+	"strings"
 )
 
 // CloneHeader returns a duplicate of the provided Header.
@@ -34,6 +36,146 @@ func UpdateHeader(older, newer http.Header) {
 	}
 }
 
+// TrailerKeys returns the canonical names of the trailers
+// declared in the given header's "Trailer" field.
+func TrailerKeys(h http.Header) []string {
+	var keys []string
+	for _, value := range h["Trailer"] {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, http.CanonicalHeaderKey(key))
+			}
+		}
+	}
+	return keys
+}
+
+// IsTrailer indicates whether the given header name is
+// to be sent as a trailer, either because it has been
+// declared in keys, or because it has the prefix
+// http.TrailerPrefix.
+func IsTrailer(name string, keys []string) bool {
+	if strings.HasPrefix(name, http.TrailerPrefix) {
+		return true
+	}
+	for _, key := range keys {
+		if http.CanonicalHeaderKey(name) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// TakeTrailer removes all headers from h and returns
+// them in a new Header, with http.TrailerPrefix removed
+// from any names that have it.
+func TakeTrailer(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		key := strings.TrimPrefix(name, http.TrailerPrefix)
+		out[key] = append(out[key], values...)
+		delete(h, name)
+	}
+	return out
+}
+
+// SplitTrailer removes the trailers from h, which are those
+// declared in its "Trailer" field or with the prefix
+// http.TrailerPrefix, and returns them in a new Header, with
+// http.TrailerPrefix removed from their names. The "Trailer"
+// field in h is set to declare the trailers returned.
+func SplitTrailer(h http.Header) http.Header {
+	keys := TrailerKeys(h)
+	out := make(http.Header)
+	for name, values := range h {
+		if !IsTrailer(name, keys) {
+			continue
+		}
+		key := strings.TrimPrefix(name, http.TrailerPrefix)
+		out[key] = append(out[key], values...)
+		delete(h, name)
+	}
+	DeclareTrailer(h, out)
+	return out
+}
+
+// DeclareTrailer sets the "Trailer" field in h to list
+// the names of the given trailers.
+func DeclareTrailer(h, trailer http.Header) {
+	if len(trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(trailer))
+	for key := range trailer {
+		keys = append(keys, http.CanonicalHeaderKey(key))
+	}
+	sort.Strings(keys)
+	h.Set("Trailer", strings.Join(keys, ", "))
+}
+
+// PreloadLinks returns the targets of the links in the
+// given header's "Link" field with the relation "preload",
+// excluding those with the "nopush" parameter.
+func PreloadLinks(h http.Header) []string {
+	var targets []string
+	for _, value := range h["Link"] {
+		for _, link := range splitLinks(value) {
+			link = strings.TrimSpace(link)
+			end := strings.Index(link, ">")
+			if !strings.HasPrefix(link, "<") || end < 0 {
+				continue
+			}
+			target := strings.TrimSpace(link[1:end])
+			preload, nopush := false, false
+			for _, param := range strings.Split(link[end+1:], ";") {
+				name, value := param, ""
+				if i := strings.Index(param, "="); i >= 0 {
+					name, value = param[:i], param[i+1:]
+				}
+				name = strings.ToLower(strings.TrimSpace(name))
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				switch name {
+				case "rel":
+					for _, rel := range strings.Fields(value) {
+						if strings.EqualFold(rel, "preload") {
+							preload = true
+						}
+					}
+				case "nopush":
+					nopush = true
+				}
+			}
+			if preload && !nopush && target != "" {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets
+}
+
+// splitLinks splits a "Link" header value into its
+// comma-separated links, ignoring commas in targets
+// and quoted parameters.
+func splitLinks(value string) []string {
+	var links []string
+	inTarget, inQuote := false, false
+	start := 0
+	for i, c := range value {
+		switch {
+		case c == '"' && !inTarget:
+			inQuote = !inQuote
+		case c == '<' && !inQuote:
+			inTarget = true
+		case c == '>' && !inQuote:
+			inTarget = false
+		case c == ',' && !inTarget && !inQuote:
+			links = append(links, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(links, value[start:])
+}
+
 func BytesToUint16(b []byte) uint16 {
 	return (uint16(b[0]) << 8) + uint16(b[1])
 }
@@ -0,0 +1,312 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// httpConn is an HTTP/1.1 connection used by the Transport
+// when SPDY is not available. Once a response body has been
+// read, the connection is returned to the Transport's pool
+// of idle connections for reuse.
+type httpConn struct {
+	t         *Transport
+	host      string        // host:port of the endpoint.
+	conn      net.Conn      // underlying network connection.
+	br        *bufio.Reader // buffered reader on conn.
+	bw        *bufio.Writer // buffered writer on conn.
+	slots     chan struct{} // connection slots for the host; one is freed on close.
+	reused    bool          // whether the connection has been used before.
+	idleTimer *time.Timer   // closes the connection if it stays idle.
+	closeOnce sync.Once     // ensures the slot is freed once.
+}
+
+func newHTTPConn(t *Transport, host string, conn net.Conn, slots chan struct{}) *httpConn {
+	out := new(httpConn)
+	out.t = t
+	out.host = host
+	out.conn = conn
+	out.br = bufio.NewReader(conn)
+	out.bw = bufio.NewWriter(conn)
+	out.slots = slots
+	return out
+}
+
+// close closes the underlying connection, freeing
+// up its connection slot. Multiple calls to close
+// are safe.
+func (c *httpConn) close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		c.slots <- struct{}{}
+	})
+}
+
+// release is called once a response has been fully
+// read. If keepAlive is true, the connection is
+// returned to the pool, otherwise it is closed.
+func (c *httpConn) release(keepAlive bool) {
+	if !keepAlive || c.t.DisableKeepAlives {
+		c.close()
+		return
+	}
+	c.t.putIdle(c)
+}
+
+// do sends the request on the connection and reads the
+// response headers. The response body will release the
+// connection once it has been read or closed.
+func (c *httpConn) do(req *http.Request) (*http.Response, error) {
+	// Apply any deadlines. The response header deadline
+	// is removed once the headers have been read.
+	ctx, cancel := c.t.requestContext(req)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	readDeadline := deadline
+	headerTimeout := false
+	if d := c.t.ResponseHeaderTimeout; d > 0 {
+		if hd := time.Now().Add(d); deadline.IsZero() || hd.Before(deadline) {
+			readDeadline = hd
+			headerTimeout = true
+		}
+	}
+	c.conn.SetWriteDeadline(deadline)
+	c.conn.SetReadDeadline(readDeadline)
+
+	err := req.Write(c.bw)
+	if err == nil {
+		err = c.bw.Flush()
+	}
+	var res *http.Response
+	if err == nil {
+		res, err = http.ReadResponse(c.br, req)
+	}
+	if err != nil {
+		c.close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if headerTimeout {
+				return nil, &common.TimeoutError{Op: "awaiting response headers", Limit: c.t.ResponseHeaderTimeout}
+			}
+			return nil, &common.TimeoutError{Op: "completing request", Limit: c.t.RequestTimeout}
+		}
+		return nil, err
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	keepAlive := !res.Close && !req.Close
+	if res.Body == nil || res.Body == http.NoBody {
+		c.release(keepAlive)
+	} else {
+		res.Body = &httpBody{body: res.Body, conn: c, keepAlive: keepAlive}
+	}
+
+	return res, nil
+}
+
+// httpBody wraps an HTTP response body, releasing the
+// connection once the body has been read to EOF or
+// closed.
+type httpBody struct {
+	body      io.ReadCloser
+	conn      *httpConn
+	keepAlive bool
+	once      sync.Once
+}
+
+func (b *httpBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err == io.EOF {
+		b.finish(b.keepAlive)
+	} else if err != nil {
+		b.finish(false)
+	}
+	return n, err
+}
+
+// Close closes the body. Any unread data is
+// discarded first, so that the connection can
+// be reused.
+func (b *httpBody) Close() error {
+	err := b.body.Close()
+	b.finish(b.keepAlive && err == nil)
+	return err
+}
+
+func (b *httpBody) finish(keepAlive bool) {
+	b.once.Do(func() {
+		b.conn.release(keepAlive)
+	})
+}
+
+// putIdle adds the connection to the pool of idle
+// connections, or closes it if the pool is full.
+func (t *Transport) putIdle(c *httpConn) {
+	c.conn.SetDeadline(time.Time{})
+	c.reused = true
+
+	t.idleM.Lock()
+	if t.idleConns == nil {
+		t.idleConns = make(map[string][]*httpConn)
+	}
+	idle := t.idleConns[c.host]
+	if len(idle) >= t.maxIdleConnsPerHost() {
+		t.idleM.Unlock()
+		c.close()
+		return
+	}
+	t.idleConns[c.host] = append(idle, c)
+	if d := t.IdleConnTimeout; d > 0 {
+		c.idleTimer = time.AfterFunc(d, func() {
+			t.removeIdle(c)
+		})
+	}
+	ready := t.idleSignal(c.host)
+	t.idleM.Unlock()
+
+	// Wake anyone waiting for a connection.
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+}
+
+// getIdle returns an idle connection to the given
+// host, or nil if there are none.
+func (t *Transport) getIdle(host string) *httpConn {
+	t.idleM.Lock()
+	defer t.idleM.Unlock()
+
+	idle := t.idleConns[host]
+	if len(idle) == 0 {
+		return nil
+	}
+
+	// Prefer the most recently used connection.
+	c := idle[len(idle)-1]
+	idle[len(idle)-1] = nil
+	t.idleConns[host] = idle[:len(idle)-1]
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	return c
+}
+
+// removeIdle closes the given connection if it
+// is still in the pool of idle connections.
+func (t *Transport) removeIdle(c *httpConn) {
+	t.idleM.Lock()
+	idle := t.idleConns[c.host]
+	for i, other := range idle {
+		if other == c {
+			copy(idle[i:], idle[i+1:])
+			idle[len(idle)-1] = nil
+			t.idleConns[c.host] = idle[:len(idle)-1]
+			t.idleM.Unlock()
+			debug.Printf("Closing idle connection to %s.\n", c.host)
+			c.close()
+			return
+		}
+	}
+	t.idleM.Unlock()
+}
+
+// idleSignal returns the channel used to signal that
+// an idle connection to the given host has become
+// available. The idle lock must be held.
+func (t *Transport) idleSignal(host string) chan struct{} {
+	if t.idleReady == nil {
+		t.idleReady = make(map[string]chan struct{})
+	}
+	ready, ok := t.idleReady[host]
+	if !ok {
+		ready = make(chan struct{}, 1)
+		t.idleReady[host] = ready
+	}
+	return ready
+}
+
+// waitForSlot blocks until either a connection slot
+// for the given host is free, or an idle connection
+// to the host is returned to the pool, in which case
+// the idle connection is returned. If the context
+// ends first, its error is returned.
+func (t *Transport) waitForSlot(ctx context.Context, host string, slots chan struct{}) (*httpConn, error) {
+	for {
+		select {
+		case <-slots:
+			return nil, nil
+		default:
+		}
+
+		t.idleM.Lock()
+		ready := t.idleSignal(host)
+		t.idleM.Unlock()
+
+		select {
+		case <-slots:
+			return nil, nil
+		case <-ready:
+			if c := t.getIdle(host); c != nil {
+				return c, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// CloseIdleConnections closes any HTTP connections
+// which are not currently in use.
+func (t *Transport) CloseIdleConnections() {
+	t.idleM.Lock()
+	var idle []*httpConn
+	for host, conns := range t.idleConns {
+		for _, c := range conns {
+			if c.idleTimer != nil {
+				c.idleTimer.Stop()
+			}
+			idle = append(idle, c)
+		}
+		delete(t.idleConns, host)
+	}
+	t.idleM.Unlock()
+
+	for _, c := range idle {
+		c.close()
+	}
+}
+
+// retryableHTTPError indicates whether a failed
+// request on a reused connection can be safely
+// retried on a new connection. This handles the
+// server closing an idle connection.
+func retryableHTTPError(req *http.Request, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+	default:
+		return false
+	}
+	if _, ok := err.(*common.TimeoutError); ok {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(*net.OpError)
+	return ok
+}
@@ -0,0 +1,441 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// DefaultPushCacheSize is the default maximum number of bytes
+// of response bodies stored in a PushCache.
+const DefaultPushCacheSize = 10 * 1024 * 1024
+
+// DefaultPushMaxAge is the default amount of time for which a
+// pushed response without an explicit max-age is considered
+// fresh.
+const DefaultPushMaxAge = time.Minute
+
+// PushCache stores server pushes received by a Transport, so
+// that later requests for the pushed resources can be served
+// without contacting the server. To enable it, set
+// Transport.PushCache to the value returned by NewPushCache.
+//
+// Only complete pushes with a cacheable status, such as 200,
+// are stored, and only GET and HEAD requests are served from
+// the cache. Pushed responses with the Cache-Control
+// directives no-store or no-cache are not stored, and
+// requests with those directives are not served from the
+// cache. A PushCache is safe for concurrent use.
+type PushCache struct {
+	// MaxSize is the maximum number of bytes of response
+	// bodies stored. The least recently used responses are
+	// evicted to make room for new pushes. If zero,
+	// DefaultPushCacheSize is used.
+	MaxSize int64
+
+	// MaxAge is the amount of time for which a pushed
+	// response without an explicit max-age is considered
+	// fresh. If zero, DefaultPushMaxAge is used.
+	MaxAge time.Duration
+
+	m       sync.Mutex
+	entries map[string]*list.Element        // complete pushes mapped to URL.
+	pending map[*http.Request]*pushResponse // pushes still being received.
+	lru     *list.List                      // complete pushes, most recently used first.
+	size    int64                           // total size of complete pushes.
+
+	hits   uint64
+	misses uint64
+}
+
+// NewPushCache gives a simple initialised PushCache.
+func NewPushCache(maxSize int64) *PushCache {
+	return &PushCache{MaxSize: maxSize}
+}
+
+// pushResponse is a single pushed response.
+type pushResponse struct {
+	url     string
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	expires time.Time
+	invalid bool
+}
+
+// Hits returns the number of requests served from the cache.
+func (p *PushCache) Hits() uint64 {
+	return atomic.LoadUint64(&p.hits)
+}
+
+// Misses returns the number of cacheable requests that could
+// not be served from the cache.
+func (p *PushCache) Misses() uint64 {
+	return atomic.LoadUint64(&p.misses)
+}
+
+// Len returns the number of responses in the cache.
+func (p *PushCache) Len() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.lru == nil {
+		return 0
+	}
+	return p.lru.Len()
+}
+
+// Size returns the number of bytes of response bodies stored
+// in the cache.
+func (p *PushCache) Size() int64 {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.size
+}
+
+func (p *PushCache) init() {
+	if p.entries == nil {
+		p.entries = make(map[string]*list.Element)
+		p.pending = make(map[*http.Request]*pushResponse)
+		p.lru = list.New()
+	}
+}
+
+func (p *PushCache) maxSize() int64 {
+	if p.MaxSize == 0 {
+		return DefaultPushCacheSize
+	}
+	return p.MaxSize
+}
+
+// Response returns the cached response for the given request,
+// or nil if it cannot be served from the cache.
+func (p *PushCache) Response(req *http.Request) *http.Response {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil
+	}
+	if d := cacheControl(req.Header); d.has("no-cache") || d.has("no-store") {
+		atomic.AddUint64(&p.misses, 1)
+		return nil
+	}
+
+	key := pushCacheKey(req.URL)
+
+	p.m.Lock()
+	p.init()
+	elt, ok := p.entries[key]
+	if ok && time.Now().After(elt.Value.(*pushResponse).expires) {
+		p.remove(elt)
+		ok = false
+	}
+	if !ok {
+		p.m.Unlock()
+		atomic.AddUint64(&p.misses, 1)
+		return nil
+	}
+	p.lru.MoveToFront(elt)
+	push := elt.Value.(*pushResponse)
+	body := push.body.Bytes()
+	header := common.CloneHeader(push.header)
+	p.m.Unlock()
+
+	atomic.AddUint64(&p.hits, 1)
+	debug.Printf("Serving %q from the push cache.\n", key)
+
+	out := new(http.Response)
+	out.Status = fmt.Sprintf("%d %s", push.status, http.StatusText(push.status))
+	out.StatusCode = push.status
+	out.Header = header
+	out.Proto = "HTTP/1.1"
+	out.ProtoMajor = 1
+	out.ProtoMinor = 1
+	out.Trailer = make(http.Header)
+	out.Request = req
+	if req.Method == "HEAD" {
+		out.Body = ioutil.NopCloser(new(bytes.Buffer))
+	} else {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	out.ContentLength = int64(len(body))
+	return out
+}
+
+// remove deletes a complete push from the cache. The
+// cache's lock must be held.
+func (p *PushCache) remove(elt *list.Element) {
+	push := elt.Value.(*pushResponse)
+	p.lru.Remove(elt)
+	delete(p.entries, push.url)
+	p.size -= int64(push.body.Len())
+}
+
+// store adds a complete push to the cache, evicting
+// older pushes if necessary. The cache's lock must
+// be held.
+func (p *PushCache) store(push *pushResponse) {
+	max := p.maxSize()
+	size := int64(push.body.Len())
+	if size > max {
+		return
+	}
+	if elt, ok := p.entries[push.url]; ok {
+		p.remove(elt)
+	}
+	for p.size+size > max {
+		p.remove(p.lru.Back())
+	}
+	p.entries[push.url] = p.lru.PushFront(push)
+	p.size += size
+}
+
+// Receiver returns a Receiver which stores the pushes
+// sent on a connection to the given origin. Pushes for
+// resources on other origins are refused.
+func (p *PushCache) Receiver(origin *url.URL) common.Receiver {
+	return &pushCacheReceiver{cache: p, origin: pushCacheOrigin(origin)}
+}
+
+// pushCacheReceiver is the common.Receiver used to
+// receive pushes on a single connection.
+type pushCacheReceiver struct {
+	cache  *PushCache
+	origin string
+}
+
+func (r *pushCacheReceiver) ReceiveRequest(req *http.Request) bool {
+	if req.URL == nil || pushCacheOrigin(req.URL) != r.origin {
+		debug.Printf("Refusing push for %q on connection to %q.\n", req.URL, r.origin)
+		return false
+	}
+
+	push := new(pushResponse)
+	push.url = pushCacheKey(req.URL)
+	push.status = http.StatusOK
+	push.header = make(http.Header)
+
+	p := r.cache
+	p.m.Lock()
+	p.init()
+	p.pending[req] = push
+	p.m.Unlock()
+	return true
+}
+
+func (r *pushCacheReceiver) ReceiveHeader(req *http.Request, header http.Header) {
+	p := r.cache
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	push := p.pending[req]
+	if push == nil {
+		return
+	}
+
+	for name, values := range header {
+		switch name {
+		case ":status", "Status":
+			status := strings.TrimSpace(header.Get(name))
+			if i := strings.Index(status, " "); i >= 0 {
+				status = status[:i]
+			}
+			if code, err := strconv.Atoi(status); err == nil {
+				push.status = code
+			}
+			continue
+		}
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		push.header[http.CanonicalHeaderKey(name)] = values
+	}
+}
+
+func (r *pushCacheReceiver) ReceiveData(req *http.Request, data []byte, final bool) {
+	p := r.cache
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	push := p.pending[req]
+	if push == nil {
+		return
+	}
+
+	if !push.invalid {
+		push.body.Write(data)
+		if int64(push.body.Len()) > p.maxSize() {
+			push.invalid = true
+			push.body.Reset()
+		}
+	}
+
+	if !final {
+		return
+	}
+
+	delete(p.pending, req)
+
+	// Check the push can be cached.
+	d := cacheControl(push.header)
+	if push.invalid || !cacheableStatus(push.status) || d.has("no-store") || d.has("no-cache") {
+		return
+	}
+	maxAge := p.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultPushMaxAge
+	}
+	if age, ok := d["max-age"]; ok {
+		seconds, err := strconv.Atoi(age)
+		if err != nil || seconds <= 0 {
+			return
+		}
+		maxAge = time.Duration(seconds) * time.Second
+	}
+	push.expires = time.Now().Add(maxAge)
+
+	p.store(push)
+}
+
+func (r *pushCacheReceiver) ReceiveAbort(req *http.Request) {
+	p := r.cache
+	p.m.Lock()
+	delete(p.pending, req)
+	p.m.Unlock()
+}
+
+// cacheableStatus returns whether responses with
+// the given status code may be stored without
+// explicit freshness information, as described in
+// RFC 7231, section 6.1. Partial content is not
+// stored, as it cannot answer a full request.
+func cacheableStatus(code int) bool {
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// cacheDirectives holds the directives in a
+// Cache-Control header.
+type cacheDirectives map[string]string
+
+func (c cacheDirectives) has(directive string) bool {
+	_, ok := c[directive]
+	return ok
+}
+
+// cacheControl parses the Cache-Control directives
+// in the given header.
+func cacheControl(h http.Header) cacheDirectives {
+	out := make(cacheDirectives)
+	for _, value := range h["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "" {
+				continue
+			}
+			if i := strings.Index(directive, "="); i >= 0 {
+				out[directive[:i]] = strings.Trim(directive[i+1:], "\"")
+			} else {
+				out[directive] = ""
+			}
+		}
+	}
+	return out
+}
+
+// pushCacheOrigin returns the origin of the given
+// URL, including the port.
+func pushCacheOrigin(u *url.URL) string {
+	host := u.Host
+	if !strings.Contains(host, ":") {
+		switch u.Scheme {
+		case "http":
+			host += ":80"
+
+		case "https":
+			host += ":443"
+		}
+	}
+	return strings.ToLower(u.Scheme + "://" + host)
+}
+
+// pushCacheKey returns the key used to store
+// the given URL.
+func pushCacheKey(u *url.URL) string {
+	return pushCacheOrigin(u) + u.RequestURI()
+}
+
+// pushReceivers passes server pushes to multiple
+// Receivers, only passing each push's headers and
+// data to those which accepted it.
+type pushReceivers struct {
+	m         sync.Mutex
+	receivers []common.Receiver
+	accepted  map[*http.Request][]common.Receiver
+}
+
+func (p *pushReceivers) ReceiveRequest(req *http.Request) bool {
+	var accepted []common.Receiver
+	for _, r := range p.receivers {
+		if r.ReceiveRequest(req) {
+			accepted = append(accepted, r)
+		}
+	}
+	if len(accepted) == 0 {
+		return false
+	}
+	p.m.Lock()
+	p.accepted[req] = accepted
+	p.m.Unlock()
+	return true
+}
+
+func (p *pushReceivers) ReceiveHeader(req *http.Request, header http.Header) {
+	p.m.Lock()
+	accepted := p.accepted[req]
+	p.m.Unlock()
+	for _, r := range accepted {
+		r.ReceiveHeader(req, header)
+	}
+}
+
+func (p *pushReceivers) ReceiveData(req *http.Request, data []byte, final bool) {
+	p.m.Lock()
+	accepted := p.accepted[req]
+	if final {
+		delete(p.accepted, req)
+	}
+	p.m.Unlock()
+	for _, r := range accepted {
+		r.ReceiveData(req, data, final)
+	}
+}
+
+func (p *pushReceivers) ReceiveAbort(req *http.Request) {
+	p.m.Lock()
+	accepted := p.accepted[req]
+	delete(p.accepted, req)
+	p.m.Unlock()
+	for _, r := range accepted {
+		if r, ok := r.(common.AbortReceiver); ok {
+			r.ReceiveAbort(req)
+		}
+	}
+}
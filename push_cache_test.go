@@ -0,0 +1,212 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy_test
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+)
+
+func TestPushCache(t *testing.T) {
+	var served int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		push, err := spdy.Push(w, r.URL.Scheme+"://"+r.URL.Host+"/pushed.js")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		push.Header().Set("Cache-Control", "max-age=60")
+		push.Write([]byte("pushed content"))
+		push.Finish()
+		w.Write([]byte("index"))
+	})
+	mux.HandleFunc("/pushed.js", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.Write([]byte("served content"))
+	})
+	ts := newServer(mux)
+	defer ts.Close()
+
+	cache := spdy.NewPushCache(0)
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushCache = cache
+
+	r, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	// The push may complete after the response.
+	for i := 0; cache.Len() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r, err = client.Get(ts.URL + "/pushed.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "pushed content" {
+		t.Errorf("Expected pushed content, got %q", s)
+	}
+	if got := r.Header.Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Expected pushed header, got %q", got)
+	}
+	if n := atomic.LoadInt32(&served); n != 0 {
+		t.Errorf("Expected pushed resource to be served from the cache, server saw %d requests", n)
+	}
+	if hits := cache.Hits(); hits != 1 {
+		t.Errorf("Expected 1 cache hit, got %d", hits)
+	}
+	if misses := cache.Misses(); misses != 1 {
+		t.Errorf("Expected 1 cache miss, got %d", misses)
+	}
+}
+
+// abortRecorder is a push receiver which records
+// the pushes that are aborted.
+type abortRecorder struct {
+	aborted chan string
+}
+
+func (a *abortRecorder) ReceiveRequest(req *http.Request) bool          { return true }
+func (a *abortRecorder) ReceiveHeader(req *http.Request, h http.Header) {}
+func (a *abortRecorder) ReceiveData(req *http.Request, data []byte, final bool) {
+	if final {
+		a.aborted <- "finished " + req.URL.Path
+	}
+}
+func (a *abortRecorder) ReceiveAbort(req *http.Request) {
+	a.aborted <- req.URL.Path
+}
+
+func TestPushCacheAbort(t *testing.T) {
+	versions := []spdy.KnownVersion{{2, 0}, {3, 1}}
+	for _, v := range versions {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if err := w.(http.Pusher).Push("/pushed.js", nil); err != nil {
+				t.Error(err)
+			}
+			w.Write([]byte("index"))
+		})
+		mux.HandleFunc("/pushed.js", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("partial"))
+			panic(http.ErrAbortHandler)
+		})
+		server := &http.Server{Handler: mux}
+
+		recorder := &abortRecorder{aborted: make(chan string, 1)}
+		cache := spdy.NewPushCache(0)
+		tr := &spdy.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				client, srv := net.Pipe()
+				conn, err := spdy.NewServerConn(srv, server, v.Version, v.Subversion)
+				if err != nil {
+					return nil, err
+				}
+				go conn.Run()
+				return client, nil
+			},
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+			PushCache:      cache,
+			PushReceiver:   recorder,
+		}
+		client := &http.Client{Transport: tr}
+
+		r, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatalf("SPDY/%d: %v", v.Version, err)
+		}
+		r.Body.Close()
+
+		// The reset push must be aborted, not finished.
+		select {
+		case path := <-recorder.aborted:
+			if path != "/pushed.js" {
+				t.Errorf("SPDY/%d: Expected push for /pushed.js to be aborted, got %q", v.Version, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("SPDY/%d: Reset push was not aborted", v.Version)
+		}
+		if n := cache.Len(); n != 0 {
+			t.Errorf("SPDY/%d: Expected reset push not to be cached, got %d entries", v.Version, n)
+		}
+	}
+}
+
+func TestPushCacheStatus(t *testing.T) {
+	var served int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if err := w.(http.Pusher).Push("/pushed.js", nil); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte("index"))
+	})
+	mux.HandleFunc("/pushed.js", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&served, 1) == 1 {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("pushed error"))
+			return
+		}
+		w.Write([]byte("served content"))
+	})
+	ts := newServer(mux)
+	defer ts.Close()
+
+	recorder := &abortRecorder{aborted: make(chan string, 1)}
+	cache := spdy.NewPushCache(0)
+	client := newClient()
+	client.Transport.(*spdy.Transport).PushCache = cache
+	client.Transport.(*spdy.Transport).PushReceiver = recorder
+
+	r, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	// The push may complete after the response.
+	select {
+	case path := <-recorder.aborted:
+		if path != "finished /pushed.js" {
+			t.Fatalf("Expected push for /pushed.js to finish, got %q", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push did not finish")
+	}
+	if n := cache.Len(); n != 0 {
+		t.Errorf("Expected pushed 500 not to be cached, got %d entries", n)
+	}
+
+	r, err = client.Get(ts.URL + "/pushed.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StatusCode != http.StatusOK || string(b) != "served content" {
+		t.Errorf("Expected the pushed 500 not to be served from the cache, got %d %q", r.StatusCode, b)
+	}
+	if hits := cache.Hits(); hits != 0 {
+		t.Errorf("Expected no cache hits, got %d", hits)
+	}
+}
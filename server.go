@@ -5,10 +5,14 @@
 package spdy
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -90,53 +94,267 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler htt
 //
 // See examples/spdy_only_server/server.go for a simple example server.
 func ListenAndServeSpdyOnly(addr string, certFile string, keyFile string, handler http.Handler) error {
-	npnStrings := npn()
-	if addr == "" {
-		addr = ":https"
-	}
-	if handler == nil {
-		handler = http.DefaultServeMux
+	server := &Server{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		},
+		SPDYOnly: true,
 	}
-	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			NextProtos:   npnStrings,
-			Certificates: make([]tls.Certificate, 1),
+
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// ListenAndServeSPDYNoNPN creates a server that listens exclusively
+// for SPDY and (unlike the rest of the package) will not support
+// HTTPS.
+func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handler http.Handler, version, subversion int) error {
+	server := &Server{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: handler,
 		},
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Version: &KnownVersion{Version: version, Subversion: subversion},
 	}
 
-	for _, str := range npnStrings {
-		switch str {
-		case "spdy/2":
-			server.TLSNextProto[str] = spdy2.NextProto
-		case "spdy/3":
-			server.TLSNextProto[str] = spdy3.NextProto
-		case "spdy/3.1":
-			server.TLSNextProto[str] = spdy3.NextProto1
-		}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Server is a SPDY server, which can serve connections from any
+// net.Listener. Connections which do not use SPDY are served
+// HTTP by the underlying http.Server, unless SPDYOnly is set.
+//
+// Unlike http.Server, the listeners given to Serve are not
+// wrapped with TLS, so ServeTLS should be used for TLS
+// listeners which do not already perform TLS.
+type Server struct {
+	// Server configures request handling, such as the
+	// Handler, TLSConfig, timeouts and ErrorLog. If its
+	// Handler is nil, http.DefaultServeMux is used. On SPDY
+	// connections, ReadTimeout and WriteTimeout are applied
+	// to each stream, which is reset if they are exceeded.
+	// Connections without open streams are closed after the
+	// IdleTimeout, or the ReadTimeout if it is zero.
+	Server *http.Server
+
+	// SPDYOnly, if true, closes connections which do not
+	// use SPDY, rather than serving them HTTP.
+	SPDYOnly bool
+
+	// Version, if non-nil, is the version of SPDY used for
+	// every connection, without NPN. This implies SPDYOnly.
+	Version *KnownVersion
+
+	// Cleartext, if true, detects SPDY on connections without
+	// TLS by examining the first frame sent by the client.
+	// SPDY/2 and SPDY/3 connections are served with the
+	// matching version. The first frame does not distinguish
+	// SPDY/3.1 from SPDY/3, so SPDY/3 is used unless it has
+	// been disabled with DisableSpdyVersion; set Version to
+	// serve SPDY/3.1 clients. Other connections are served
+	// HTTP, unless SPDYOnly is set.
+	Cleartext bool
+
+	// PushPreloads, if true, pushes the same-origin resources
+	// named in "Link" response headers with the relation
+	// "preload", unless the link has the "nopush" parameter.
+	// Each pushed response is produced by calling the Handler
+	// with a synthetic GET request. A resource is pushed at
+	// most once per connection.
+	PushPreloads bool
+
+	// AccessLog, if non-nil, is called with an entry for
+	// each stream served on a SPDY connection, including
+	// pushed streams, once the stream has ended. See
+	// CommonLog, CombinedLog and JSONLog.
+	AccessLog common.AccessLogger
+
+	// MaxConcurrentStreams, if non-zero, is the maximum number
+	// of streams each client may have open at once, advertised
+	// with the MAX_CONCURRENT_STREAMS setting. The default is
+	// common.DEFAULT_STREAM_LIMIT.
+	MaxConcurrentStreams uint32
+
+	// MaxConnHandlers, if non-zero, limits the number of
+	// handlers executing concurrently on each SPDY connection,
+	// and MaxHandlers, if non-zero, limits the number executing
+	// across all SPDY connections. Streams over either limit
+	// wait for a handler to finish, with higher-priority
+	// streams started first, unless RefuseStreams is set.
+	MaxConnHandlers int
+	MaxHandlers     int
+
+	// RefuseStreams, if true, resets streams over the handler
+	// limits with REFUSED_STREAM, rather than queueing them.
+	// The advertised MAX_CONCURRENT_STREAMS is then reduced to
+	// no more than MaxConnHandlers and MaxHandlers.
+	RefuseStreams bool
+
+	// ValidateOrigins, if true, serves each request only if
+	// its host is covered by the certificate presented on the
+	// connection, or is in AllowedOrigins. Other requests are
+	// answered with 421 Misdirected Request, so that clients
+	// do not use a connection for hosts it cannot serve.
+	// Without TLS, only the hosts in AllowedOrigins are served.
+	// AllowedOrigins may contain hosts beginning with "*.",
+	// which allow any of their subdomains.
+	ValidateOrigins bool
+	AllowedOrigins  []string
+
+	// NewScheduler, if non-nil, returns the Scheduler used to
+	// order the frames sent on each SPDY connection. It is
+	// called once per connection. If nil, each connection uses
+	// common.NewWeightedScheduler.
+	NewScheduler func() common.Scheduler
+
+	// MaxDataSize, if non-zero, is the maximum payload of each
+	// DATA frame sent on SPDY connections. Larger writes are
+	// split into several frames, so the frames of concurrent
+	// streams can be interleaved. The default is
+	// common.DEFAULT_MAX_DATA_SIZE.
+	MaxDataSize int
+
+	// MaxBufferedData, if non-zero, is the maximum data each
+	// stream buffers while waiting for flow control, before
+	// writes block until the client has received more of the
+	// response. This also limits the data each SPDY/3.1
+	// connection buffers for its connection-level window. The
+	// default is common.DEFAULT_MAX_BUFFERED_DATA.
+	MaxBufferedData int
+
+	// NewFlowControl, if non-nil, returns the FlowControl used
+	// by each connection using SPDY/3 or later. It is called
+	// once per connection. If nil, each connection uses
+	// spdy3.DefaultFlowControl. spdy3.NewAutoFlowControl can
+	// be used to grow windows on links with high latency.
+	NewFlowControl func() common.FlowControl
+
+	// Bandwidth, if non-zero, limits the data sent on each SPDY
+	// connection to that many bytes per second, so that a single
+	// client cannot use all of a shared server's bandwidth. The
+	// connection's frames are still sent in order of priority,
+	// and only DATA frames are held back, so control frames
+	// such as PING and RST_STREAM are sent at once.
+	// StreamBandwidth, if non-zero, similarly limits each stream,
+	// which can be changed for a stream with SetStreamBandwidth.
+	// If PeerBandwidth is true, each connection is also limited
+	// to the client's SETTINGS_DOWNLOAD_BANDWIDTH, if sent.
+	Bandwidth       int64
+	StreamBandwidth int64
+	PeerBandwidth   bool
+
+	m         sync.Mutex
+	tlsConfig *tls.Config               // configuration used by ServeTLS.
+	handlers  *common.HandlerLimit      // limits handlers across connections.
+	listeners map[net.Listener]struct{} // active listeners.
+	conns     map[common.Conn]struct{}  // active SPDY connections.
+	fallback  *connListener             // passes HTTP connections to Server.
+	shutdown  bool                      // whether Shutdown has been called.
+}
+
+// ListenAndServe listens on the TCP network address
+// s.Server.Addr and then calls Serve to handle requests
+// on incoming connections without TLS. If the address
+// is blank, ":http" is used. See Server.Cleartext.
+func (s *Server) ListenAndServe() error {
+	addr := s.Server.Addr
+	if addr == "" {
+		addr = ":http"
 	}
 
-	var err error
-	server.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.Listen("tcp", addr)
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS listens on the TCP network address
+// s.Server.Addr and then calls ServeTLS to handle requests
+// on incoming connections. If the address is blank, ":https"
+// is used.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	addr := s.Server.Addr
+	if addr == "" {
+		addr = ":https"
+	}
+
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	tlsListener := tls.NewListener(conn, server.TLSConfig)
-	defer tlsListener.Close()
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS accepts incoming connections on the listener l,
+// performing the TLS handshake and serving each connection
+// with SPDY, or HTTPS if no version of SPDY is negotiated.
+// If s.Server.TLSConfig does not contain a certificate, the
+// certificate and matching private key are loaded from
+// certFile and keyFile.
+//
+// ServeTLS always returns a non-nil error. After Shutdown,
+// the returned error is http.ErrServerClosed.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := new(tls.Config)
+	if s.Server.TLSConfig != nil {
+		config = s.Server.TLSConfig.Clone()
+	}
+
+	switch {
+	case s.Version != nil:
+		config.NextProtos = nil
+	case config.NextProtos == nil:
+		config.NextProtos = s.npn()
+	}
+
+	if len(config.Certificates) == 0 && config.GetCertificate == nil || certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	s.m.Lock()
+	s.tlsConfig = config
+	s.m.Unlock()
+
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// Serve accepts incoming connections on the listener l,
+// serving each with SPDY. The version of SPDY is taken from
+// s.Version if set, negotiated with NPN over TLS, or detected
+// on connections without TLS if s.Cleartext is set.
+// Connections without a SPDY version are served HTTP
+// by s.Server, unless s.SPDYOnly is set.
+//
+// Serve always returns a non-nil error. After Shutdown,
+// the returned error is http.ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if s.Server.Handler == nil {
+		s.Server.Handler = http.DefaultServeMux
+	}
+
+	if !s.trackListener(l) {
+		l.Close()
+		return http.ErrServerClosed
+	}
+	defer s.untrackListener(l)
+	defer l.Close()
 
 	// Main loop
 	var tempDelay time.Duration
 	for {
-		rw, e := tlsListener.Accept()
+		rw, e := l.Accept()
 		if e != nil {
+			if s.shuttingDown() {
+				return http.ErrServerClosed
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -146,123 +364,418 @@ func ListenAndServeSpdyOnly(addr string, certFile string, keyFile string, handle
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				log.Printf("Accept error: %v; retrying in %v", e, tempDelay)
+				s.logf("Accept error: %v; retrying in %v", e, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
 			return e
 		}
 		tempDelay = 0
-		go serveSPDY(rw, server)
+		go s.serveConn(rw)
 	}
 }
 
-// ListenAndServeSPDYNoNPN creates a server that listens exclusively
-// for SPDY and (unlike the rest of the package) will not support
-// HTTPS.
-func ListenAndServeSPDYNoNPN(addr string, certFile string, keyFile string, handler http.Handler, version, subversion int) error {
-	if addr == "" {
-		addr = ":https"
+// Shutdown gracefully shuts down the server. First, all
+// listeners are closed. Then, each SPDY connection is sent
+// a GOAWAY and closed once its active streams have finished,
+// and HTTP connections are shut down by s.Server. If the
+// context expires first, the remaining connections are
+// closed and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	s.shutdown = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	if handler == nil {
-		handler = http.DefaultServeMux
-	}
-	server := &http.Server{
-		Addr:    addr,
-		Handler: handler,
-		TLSConfig: &tls.Config{
-			Certificates: make([]tls.Certificate, 1),
-		},
+	conns := make([]common.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
 	}
+	s.m.Unlock()
 
-	var err error
-	server.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
+	errs := make(chan error, len(conns)+1)
+	go func() {
+		errs <- s.Server.Shutdown(ctx)
+	}()
+	for _, conn := range conns {
+		go func(conn common.Conn) {
+			if shutdowner, ok := conn.(Shutdowner); ok {
+				errs <- shutdowner.Shutdown(ctx)
+			} else {
+				errs <- conn.Close()
+			}
+		}(conn)
 	}
 
-	conn, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	for i := 0; i < len(conns)+1; i++ {
+		if e := <-errs; e != nil && (err == nil || e == ctx.Err()) {
+			err = e
+		}
 	}
 
-	tlsListener := tls.NewListener(conn, server.TLSConfig)
-	defer tlsListener.Close()
+	return err
+}
 
-	// Main loop
-	var tempDelay time.Duration
-	for {
-		rw, e := tlsListener.Accept()
-		if e != nil {
-			if ne, ok := e.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Printf("Accept error: %v; retrying in %v", e, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
-			return e
+// npn returns the NPN strings offered by the server.
+func (s *Server) npn() []string {
+	protos := npn()
+	if !s.SPDYOnly {
+		return protos
+	}
+	out := make([]string, 0, len(protos))
+	for _, proto := range protos {
+		if proto != "http/1.1" {
+			out = append(out, proto)
 		}
-		tempDelay = 0
-		go serveSPDYNoNPN(rw, server, version, subversion)
 	}
+	return out
 }
 
-func serveSPDY(conn net.Conn, srv *http.Server) {
+func (s *Server) serveConn(conn net.Conn) {
 	defer common.Recover()
 
-	tlsConn, ok := conn.(*tls.Conn)
-	if !ok { // Only allow TLS connections.
+	srv := s.Server
+	version, subversion, ok := 0, 0, false
+
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		if d := srv.ReadTimeout; d != 0 {
+			conn.SetReadDeadline(time.Now().Add(d))
+		}
+		if d := srv.WriteTimeout; d != 0 {
+			conn.SetWriteDeadline(time.Now().Add(d))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			debug.Printf("TLS handshake error from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if s.Version == nil {
+			version, subversion, ok = npnVersion(tlsConn.ConnectionState().NegotiatedProtocol)
+		}
+	} else if s.Version == nil && s.Cleartext {
+		var err error
+		conn, version, subversion, ok, err = s.sniff(conn)
+		if err != nil {
+			debug.Printf("Failed to detect protocol from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	if s.Version != nil {
+		version, subversion, ok = s.Version.Version, s.Version.Subversion, true
+	}
+
+	// Handle HTTP connections.
+	if !ok {
+		if s.SPDYOnly {
+			conn.Close()
+			return
+		}
+		s.serveHTTP(conn)
 		return
 	}
 
-	if d := srv.ReadTimeout; d != 0 {
-		conn.SetReadDeadline(time.Now().Add(d))
+	serverConn, err := NewServerConn(conn, srv, version, subversion)
+	if err != nil {
+		s.logf("%v", err)
+		conn.Close()
+		return
 	}
-	if d := srv.WriteTimeout; d != 0 {
-		conn.SetWriteDeadline(time.Now().Add(d))
+	handlers := s.handlerLimit()
+	origins := s.originPolicy(conn)
+	switch c := serverConn.(type) {
+	case *spdy3.Conn:
+		c.PushPreloads = s.PushPreloads
+		c.AccessLog = s.AccessLog
+		c.Origins = origins
+		if s.NewScheduler != nil {
+			c.Scheduler = s.NewScheduler()
+		}
+		c.MaxDataSize = s.MaxDataSize
+		c.MaxBufferedData = s.MaxBufferedData
+		if s.NewFlowControl != nil {
+			c.SetFlowControl(s.NewFlowControl())
+		}
+		c.Bandwidth = s.Bandwidth
+		c.StreamBandwidth = s.StreamBandwidth
+		c.PeerBandwidth = s.PeerBandwidth
+		c.MaxConcurrentStreams = s.MaxConcurrentStreams
+		c.MaxHandlers = s.MaxConnHandlers
+		c.Handlers = handlers
+		c.RefuseStreams = s.RefuseStreams
+	case *spdy2.Conn:
+		c.PushPreloads = s.PushPreloads
+		c.AccessLog = s.AccessLog
+		c.Origins = origins
+		if s.NewScheduler != nil {
+			c.Scheduler = s.NewScheduler()
+		}
+		c.MaxDataSize = s.MaxDataSize
+		c.Bandwidth = s.Bandwidth
+		c.StreamBandwidth = s.StreamBandwidth
+		c.PeerBandwidth = s.PeerBandwidth
+		c.MaxConcurrentStreams = s.MaxConcurrentStreams
+		c.MaxHandlers = s.MaxConnHandlers
+		c.Handlers = handlers
+		c.RefuseStreams = s.RefuseStreams
 	}
-	if err := tlsConn.Handshake(); err != nil {
+	if !s.trackConn(serverConn, true) {
+		serverConn.Close()
 		return
 	}
+	defer s.trackConn(serverConn, false)
+	serverConn.Run()
+}
+
+// sniff examines the first bytes sent on a connection
+// without TLS, to determine whether it uses SPDY. A SPDY
+// connection begins with a control frame, so its first
+// byte has the control bit set, followed by the version.
+// The returned connection must be used in place of conn,
+// as it includes the bytes examined.
+func (s *Server) sniff(conn net.Conn) (net.Conn, int, int, bool, error) {
+	if d := s.Server.ReadTimeout; d != 0 {
+		conn.SetReadDeadline(time.Now().Add(d))
+	}
+
+	buf := bufio.NewReader(conn)
+	peek, err := buf.Peek(2)
+	conn.SetReadDeadline(time.Time{})
+	out := &sniffedConn{Conn: conn, buf: buf}
+	if err != nil {
+		return out, 0, 0, false, err
+	}
+
+	if peek[0] != 0x80 {
+		return out, 0, 0, false, nil
+	}
+
+	switch peek[1] {
+	case 2:
+		if SupportedVersion(2) {
+			return out, 2, 0, true, nil
+		}
 
-	tlsState := new(tls.ConnectionState)
-	*tlsState = tlsConn.ConnectionState()
-	proto := tlsState.NegotiatedProtocol
-	if fn := srv.TLSNextProto[proto]; fn != nil {
-		fn(srv, tlsConn, nil)
+	case 3:
+		// SPDY/3.1 uses the same version number. Serving
+		// a SPDY/3 client with SPDY/3.1 would stall once
+		// the connection window was exhausted.
+		if SupportedVersion(3) {
+			return out, 3, 0, true, nil
+		}
+		if SupportedVersion(3.1) {
+			return out, 3, 1, true, nil
+		}
 	}
-	return
+
+	return out, 0, 0, false, errors.New("Error: Unsupported SPDY version.")
 }
 
-func serveSPDYNoNPN(conn net.Conn, srv *http.Server, version, subversion int) {
-	defer common.Recover()
+// sniffedConn is a net.Conn whose first bytes have
+// been read into a buffer.
+type sniffedConn struct {
+	net.Conn
+	buf *bufio.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.buf.Read(b)
+}
 
-	tlsConn, ok := conn.(*tls.Conn)
-	if !ok { // Only allow TLS connections.
+// serveHTTP passes the connection to s.Server.
+func (s *Server) serveHTTP(conn net.Conn) {
+	s.m.Lock()
+	if s.shutdown {
+		s.m.Unlock()
+		conn.Close()
 		return
 	}
+	if s.fallback == nil {
+		s.fallback = newConnListener(conn.LocalAddr())
+		go s.Server.Serve(s.fallback)
+	}
+	fallback := s.fallback
+	s.m.Unlock()
 
-	if d := srv.ReadTimeout; d != 0 {
-		conn.SetReadDeadline(time.Now().Add(d))
+	fallback.deliver(conn)
+}
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.shutdown {
+		return false
 	}
-	if d := srv.WriteTimeout; d != 0 {
-		conn.SetWriteDeadline(time.Now().Add(d))
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
 	}
-	if err := tlsConn.Handshake(); err != nil {
-		return
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.m.Lock()
+	delete(s.listeners, l)
+	s.m.Unlock()
+}
+
+// trackConn adds or removes the connection from the
+// set of active connections, returning false if the
+// server is shutting down.
+func (s *Server) trackConn(conn common.Conn, add bool) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.shutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[common.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// handlerLimit returns the limit on handlers executing
+// across all connections, or nil if there is no limit.
+func (s *Server) handlerLimit() *common.HandlerLimit {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.handlers == nil && s.MaxHandlers > 0 {
+		s.handlers = common.NewHandlerLimit(s.MaxHandlers)
+	}
+	return s.handlers
+}
+
+// originPolicy returns the OriginPolicy for a new
+// connection, or nil if origins are not validated.
+func (s *Server) originPolicy(conn net.Conn) *common.OriginPolicy {
+	if !s.ValidateOrigins {
+		return nil
+	}
+
+	policy := &common.OriginPolicy{Hosts: s.AllowedOrigins}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		s.m.Lock()
+		config := s.tlsConfig
+		s.m.Unlock()
+		if config == nil {
+			config = s.Server.TLSConfig
+		}
+		policy.Certificate = servedCertificate(config, tlsConn)
+	}
+
+	return policy
+}
+
+// servedCertificate returns the leaf certificate which
+// was presented on the connection, as chosen by the TLS
+// configuration for the server name sent by the client.
+func servedCertificate(config *tls.Config, conn *tls.Conn) *x509.Certificate {
+	if config == nil {
+		return nil
+	}
+
+	name := conn.ConnectionState().ServerName
+	var cert *tls.Certificate
+	if config.GetCertificate != nil {
+		cert, _ = config.GetCertificate(&tls.ClientHelloInfo{ServerName: name, Conn: conn})
+	}
+	if cert == nil {
+		for i := range config.Certificates {
+			c := &config.Certificates[i]
+			if cert == nil {
+				cert = c // The first certificate is the default.
+			}
+			if leaf := certificateLeaf(c); leaf != nil && name != "" && leaf.VerifyHostname(name) == nil {
+				cert = c
+				break
+			}
+		}
 	}
 
-	serverConn, err := NewServerConn(tlsConn, srv, version, subversion)
+	return certificateLeaf(cert)
+}
+
+// certificateLeaf returns the parsed leaf certificate.
+func certificateLeaf(cert *tls.Certificate) *x509.Certificate {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		log.Println(err)
-		return
+		return nil
 	}
-	serverConn.Run()
+	return leaf
+}
+
+func (s *Server) shuttingDown() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.shutdown
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Server.ErrorLog != nil {
+		s.Server.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// connListener is a net.Listener which returns the
+// connections passed to deliver.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	out := new(connListener)
+	out.addr = addr
+	out.conns = make(chan net.Conn)
+	out.closed = make(chan struct{})
+	return out
+}
+
+// deliver passes the connection to Accept, or
+// closes it if the listener has been closed.
+func (l *connListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Error: Listener closed.")
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
 }
@@ -0,0 +1,2466 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SlyMarbo/spdy"
+	"github.com/SlyMarbo/spdy/common"
+	spdy2frames "github.com/SlyMarbo/spdy/spdy2/frames"
+	"github.com/SlyMarbo/spdy/spdy3"
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "SPDY/%v %s", spdy.SPDYversion(w), r.URL.Path)
+}
+
+func startServer(t *testing.T, server *spdy.Server) (net.Listener, <-chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(l)
+	}()
+	return l, done
+}
+
+// waitFor polls cond until it returns true, giving up
+// after five seconds. waitFor returns whether cond was
+// met, so that handlers can use it as well as tests.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func TestServerFixedVersion(t *testing.T) {
+	v := spdy.KnownVersion{Version: 3, Subversion: 1}
+	server := &spdy.Server{
+		Server:  &http.Server{Handler: http.HandlerFunc(versionHandler)},
+		Version: &v,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &spdy.Transport{
+		PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+	}}
+	r, err := client.Get("http://" + l.Addr().String() + "/fixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "SPDY/3.1 /fixed" {
+		t.Errorf("Incorrect page body: %q", s)
+	}
+}
+
+func TestServerHTTPFallback(t *testing.T) {
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(versionHandler)},
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	client := &http.Client{Transport: new(http.Transport)}
+	r, err := client.Get("http://" + l.Addr().String() + "/fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "SPDY/0 /fallback" {
+		t.Errorf("Incorrect page body: %q", s)
+	}
+	if r.ProtoMajor != 1 {
+		t.Errorf("Expected HTTP/1.x, got %s", r.Proto)
+	}
+}
+
+func TestServerCleartext(t *testing.T) {
+	server := &spdy.Server{
+		Server:    &http.Server{Handler: http.HandlerFunc(versionHandler)},
+		Cleartext: true,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	tests := []struct {
+		transport http.RoundTripper
+		expected  string
+	}{
+		{&spdy.Transport{PriorKnowledge: map[string]spdy.KnownVersion{"*": {3, 0}}}, "SPDY/3 /"},
+		{&spdy.Transport{PriorKnowledge: map[string]spdy.KnownVersion{"*": {2, 0}}}, "SPDY/2 /"},
+		{new(http.Transport), "SPDY/0 /"},
+	}
+
+	for _, test := range tests {
+		client := &http.Client{Transport: test.transport}
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, s)
+		}
+	}
+}
+
+func TestServerCleartextLargeBody(t *testing.T) {
+	// More than the initial connection window, which a
+	// SPDY/3 client never updates.
+	body := bytes.Repeat([]byte("x"), 200<<10)
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		})},
+		Cleartext: true,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	// The client advertises the default window, so the
+	// connection window is not enlarged by its SETTINGS.
+	tr := &spdy.Transport{
+		PriorKnowledge: map[string]spdy.KnownVersion{"*": {3, 0}},
+		NewFlowControl: func() common.FlowControl {
+			return spdy3.DefaultFlowControl(common.DEFAULT_INITIAL_WINDOW_SIZE)
+		},
+	}
+	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	r, err := client.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("Expected %d bytes, got %d", len(body), len(b))
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	v := spdy.KnownVersion{Version: 3, Subversion: 1}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		})},
+		Version: &v,
+	}
+	l, served := startServer(t, server)
+
+	client := &http.Client{Transport: &spdy.Transport{
+		PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+	}}
+	responses := make(chan error, 1)
+	go func() {
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err == nil {
+			var b []byte
+			b, err = pedanticReadAll(r.Body)
+			r.Body.Close()
+			if err == nil && string(b) != "done" {
+				err = fmt.Errorf("Incorrect page body: %q", b)
+			}
+		}
+		responses <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("Expected http.ErrServerClosed from Serve, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the active stream finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-responses; err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return after the active stream finished")
+	}
+}
+
+func TestServerHandlerPanic(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		var logs bytes.Buffer
+		var logsM sync.Mutex
+		mux := http.NewServeMux()
+		mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Discarded", "true")
+			panic("handler failure")
+		})
+		mux.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+		mux.HandleFunc("/ok", versionHandler)
+		server := &spdy.Server{
+			Server: &http.Server{
+				Handler: mux,
+				ErrorLog: log.New(writerFunc(func(b []byte) (int, error) {
+					logsM.Lock()
+					defer logsM.Unlock()
+					return logs.Write(b)
+				}), "", 0),
+			},
+			Version: &v,
+		}
+
+		// Record what the server sends, and on how many
+		// connections.
+		var sent bytes.Buffer
+		var sentM sync.Mutex
+		conns := 0
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(&wrapListener{l, func(conn net.Conn) net.Conn {
+			sentM.Lock()
+			conns++
+			sentM.Unlock()
+			return recordingConn{conn, &sent, &sentM}
+		}})
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		url := "http://" + l.Addr().String()
+
+		r, err := client.Get(url + "/panic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusInternalServerError {
+			t.Errorf("SPDY/%d: expected status 500, got %d", v.Version, r.StatusCode)
+		}
+		if r.Header.Get("X-Discarded") != "" {
+			t.Errorf("SPDY/%d: headers from panicking handler were sent", v.Version)
+		}
+
+		// The aborted stream is reset, which is checked
+		// below using the frames the server sent.
+		r, err = client.Get(url + "/abort")
+		if err == nil {
+			r.Body.Close()
+			if r.StatusCode == http.StatusOK {
+				t.Errorf("SPDY/%d: aborted handler gave status 200", v.Version)
+			}
+		}
+
+		// Other streams on the connection are unaffected.
+		r, err = client.Get(url + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); !strings.HasSuffix(s, " /ok") {
+			t.Errorf("SPDY/%d: incorrect page body: %q", v.Version, s)
+		}
+
+		server.Shutdown(context.Background())
+
+		sentM.Lock()
+		if conns != 1 {
+			t.Errorf("SPDY/%d: expected 1 connection, got %d", v.Version, conns)
+		}
+		resets := sentResets(t, v, sent.Bytes())
+		sentM.Unlock()
+		if len(resets) != 1 || resets[3] != common.RST_STREAM_INTERNAL_ERROR {
+			t.Errorf("SPDY/%d: expected INTERNAL_ERROR for stream 3 only, got %v", v.Version, resets)
+		}
+
+		logsM.Lock()
+		s := logs.String()
+		logsM.Unlock()
+		if n := strings.Count(s, "panic serving stream"); n != 1 {
+			t.Errorf("SPDY/%d: expected 1 panic logged, got %d:\n%s", v.Version, n, s)
+		}
+		if !strings.Contains(s, "handler failure") {
+			t.Errorf("SPDY/%d: panic value not logged:\n%s", v.Version, s)
+		}
+	}
+}
+
+// recordingConn copies the data written to
+// the connection into a buffer.
+type recordingConn struct {
+	net.Conn
+	buf *bytes.Buffer
+	m   *sync.Mutex
+}
+
+func (c recordingConn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	c.buf.Write(b)
+	c.m.Unlock()
+	return c.Conn.Write(b)
+}
+
+// sentResets returns the status of each RST_STREAM
+// in the given frames, by stream ID.
+func sentResets(t *testing.T, v spdy.KnownVersion, b []byte) map[common.StreamID]common.StatusCode {
+	resets := make(map[common.StreamID]common.StatusCode)
+	reader := bufio.NewReader(bytes.NewReader(b))
+	for {
+		var frame common.Frame
+		var err error
+		if v.Version == 2 {
+			frame, err = spdy2frames.ReadFrame(reader)
+		} else {
+			frame, err = frames.ReadFrame(reader, v.Subversion)
+		}
+		if err == io.EOF {
+			return resets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *spdy2frames.RST_STREAM:
+			resets[frame.StreamID] = frame.Status
+		case *frames.RST_STREAM:
+			resets[frame.StreamID] = frame.Status
+		}
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestServerStreamingRequestBody(t *testing.T) {
+	// The body is larger than the default transfer
+	// window, so it can only be received if the
+	// window is regrown as the handler reads it.
+	const size = 12 << 20
+	v := spdy.KnownVersion{Version: 3, Subversion: 1}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf := make([]byte, 4096)
+			total := 0
+			for {
+				n, err := r.Body.Read(buf)
+				total += n
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			fmt.Fprint(w, total)
+		})},
+		Version: &v,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &spdy.Transport{
+		PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+	}}
+	body := bytes.NewReader(make([]byte, size))
+	r, err := client.Post("http://"+l.Addr().String()+"/", "application/octet-stream", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pedanticReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != fmt.Sprint(size) {
+		t.Errorf("Expected handler to read %d bytes, got %q", size, s)
+	}
+}
+
+func TestServerPusher(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		pushed := make(chan *http.Request, 1)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			pusher, ok := w.(http.Pusher)
+			if !ok {
+				t.Errorf("SPDY/%d: ResponseWriter is not an http.Pusher", v.Version)
+				return
+			}
+			opts := &http.PushOptions{Header: http.Header{"X-Pushed": {"true"}}}
+			if err := pusher.Push("/pushed.js", opts); err != nil {
+				t.Errorf("SPDY/%d: %v", v.Version, err)
+			}
+			if err := pusher.Push("/pushed.js", &http.PushOptions{Method: "POST"}); err == nil {
+				t.Errorf("SPDY/%d: expected error pushing a POST", v.Version)
+			}
+			w.Write([]byte("index"))
+			w.(http.Flusher).Flush()
+		})
+		mux.HandleFunc("/pushed.js", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case pushed <- r:
+			default:
+			}
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("pushed content"))
+		})
+		server := &spdy.Server{
+			Server:  &http.Server{Handler: mux},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		cache := spdy.NewPushCache(0)
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+			PushCache:      cache,
+		}}
+		url := "http://" + l.Addr().String()
+
+		r, err := client.Get(url + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		select {
+		case req := <-pushed:
+			if req.Method != "GET" {
+				t.Errorf("SPDY/%d: expected pushed GET, got %s", v.Version, req.Method)
+			}
+			if req.Header.Get("X-Pushed") != "true" {
+				t.Errorf("SPDY/%d: push options headers not passed to handler", v.Version)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("SPDY/%d: handler not called for push", v.Version)
+		}
+
+		// The push may complete after the response.
+		if !waitFor(func() bool { return cache.Len() > 0 }) {
+			t.Fatalf("SPDY/%d: push was not cached", v.Version)
+		}
+		r, err = client.Get(url + "/pushed.js")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "pushed content" {
+			t.Errorf("SPDY/%d: expected pushed content, got %q", v.Version, s)
+		}
+		if hits := cache.Hits(); hits != 1 {
+			t.Errorf("SPDY/%d: expected 1 cache hit, got %d", v.Version, hits)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerCloseNotify(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		started := make(chan struct{})
+		notified := make(chan struct{})
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/wait" {
+					versionHandler(w, r)
+					return
+				}
+				w.(http.Flusher).Flush()
+				close(started)
+				select {
+				case <-w.(http.CloseNotifier).CloseNotify():
+					close(notified)
+				case <-time.After(time.Second):
+				}
+			})},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		url := "http://" + l.Addr().String()
+
+		// Cancelling the request resets the stream.
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("GET", url+"/wait", nil)
+		go func() {
+			<-started
+			cancel()
+		}()
+		if r, err := client.Do(req.WithContext(ctx)); err == nil {
+			r.Body.Close()
+		}
+
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Errorf("SPDY/%d: CloseNotify did not fire when the stream was reset", v.Version)
+		}
+
+		// The connection remains usable.
+		r, err := client.Get(url + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerConcurrentPushes(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Pusher).Push("/pushed.js", nil)
+			w.Write([]byte("index"))
+		})
+		mux.HandleFunc("/pushed.js", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("pushed content"))
+		})
+		server := &spdy.Server{
+			Server:  &http.Server{Handler: mux},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+			PushCache:      spdy.NewPushCache(0),
+		}}
+		url := "http://" + l.Addr().String() + "/"
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, err := client.Get(url)
+				if err != nil {
+					errs <- err
+					return
+				}
+				b, err := pedanticReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					errs <- err
+				} else if s := string(b); s != "index" {
+					errs <- fmt.Errorf("expected index, got %q", s)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("SPDY/%d: %v", v.Version, err)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerPushPreloads(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		var pushedM sync.Mutex
+		pushed := make(map[string]int)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Link", "</app.js>; rel=preload; as=script, </style.css>; rel=preload; nopush")
+			w.Header().Add("Link", `<http://example.com/other.js>; rel="preload", </app.js>; rel=preload`)
+			w.Write([]byte("index"))
+		})
+		resource := func(w http.ResponseWriter, r *http.Request) {
+			pushedM.Lock()
+			pushed[r.URL.Path]++
+			pushedM.Unlock()
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte("resource"))
+		}
+		mux.HandleFunc("/app.js", resource)
+		mux.HandleFunc("/style.css", resource)
+		server := &spdy.Server{
+			Server:       &http.Server{Handler: mux},
+			Version:      &v,
+			PushPreloads: true,
+		}
+		l, _ := startServer(t, server)
+
+		cache := spdy.NewPushCache(0)
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+			PushCache:      cache,
+		}}
+		url := "http://" + l.Addr().String()
+
+		// The second request is on the same connection,
+		// so the resource is not pushed again.
+		for i := 0; i < 2; i++ {
+			r, err := client.Get(url + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Body.Close()
+		}
+
+		// The push may complete after the response.
+		if !waitFor(func() bool { return cache.Len() > 0 }) {
+			t.Fatalf("SPDY/%d: push was not cached", v.Version)
+		}
+
+		r, err := client.Get(url + "/app.js")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if hits := cache.Hits(); hits != 1 {
+			t.Errorf("SPDY/%d: expected 1 cache hit, got %d", v.Version, hits)
+		}
+
+		server.Shutdown(context.Background())
+
+		pushedM.Lock()
+		if n := pushed["/app.js"]; n != 1 {
+			t.Errorf("SPDY/%d: expected /app.js to be pushed once, got %d", v.Version, n)
+		}
+		if n := pushed["/style.css"]; n != 0 {
+			t.Errorf("SPDY/%d: nopush link was pushed", v.Version)
+		}
+		pushedM.Unlock()
+	}
+}
+
+func TestServerPushPreloadsRetry(t *testing.T) {
+	v := spdy.KnownVersion{3, 1}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				w.Header().Set("Link", "</app.js>; rel=preload")
+			}
+			w.Write([]byte("content"))
+		})},
+		Version:      &v,
+		PushPreloads: true,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// request sets the client's stream limit, then
+	// returns the number of streams pushed with the
+	// response.
+	request := func(sid common.StreamID, limit uint32) int {
+		settings := &frames.SETTINGS{Settings: make(common.Settings)}
+		settings.Add(0, common.SETTINGS_MAX_CONCURRENT_STREAMS, limit)
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = common.FLAG_FIN
+		syn.Header = http.Header{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":host":    {l.Addr().String()},
+			":scheme":  {"http"},
+		}
+		if err := syn.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range []common.Frame{settings, syn} {
+			if _, err := frame.WriteTo(conn); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pushed := 0
+		for {
+			frame, err := frames.ReadFrame(reader, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch frame := frame.(type) {
+			case *frames.SYN_STREAM:
+				if frame.AssocStreamID == sid {
+					pushed++
+				}
+			case *frames.SYN_REPLY:
+				if frame.StreamID == sid && frame.Flags.FIN() {
+					return pushed
+				}
+			case *frames.DATA:
+				if frame.StreamID == sid && frame.Flags.FIN() {
+					return pushed
+				}
+			}
+		}
+	}
+
+	// The push fails while the client permits no streams,
+	// so the preload is pushed with the next response.
+	if n := request(1, 0); n != 0 {
+		t.Errorf("expected no push with a stream limit of 0, got %d", n)
+	}
+	if n := request(3, 100); n != 1 {
+		t.Errorf("expected the failed preload to be pushed with the next response, got %d pushes", n)
+	}
+}
+
+func TestServerPushRefused(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		done := make(chan error, 1)
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				push, err := spdy.Push(w, r.URL.Scheme+"://"+r.URL.Host+"/refused.js")
+				if err != nil {
+					done <- err
+					return
+				}
+				select {
+				case <-push.CloseNotify():
+				case <-time.After(time.Second):
+					done <- fmt.Errorf("CloseNotify did not fire when the push was refused")
+					return
+				}
+				if _, err := push.Write([]byte("refused")); err != common.ErrPushRefused {
+					done <- fmt.Errorf("expected ErrPushRefused, got %v", err)
+					return
+				}
+				done <- nil
+			})},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		// Without a PushReceiver, the client refuses pushes.
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if err := <-done; err != nil {
+			t.Errorf("SPDY/%d: %v", v.Version, err)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerStreamDeadlines(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		results := make(chan error, 2)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-w.(http.CloseNotifier).CloseNotify():
+			case <-time.After(5 * time.Second):
+				results <- errors.New("slow stream was not reset after its deadline")
+				return
+			}
+			_, err := w.Write([]byte("slow"))
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				results <- fmt.Errorf("expected timeout error from slow handler, got %v", err)
+				return
+			}
+			results <- nil
+		})
+		mux.HandleFunc("/extended", func(w http.ResponseWriter, r *http.Request) {
+			rc := http.NewResponseController(w)
+			if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+				results <- err
+				return
+			}
+			// Outlive the server's deadline.
+			select {
+			case <-w.(http.CloseNotifier).CloseNotify():
+				results <- errors.New("extended stream was reset after its deadline was cleared")
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+			_, err := w.Write([]byte("extended"))
+			results <- err
+		})
+		mux.HandleFunc("/ok", versionHandler)
+		server := &spdy.Server{
+			Server: &http.Server{
+				Handler:      mux,
+				WriteTimeout: 100 * time.Millisecond,
+			},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		url := "http://" + l.Addr().String()
+
+		// The slow stream is reset, but the connection remains.
+		if r, err := client.Get(url + "/slow"); err == nil {
+			b, _ := io.ReadAll(r.Body)
+			r.Body.Close()
+			if string(b) == "slow" {
+				t.Errorf("SPDY/%d: slow response was sent after its deadline", v.Version)
+			}
+		}
+		if err := <-results; err != nil {
+			t.Errorf("SPDY/%d: %v", v.Version, err)
+		}
+
+		r, err := client.Get(url + "/extended")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "extended" {
+			t.Errorf("SPDY/%d: expected extended response, got %q", v.Version, s)
+		}
+		if err := <-results; err != nil {
+			t.Errorf("SPDY/%d: %v", v.Version, err)
+		}
+
+		r, err = client.Get(url + "/ok")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerDeadlineHeaderRace(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		results := make(chan error, 1)
+		server := &spdy.Server{
+			Server: &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Keep using the headers while the write deadline
+					// passes and for a while after the stream is reset.
+					reset := w.(http.CloseNotifier).CloseNotify()
+					deadline := time.Now().Add(150 * time.Millisecond)
+					for i := 0; time.Now().Before(deadline); i++ {
+						w.Header().Set("X-Count", fmt.Sprint(i))
+					}
+					select {
+					case <-reset:
+					case <-time.After(time.Second):
+						results <- errors.New("stream was not reset after its deadline")
+						return
+					}
+					w.Header().Set("X-Done", "true")
+					_, err := w.Write([]byte("late"))
+					if e, ok := err.(net.Error); !ok || !e.Timeout() {
+						results <- fmt.Errorf("expected timeout error, got %v", err)
+						return
+					}
+					results <- nil
+				}),
+				WriteTimeout: 30 * time.Millisecond,
+			},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		if r, err := client.Get("http://" + l.Addr().String()); err == nil {
+			b, _ := io.ReadAll(r.Body)
+			r.Body.Close()
+			if string(b) == "late" {
+				t.Errorf("SPDY/%d: response was sent after its deadline", v.Version)
+			}
+		}
+		if err := <-results; err != nil {
+			t.Errorf("SPDY/%d: %v", v.Version, err)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		closed := make(chan struct{})
+		server := &spdy.Server{
+			Server: &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					// Outlive the idle timeout.
+					select {
+					case <-closed:
+						t.Errorf("SPDY/%d: connection closed with a stream open", v.Version)
+						return
+					case <-time.After(150 * time.Millisecond):
+					}
+					w.Write([]byte("slow"))
+				}),
+				IdleTimeout: 50 * time.Millisecond,
+				ConnState: func(_ net.Conn, state http.ConnState) {
+					if state == http.StateClosed {
+						close(closed)
+					}
+				},
+			},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+
+		// A connection with an open stream is not idle.
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "slow" {
+			t.Errorf("SPDY/%d: incorrect page body: %q", v.Version, s)
+		}
+
+		// Once idle, the connection is closed.
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Errorf("SPDY/%d: idle connection was not closed", v.Version)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerHandlerLimits(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		var active, peak int32
+		var m sync.Mutex
+		var first sync.Once
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				m.Lock()
+				active++
+				if active > peak {
+					peak = active
+				}
+				m.Unlock()
+
+				// The first handler runs until the other
+				// streams have arrived.
+				first.Do(func() {
+					arrived := waitFor(func() bool {
+						stats, err := spdy.GetConnStats(w)
+						return err == nil && len(stats.Streams) == 4
+					})
+					if !arrived {
+						t.Errorf("SPDY/%d: queued streams did not arrive", v.Version)
+					}
+				})
+				m.Lock()
+				active--
+				m.Unlock()
+				versionHandler(w, r)
+			})},
+			Version:         &v,
+			MaxConnHandlers: 1,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		url := "http://" + l.Addr().String()
+
+		// Excess streams are queued.
+		var wg sync.WaitGroup
+		errs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, err := client.Get(url + "/queued")
+				if err != nil {
+					errs <- err
+					return
+				}
+				r.Body.Close()
+				if r.StatusCode != http.StatusOK {
+					errs <- fmt.Errorf("unexpected status %d", r.StatusCode)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("SPDY/%d: %v", v.Version, err)
+		}
+		if peak != 1 {
+			t.Errorf("SPDY/%d: expected 1 concurrent handler, got %d", v.Version, peak)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerRefuseStreams(t *testing.T) {
+	v := spdy.KnownVersion{Version: 3, Subversion: 1}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				started <- struct{}{}
+				<-release
+			}
+			versionHandler(w, r)
+		})},
+		Version:       &v,
+		MaxHandlers:   1,
+		RefuseStreams: true,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	url := "http://" + l.Addr().String()
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		r, err := newClient().Get(url + "/block")
+		if err == nil {
+			r.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+
+	// The server's limit is reached, so a stream on
+	// another connection is refused.
+	if r, err := newClient().Get(url + "/refused"); err == nil {
+		r.Body.Close()
+		t.Errorf("expected stream to be refused, got status %d", r.StatusCode)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newClient().Get(url + "/accepted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+}
+
+func TestHandlerLimitPriority(t *testing.T) {
+	limit := common.NewHandlerLimit(1)
+	if !limit.Add() {
+		t.Fatal("expected handler to start")
+	}
+	if limit.Add() {
+		t.Fatal("expected handler limit to be reached")
+	}
+
+	// Waiting handlers start in priority order.
+	order := make(chan common.Priority, 3)
+	for i, p := range []common.Priority{3, 1, 2} {
+		go func(p common.Priority) {
+			if limit.Wait(p, nil) {
+				order <- p
+			}
+		}(p)
+		if !waitFor(func() bool { return limit.Waiting() == i+1 }) {
+			t.Fatalf("handler with priority %d did not wait", p)
+		}
+	}
+
+	// A cancelled wait gives up its place.
+	stop := make(chan bool)
+	cancelled := make(chan bool)
+	go func() {
+		cancelled <- limit.Wait(0, stop)
+	}()
+	if !waitFor(func() bool { return limit.Waiting() == 4 }) {
+		t.Fatal("cancelled handler did not wait")
+	}
+	close(stop)
+	if <-cancelled {
+		t.Fatal("expected cancelled wait to fail")
+	}
+
+	for _, want := range []common.Priority{1, 2, 3} {
+		limit.Close()
+		if got := <-order; got != want {
+			t.Errorf("expected priority %d to start, got %d", want, got)
+		}
+	}
+	limit.Close()
+	if !limit.Add() {
+		t.Error("expected handler to start after all have finished")
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		entries := make(chan *common.AccessLogEntry, 10)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/logged", func(w http.ResponseWriter, r *http.Request) {
+			if err := w.(http.Pusher).Push("/pushed", nil); err != nil {
+				t.Errorf("SPDY/%d: %v", v.Version, err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "logged")
+		})
+		mux.HandleFunc("/pushed", func(w http.ResponseWriter, r *http.Request) {})
+		mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		})
+		server := &spdy.Server{
+			Server:  &http.Server{Handler: mux},
+			Version: &v,
+			AccessLog: func(entry *common.AccessLogEntry) {
+				entries <- entry
+			},
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		url := "http://" + l.Addr().String()
+
+		req, _ := http.NewRequest("POST", url+"/logged", strings.NewReader("request"))
+		req.Header.Set("User-Agent", "spdy-test")
+		r, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(r.Body)
+		r.Body.Close()
+
+		if r, err := client.Get(url + "/panic"); err == nil {
+			io.ReadAll(r.Body)
+			r.Body.Close()
+		}
+
+		got := make(map[string]*common.AccessLogEntry)
+		for len(got) < 3 {
+			select {
+			case entry := <-entries:
+				got[entry.Path] = entry
+			case <-time.After(time.Second):
+				t.Fatalf("SPDY/%d: expected 3 access log entries, got %d", v.Version, len(got))
+			}
+		}
+
+		e := got["/logged"]
+		if e == nil {
+			t.Fatalf("SPDY/%d: no entry for /logged", v.Version)
+		}
+		if e.Method != "POST" || e.Status != http.StatusCreated || e.BytesIn != 7 || e.BytesOut != 6 ||
+			e.UserAgent != "spdy-test" || e.Pushed || e.Reset != 0 || e.Goaway {
+			t.Errorf("SPDY/%d: unexpected entry for /logged: %+v", v.Version, e)
+		}
+		if e.Version != v.Version || e.Subversion != v.Subversion || e.StreamID != 1 {
+			t.Errorf("SPDY/%d: unexpected SPDY details for /logged: %+v", v.Version, e)
+		}
+
+		if e := got["/pushed"]; e == nil || !e.Pushed || e.Method != "GET" || e.StreamID&1 != 0 {
+			t.Errorf("SPDY/%d: unexpected entry for /pushed: %+v", v.Version, e)
+		}
+
+		if e := got["/panic"]; e == nil || e.Status != http.StatusOK || e.Reset != common.RST_STREAM_INTERNAL_ERROR {
+			t.Errorf("SPDY/%d: unexpected entry for /panic: %+v", v.Version, e)
+		}
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &common.AccessLogEntry{
+		Time:       time.Date(2014, time.March, 2, 13, 55, 36, 0, time.UTC),
+		Duration:   1500 * time.Microsecond,
+		RemoteAddr: "192.0.2.1:4321",
+		Method:     "GET",
+		Host:       "example.com",
+		Path:       "/index.html",
+		Proto:      "HTTP/1.1",
+		UserAgent:  `agent "quoted"`,
+		Status:     200,
+		BytesOut:   2326,
+		Version:    3,
+		Subversion: 1,
+		StreamID:   5,
+		Priority:   2,
+		Reset:      common.RST_STREAM_CANCEL,
+	}
+
+	tests := []struct {
+		logger func(io.Writer) common.AccessLogger
+		want   string
+	}{
+		{spdy.CommonLog, `192.0.2.1 - - [02/Mar/2014:13:55:36 +0000] "GET /index.html HTTP/1.1" 200 2326` + "\n"},
+		{spdy.CombinedLog, `192.0.2.1 - - [02/Mar/2014:13:55:36 +0000] "GET /index.html HTTP/1.1" 200 2326 "-" "agent \"quoted\""` + "\n"},
+		{spdy.JSONLog, `{"time":"2014-03-02T13:55:36.000Z","remote_addr":"192.0.2.1:4321","method":"GET","host":"example.com",` +
+			`"path":"/index.html","proto":"HTTP/1.1","user_agent":"agent \"quoted\"","status":200,"bytes_in":0,"bytes_out":2326,` +
+			`"duration_ms":1.5,"version":3,"subversion":1,"stream_id":5,"priority":2,"pushed":false,"reset":"CANCEL"}` + "\n"},
+	}
+
+	for i, test := range tests {
+		buf := new(bytes.Buffer)
+		test.logger(buf)(entry)
+		if got := buf.String(); got != test.want {
+			t.Errorf("Test %d: expected\n%s\ngot\n%s", i, test.want, got)
+		}
+	}
+}
+
+func TestServerConnState(t *testing.T) {
+	expectStates := func(t *testing.T, name string, states <-chan http.ConnState, want ...http.ConnState) {
+		for _, w := range want {
+			select {
+			case got := <-states:
+				if got != w {
+					t.Errorf("%s: expected state %v, got %v", name, w, got)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: timed out waiting for state %v", name, w)
+				return
+			}
+		}
+	}
+
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		serverStates := make(chan http.ConnState, 10)
+		server := &spdy.Server{
+			Server: &http.Server{
+				Handler: http.HandlerFunc(versionHandler),
+				ConnState: func(conn net.Conn, state http.ConnState) {
+					serverStates <- state
+				},
+			},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		nc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := spdy.NewClientConn(nc, nil, v.Version, v.Subversion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientStates := make(chan http.ConnState, 10)
+		conn.(spdy.ConnStater).SetStateHook(func(c common.Conn, state http.ConnState) {
+			clientStates <- state
+		})
+		go conn.Run()
+
+		req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/state", nil)
+		r, err := conn.RequestResponse(req, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(r.Body)
+		r.Body.Close()
+
+		expectStates(t, fmt.Sprintf("SPDY/%d server", v.Version), serverStates, http.StateNew, http.StateActive, http.StateIdle)
+		expectStates(t, fmt.Sprintf("SPDY/%d client", v.Version), clientStates, http.StateNew, http.StateActive, http.StateIdle)
+		if s := conn.(spdy.ConnStater).State(); s != http.StateIdle {
+			t.Errorf("SPDY/%d: expected client to be idle, got %v", v.Version, s)
+		}
+
+		conn.Close()
+		expectStates(t, fmt.Sprintf("SPDY/%d client", v.Version), clientStates, http.StateClosed)
+		expectStates(t, fmt.Sprintf("SPDY/%d server", v.Version), serverStates, http.StateClosed)
+
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerCredentials(t *testing.T) {
+	ts := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certs, err := spdy.GetCredentials(w)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(certs) == 0 {
+			io.WriteString(w, "none")
+			return
+		}
+		io.WriteString(w, certs[0].Subject.CommonName)
+	}))
+	defer ts.Close()
+
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"spdy/3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "spdy/3" {
+		t.Fatalf("negotiated %q, not spdy/3", state.NegotiatedProtocol)
+	}
+
+	client := newCertificate(t, "client")
+	key, cert := client.PrivateKey.(*ecdsa.PrivateKey), client.Leaf
+
+	input, err := state.ExportKeyingMaterial("EXPORTER SPDY certificate proof", nil, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(input)
+	proof, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := sha256.Sum256([]byte("wrong"))
+	badProof, err := ecdsa.SignASN1(rand.Reader, key, bad[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slot 2 has a valid proof, slot 3 does not.
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+	send := []common.Frame{
+		&frames.CREDENTIAL{Slot: 2, Proof: proof, Certificates: []*x509.Certificate{cert}},
+		&frames.CREDENTIAL{Slot: 3, Proof: badProof, Certificates: []*x509.Certificate{cert}},
+	}
+	for i, slot := range []byte{0, 2, 3} {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = common.StreamID(2*i + 1)
+		syn.Flags = common.FLAG_FIN
+		syn.Slot = slot
+		syn.Header = http.Header{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":host":    {ts.Listener.Addr().String()},
+			":scheme":  {"https"},
+		}
+		send = append(send, syn)
+	}
+	for _, frame := range send {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Collect the responses to each stream.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	bodies := make(map[common.StreamID]string)
+	var reset *frames.RST_STREAM
+	for finished := 0; finished < 3; {
+		frame, err := frames.ReadFrame(reader, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frame := frame.(type) {
+		case *frames.DATA:
+			bodies[frame.StreamID] += string(frame.Data)
+			if frame.Flags.FIN() {
+				finished++
+			}
+		case *frames.RST_STREAM:
+			reset = frame
+			finished++
+		}
+	}
+
+	if body := bodies[1]; body != "none" {
+		t.Errorf("stream without a slot: got %q, expected \"none\"", body)
+	}
+	if body := bodies[3]; body != "client" {
+		t.Errorf("stream using slot 2: got %q, expected \"client\"", body)
+	}
+	if reset == nil || reset.StreamID != 5 || reset.Status != common.RST_STREAM_INVALID_CREDENTIALS {
+		t.Errorf("stream using slot 3: expected INVALID_CREDENTIALS, got %v", reset)
+	}
+}
+
+func TestServerValidateOrigins(t *testing.T) {
+	for _, v := range []string{"spdy/2", "spdy/3.1"} {
+		server := &spdy.Server{
+			Server: &http.Server{
+				Handler:   http.HandlerFunc(versionHandler),
+				TLSConfig: &tls.Config{Certificates: []tls.Certificate{newCertificate(t, "server", "example.com")}},
+			},
+			ValidateOrigins: true,
+			AllowedOrigins:  []string{"*.allowed.example"},
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(l, "", "")
+
+		client := &http.Client{Transport: &spdy.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				NextProtos:         []string{v},
+			},
+		}}
+		for host, status := range map[string]int{
+			"example.com":          http.StatusOK,
+			"EXAMPLE.COM:443":      http.StatusOK,
+			"a.allowed.example":    http.StatusOK,
+			"allowed.example":      http.StatusMisdirectedRequest,
+			"other.example":        http.StatusMisdirectedRequest,
+			l.Addr().String():      http.StatusMisdirectedRequest,
+			"example.com.evil.net": http.StatusMisdirectedRequest,
+		} {
+			req, err := http.NewRequest("GET", "https://"+l.Addr().String()+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = host
+			r, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Body.Close()
+			if r.StatusCode != status {
+				t.Errorf("%s: request for %q got status %d, expected %d", v, host, r.StatusCode, status)
+			}
+		}
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerSchedulers(t *testing.T) {
+	// Each scheduler can serve requests.
+	for _, scheduler := range []func() common.Scheduler{common.NewPriorityScheduler, common.NewWeightedScheduler, common.NewRoundRobinScheduler} {
+		v := spdy.KnownVersion{3, 1}
+		server := &spdy.Server{
+			Server:       &http.Server{Handler: http.HandlerFunc(versionHandler)},
+			Version:      &v,
+			NewScheduler: scheduler,
+		}
+		l, _ := startServer(t, server)
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+			NewScheduler:   scheduler,
+		}}
+		r, err := client.Get("http://" + l.Addr().String() + "/scheduled")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != "SPDY/3.1 /scheduled" {
+			t.Errorf("Incorrect page body: %q", s)
+		}
+		server.Shutdown(context.Background())
+	}
+}
+
+func TestServerMaxDataSize(t *testing.T) {
+	const size = 32 << 10
+	var started sync.WaitGroup
+	started.Add(2)
+	v := spdy.KnownVersion{3, 0}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Write both responses at once.
+			started.Done()
+			started.Wait()
+			w.Write(bytes.Repeat([]byte{'x'}, size))
+		})},
+		Version:     &v,
+		MaxDataSize: 1024,
+	}
+
+	// Slow writes let both streams' frames queue.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(&wrapListener{l, func(conn net.Conn) net.Conn {
+		return slowConn{conn, time.Millisecond}
+	}})
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+
+	// Shut down the server before the connection closes.
+	defer server.Shutdown(context.Background())
+
+	for _, sid := range []common.StreamID{1, 3} {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = common.FLAG_FIN
+		syn.Header = http.Header{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":host":    {l.Addr().String()},
+			":scheme":  {"http"},
+		}
+		if err := syn.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syn.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Record the order in which the streams' DATA frames arrive.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	received := make(map[common.StreamID]int)
+	var order []common.StreamID
+	for finished := 0; finished < 2; {
+		frame, err := frames.ReadFrame(reader, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := frame.(*frames.DATA)
+		if !ok {
+			continue
+		}
+		if len(data.Data) > 1024 {
+			t.Fatalf("received DATA frame with %d bytes, expected at most 1024", len(data.Data))
+		}
+		received[data.StreamID] += len(data.Data)
+		if len(data.Data) > 0 {
+			order = append(order, data.StreamID)
+		}
+		if data.Flags.FIN() {
+			finished++
+		}
+	}
+
+	for _, sid := range []common.StreamID{1, 3} {
+		if received[sid] != size {
+			t.Errorf("stream %d: received %d bytes, expected %d", sid, received[sid], size)
+		}
+	}
+
+	// Neither stream should have been sent in one burst.
+	switched := 0
+	for i := 1; i < len(order); i++ {
+		if order[i] != order[i-1] {
+			switched++
+		}
+	}
+	if switched < 2 {
+		t.Errorf("streams were not interleaved: sent %v", order)
+	}
+}
+
+// wrapListener wraps the connections it accepts.
+type wrapListener struct {
+	net.Listener
+	wrap func(net.Conn) net.Conn
+}
+
+func (l *wrapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(conn), nil
+}
+
+// slowConn simulates a slow link, with each
+// write blocking for a delay.
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+// newLatencyConn returns a connection whose writes
+// are delivered after a delay.
+func newLatencyConn(conn net.Conn, delay time.Duration) net.Conn {
+	c := &latencyConn{
+		Conn:   conn,
+		delay:  delay,
+		writes: make(chan latencyWrite, 1024),
+		done:   make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+type latencyWrite struct {
+	data []byte
+	at   time.Time
+}
+
+// latencyConn simulates a link with high latency,
+// delivering each write after a delay without
+// limiting the data in flight.
+type latencyConn struct {
+	net.Conn
+	delay  time.Duration
+	writes chan latencyWrite
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	w := latencyWrite{data: append([]byte(nil), b...), at: time.Now().Add(c.delay)}
+	select {
+	case c.writes <- w:
+		return len(b), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *latencyConn) deliver() {
+	for {
+		select {
+		case w := <-c.writes:
+			time.Sleep(time.Until(w.at))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *latencyConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+func TestServerAutoFlowControl(t *testing.T) {
+	const size = 2 << 20
+	const delay = 20 * time.Millisecond
+
+	// upload sends a request body to a server whose
+	// window updates are delayed, returning the time
+	// taken.
+	upload := func(newFlowControl func() common.FlowControl) time.Duration {
+		v := spdy.KnownVersion{3, 1}
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n, _ := io.Copy(io.Discard, r.Body)
+				fmt.Fprint(w, n)
+			})},
+			Version:        &v,
+			NewFlowControl: newFlowControl,
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(&wrapListener{l, func(conn net.Conn) net.Conn {
+			return newLatencyConn(conn, delay)
+		}})
+		defer server.Shutdown(context.Background())
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+
+		// Wait for the server's SETTINGS to arrive,
+		// so the client uses the server's window size.
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		start := time.Now()
+		r, err = client.Post("http://"+l.Addr().String()+"/", "text/plain", bytes.NewReader(make([]byte, size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b); s != fmt.Sprint(size) {
+			t.Errorf("server received %s bytes, expected %d", s, size)
+		}
+		return time.Since(start)
+	}
+
+	fixed := upload(nil)
+	var flow *spdy3.AutoFlowControl
+	adaptive := upload(func() common.FlowControl {
+		flow = spdy3.NewAutoFlowControl(0, 0)
+		return flow
+	})
+
+	if rtt := flow.RTT(); rtt < delay {
+		t.Errorf("measured round-trip time of %v, expected at least %v", rtt, delay)
+	}
+	if adaptive > fixed/2 {
+		t.Errorf("upload took %v with adaptive flow control, and %v without", adaptive, fixed)
+	}
+}
+
+func TestServerBackpressure(t *testing.T) {
+	const chunk = 16 << 10
+	const limit = 64 << 10
+	var m sync.Mutex
+	written := 0
+	errs := make(chan error, 2)
+	v := spdy.KnownVersion{3, 0}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/deadline" {
+				http.NewResponseController(w).SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			}
+			for i := 0; i < 32; i++ {
+				if _, err := w.Write(make([]byte, chunk)); err != nil {
+					errs <- err
+					return
+				}
+				if r.URL.Path == "/" {
+					m.Lock()
+					written += chunk
+					m.Unlock()
+				}
+			}
+			errs <- nil
+		})},
+		Version:         &v,
+		MaxBufferedData: limit,
+	}
+	l, _ := startServer(t, server)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+
+	// Shut down the server before the connection closes.
+	defer server.Shutdown(context.Background())
+
+	send := func(frame common.Frame) {
+		if syn, ok := frame.(*frames.SYN_STREAM); ok {
+			if err := syn.Compress(compressor); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := frame.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(sid common.StreamID, path string) {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Flags = common.FLAG_FIN
+		syn.Header = http.Header{
+			":method":  {"GET"},
+			":path":    {path},
+			":version": {"HTTP/1.1"},
+			":host":    {l.Addr().String()},
+			":scheme":  {"http"},
+		}
+		send(syn)
+	}
+
+	// Without window updates, the handler can send one
+	// window of data and buffer up to the limit, so
+	// wait until it is within a chunk of the limit.
+	request(1, "/")
+	var n int
+	waitFor(func() bool {
+		m.Lock()
+		n = written
+		m.Unlock()
+		return n > common.DEFAULT_INITIAL_WINDOW_SIZE+limit-chunk
+	})
+	if n < common.DEFAULT_INITIAL_WINDOW_SIZE || n > common.DEFAULT_INITIAL_WINDOW_SIZE+limit+chunk {
+		t.Errorf("handler wrote %d bytes before blocking", n)
+	}
+
+	// Writes resume as the window grows.
+	send(&frames.WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 1 << 20})
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("handler's writes failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler's writes did not resume")
+	}
+
+	// Blocked writes respect the write deadline.
+	request(3, "/deadline")
+	select {
+	case err := <-errs:
+		var timeout *common.TimeoutError
+		if !errors.As(err, &timeout) {
+			t.Fatalf("Expected a TimeoutError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked write did not time out")
+	}
+
+	// With SPDY/3.1, the connection window is exhausted while
+	// the stream window is not, so the handler can send one
+	// connection window of data and buffer up to the limit.
+	written = 0
+	v31 := spdy.KnownVersion{3, 1}
+	server31 := &spdy.Server{
+		Server:          &http.Server{Handler: server.Server.Handler},
+		Version:         &v31,
+		MaxBufferedData: limit,
+	}
+	l31, _ := startServer(t, server31)
+
+	conn31, err := net.Dial("tcp", l31.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn31.Close()
+
+	compressor31 := common.NewCompressor(3)
+	defer compressor31.Close()
+	defer server31.Shutdown(context.Background())
+
+	syn := new(frames.SYN_STREAMV3_1)
+	syn.StreamID = 1
+	syn.Flags = common.FLAG_FIN
+	syn.Header = http.Header{
+		":method":  {"GET"},
+		":path":    {"/"},
+		":version": {"HTTP/1.1"},
+		":host":    {l31.Addr().String()},
+		":scheme":  {"http"},
+	}
+	if err := syn.Compress(compressor31); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syn.WriteTo(conn31); err != nil {
+		t.Fatal(err)
+	}
+	grow := &frames.WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 16 << 20}
+	if _, err := grow.WriteTo(conn31); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool {
+		m.Lock()
+		n = written
+		m.Unlock()
+		return n >= common.DEFAULT_INITIAL_WINDOW_SIZE+limit
+	})
+	if n < common.DEFAULT_INITIAL_WINDOW_SIZE+limit || n > common.DEFAULT_INITIAL_WINDOW_SIZE+limit+chunk {
+		t.Errorf("handler wrote %d bytes before blocking on the connection window", n)
+	}
+
+	// Writes resume as the connection window grows.
+	update := &frames.WINDOW_UPDATE{StreamID: 0, DeltaWindowSize: 1 << 20}
+	if _, err := update.WriteTo(conn31); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("handler's writes failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler's writes did not resume")
+	}
+}
+
+func TestServerConnectionWindowControlFrames(t *testing.T) {
+	const chunk = 16 << 10
+	v := spdy.KnownVersion{3, 1}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/upload":
+				io.Copy(io.Discard, r.Body)
+			case "/deadline":
+				http.NewResponseController(w).SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+			}
+			for i := 0; i < 32; i++ {
+				if _, err := w.Write(make([]byte, chunk)); err != nil {
+					return
+				}
+			}
+		})},
+		Version: &v,
+	}
+	l, _ := startServer(t, server)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	send := func(frame common.Frame) {
+		if err := frame.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := frame.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := func(sid common.StreamID, method, path string, fin bool) {
+		syn := new(frames.SYN_STREAMV3_1)
+		syn.StreamID = sid
+		if fin {
+			syn.Flags = common.FLAG_FIN
+		}
+		syn.Header = http.Header{
+			":method":  {method},
+			":path":    {path},
+			":version": {"HTTP/1.1"},
+			":host":    {l.Addr().String()},
+			":scheme":  {"http"},
+		}
+		send(syn)
+	}
+
+	// Exhaust the connection window, leaving the stream
+	// window open.
+	request(1, "GET", "/", true)
+	send(&frames.WINDOW_UPDATE{StreamID: 1, DeltaWindowSize: 16 << 20})
+	for received := 0; received < common.DEFAULT_INITIAL_WINDOW_SIZE; {
+		frame, err := frames.ReadFrame(reader, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*frames.DATA); ok {
+			received += len(data.Data)
+		}
+	}
+
+	// The server still acknowledges the data it receives,
+	// and resets the stream whose write deadline passes,
+	// while its DATA waits for the connection window.
+	request(3, "POST", "/upload", false)
+	send(&frames.DATA{StreamID: 3, Data: make([]byte, 40<<10)})
+	request(5, "GET", "/deadline", true)
+
+	var updated, reset bool
+	for !updated || !reset {
+		frame, err := frames.ReadFrame(reader, 1)
+		if err != nil {
+			t.Fatalf("updated: %v, reset: %v: %v", updated, reset, err)
+		}
+		switch frame := frame.(type) {
+		case *frames.WINDOW_UPDATE:
+			if frame.StreamID == 3 {
+				updated = true
+			}
+		case *frames.RST_STREAM:
+			if frame.StreamID == 5 && frame.Status == common.RST_STREAM_CANCEL {
+				reset = true
+			}
+		case *frames.DATA:
+			t.Fatalf("DATA sent on stream %d with the connection window exhausted", frame.StreamID)
+		}
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	const bodySize = 1000
+	const responseSize = 500
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 0}, {3, 1}} {
+		type result struct {
+			stream   common.StreamStats
+			conn     common.ConnStats
+			priority int
+			err      error
+		}
+		results := make(chan result, 1)
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.Write(make([]byte, responseSize))
+				var res result
+				res.priority, _ = spdy.GetPriority(w)
+				res.stream, res.err = spdy.GetStreamStats(w)
+				if res.err == nil {
+					res.conn, res.err = spdy.GetConnStats(w)
+				}
+				results <- res
+			})},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+		defer server.Shutdown(context.Background())
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		r, err := client.Post("http://"+l.Addr().String()+"/", "text/plain", bytes.NewReader(make([]byte, bodySize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+
+		res := <-results
+		if res.err != nil {
+			t.Fatalf("SPDY/%d.%d: %v", v.Version, v.Subversion, res.err)
+		}
+		stream, conn := res.stream, res.conn
+		if stream.StreamID != 1 {
+			t.Errorf("SPDY/%d.%d: expected stream ID 1, got %d", v.Version, v.Subversion, stream.StreamID)
+		}
+		if int(stream.Priority) != res.priority {
+			t.Errorf("SPDY/%d.%d: expected priority %d, got %d", v.Version, v.Subversion, res.priority, stream.Priority)
+		}
+		if !stream.State.ClosedThere() {
+			t.Errorf("SPDY/%d.%d: expected stream to be half-closed by the client", v.Version, v.Subversion)
+		}
+		if stream.BytesReceived != bodySize || stream.BytesSent != responseSize {
+			t.Errorf("SPDY/%d.%d: expected %d bytes received and %d sent, got %d and %d", v.Version, v.Subversion,
+				bodySize, responseSize, stream.BytesReceived, stream.BytesSent)
+		}
+		if v.Version > 2 && (stream.SendWindow <= 0 || stream.ReceiveWindow <= 0) {
+			t.Errorf("SPDY/%d.%d: expected open transfer windows, got %d and %d", v.Version, v.Subversion,
+				stream.SendWindow, stream.ReceiveWindow)
+		}
+
+		if conn.Version != v.Version || conn.Subversion != v.Subversion {
+			t.Errorf("SPDY/%d.%d: connection reported version %d.%d", v.Version, v.Subversion, conn.Version, conn.Subversion)
+		}
+		if len(conn.Streams) != 1 || conn.Streams[0].StreamID != stream.StreamID {
+			t.Errorf("SPDY/%d.%d: expected only stream %d, got %v", v.Version, v.Subversion, stream.StreamID, conn.Streams)
+		}
+		if (v.Subversion > 0) != (conn.ReceiveWindow > 0) {
+			t.Errorf("SPDY/%d.%d: unexpected connection receive window of %d", v.Version, v.Subversion, conn.ReceiveWindow)
+		}
+	}
+}
+
+func TestServerBandwidth(t *testing.T) {
+	const size = 64 << 10
+	const rate = 128 << 10
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, size))
+		})
+		mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+			if err := spdy.SetStreamBandwidth(w, rate); err != nil {
+				t.Error(err)
+			}
+			w.Write(make([]byte, size))
+		})
+		server := &spdy.Server{
+			Server:    &http.Server{Handler: mux},
+			Version:   &v,
+			Bandwidth: 2 * rate,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+
+		// Each response should take most of size/limit,
+		// less what the token bucket holds initially.
+		for path, limit := range map[string]int{"/": 2 * rate, "/stream": rate} {
+			start := time.Now()
+			r, err := client.Get("http://" + l.Addr().String() + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, _ := io.Copy(io.Discard, r.Body)
+			r.Body.Close()
+			elapsed := time.Since(start)
+			if n != size {
+				t.Errorf("SPDY/%d.%d %s: received %d bytes, expected %d", v.Version, v.Subversion, path, n, size)
+			}
+			if min := time.Duration(size) * time.Second * 3 / time.Duration(4*limit); elapsed < min {
+				t.Errorf("SPDY/%d.%d %s: response took %v, expected at least %v", v.Version, v.Subversion, path, elapsed, min)
+			}
+		}
+	}
+}
+
+func TestServerBandwidthPing(t *testing.T) {
+	const size = 64 << 10
+	const rate = 32 << 10
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		pings := make(chan time.Duration, 3)
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(pings)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					w.Write(make([]byte, size))
+				}()
+				defer func() { <-done }()
+
+				// While the response's DATA is held back by
+				// the bandwidth limit, PINGs are sent at once.
+				sent := waitFor(func() bool {
+					stats, err := spdy.GetStreamStats(w)
+					return err == nil && stats.BytesSent > 0
+				})
+				if !sent {
+					t.Error("response DATA was not sent")
+					return
+				}
+				for i := 0; i < cap(pings); i++ {
+					start := time.Now()
+					ping, err := spdy.PingClient(w)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok := <-ping; !ok {
+						t.Error("PING failed")
+						return
+					}
+					pings <- time.Since(start)
+				}
+			})},
+			Version:     &v,
+			Bandwidth:   rate,
+			MaxDataSize: rate,
+		}
+		l, _ := startServer(t, server)
+		defer server.Shutdown(context.Background())
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := io.Copy(io.Discard, r.Body); n != size {
+			t.Errorf("SPDY/%d.%d: received %d bytes, expected %d", v.Version, v.Subversion, n, size)
+		}
+		r.Body.Close()
+
+		for elapsed := range pings {
+			if elapsed > 250*time.Millisecond {
+				t.Errorf("SPDY/%d.%d: PING took %v while DATA was throttled", v.Version, v.Subversion, elapsed)
+			}
+		}
+	}
+}
+
+func TestServerPeerBandwidth(t *testing.T) {
+	const size = 32 << 10
+	var started sync.WaitGroup
+	started.Add(2)
+	v := spdy.KnownVersion{3, 0}
+	server := &spdy.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Write both responses at once.
+			started.Done()
+			started.Wait()
+			w.Write(make([]byte, size))
+		})},
+		Version:       &v,
+		MaxDataSize:   1024,
+		PeerBandwidth: true,
+	}
+	l, _ := startServer(t, server)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	compressor := common.NewCompressor(3)
+	defer compressor.Close()
+
+	// Shut down the server before the connection closes.
+	defer server.Shutdown(context.Background())
+
+	// Limit the server to 128 kB/s.
+	settings := new(frames.SETTINGS)
+	settings.Settings = common.Settings{
+		common.SETTINGS_DOWNLOAD_BANDWIDTH: &common.Setting{
+			ID:    common.SETTINGS_DOWNLOAD_BANDWIDTH,
+			Value: 128,
+		},
+	}
+	if _, err := settings.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stream 3 has the higher priority.
+	start := time.Now()
+	for _, sid := range []common.StreamID{1, 3} {
+		syn := new(frames.SYN_STREAM)
+		syn.StreamID = sid
+		syn.Priority = common.Priority(7 - sid)
+		syn.Flags = common.FLAG_FIN
+		syn.Header = http.Header{
+			":method":  {"GET"},
+			":path":    {"/"},
+			":version": {"HTTP/1.1"},
+			":host":    {l.Addr().String()},
+			":scheme":  {"http"},
+		}
+		if err := syn.Compress(compressor); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := syn.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Record the order in which the streams finish.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	var order []common.StreamID
+	for len(order) < 2 {
+		frame, err := frames.ReadFrame(reader, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, ok := frame.(*frames.DATA); ok && data.Flags.FIN() {
+			order = append(order, data.StreamID)
+		}
+	}
+	elapsed := time.Since(start)
+
+	if order[0] != 3 {
+		t.Errorf("streams finished in order %v, expected the higher priority stream 3 first", order)
+	}
+	if min := 2 * size * time.Second * 3 / (4 * 128 << 10); elapsed < min {
+		t.Errorf("responses took %v, expected at least %v", elapsed, min)
+	}
+}
+
+func TestServerTrailersWithoutBody(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "Server-Trailer-A")
+				w.Header().Set("Server-Trailer-A", "valuea")
+				w.Header().Set(http.TrailerPrefix+"Server-Trailer-B", "valueb")
+			})},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+		r, err := client.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Shutdown(context.Background())
+
+		if len(b) != 0 {
+			t.Errorf("SPDY/%d: expected an empty body, got %q", v.Version, b)
+		}
+		if got := r.Trailer.Get("Server-Trailer-A"); got != "valuea" {
+			t.Errorf("SPDY/%d: expected declared trailer %q, got %q", v.Version, "valuea", got)
+		}
+		if got := r.Trailer.Get("Server-Trailer-B"); got != "valueb" {
+			t.Errorf("SPDY/%d: expected prefixed trailer %q, got %q", v.Version, "valueb", got)
+		}
+		if got := r.Header.Get("Server-Trailer-A") + r.Header.Get("Server-Trailer-B"); got != "" {
+			t.Errorf("SPDY/%d: trailers leaked into header: %q", v.Version, got)
+		}
+	}
+}
+
+func TestServerRequestTrailers(t *testing.T) {
+	for _, v := range []spdy.KnownVersion{{2, 0}, {3, 1}} {
+		server := &spdy.Server{
+			Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The declared trailers are known before
+				// the body has been read.
+				if _, ok := r.Trailer["Client-Trailer"]; !ok {
+					t.Errorf("SPDY/%d: trailer not declared before body: %v", v.Version, r.Trailer)
+				}
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				fmt.Fprintf(w, "%s %s", b, r.Trailer.Get("Client-Trailer"))
+			})},
+			Version: &v,
+		}
+		l, _ := startServer(t, server)
+
+		client := &http.Client{Transport: &spdy.Transport{
+			PriorKnowledge: map[string]spdy.KnownVersion{"*": v},
+		}}
+
+		// Send the body in pieces, so that it
+		// arrives in separate DATA frames.
+		body, bodyWriter := io.Pipe()
+		go func() {
+			for i := 0; i < 3; i++ {
+				bodyWriter.Write([]byte("x"))
+			}
+			bodyWriter.Close()
+		}()
+		req, err := http.NewRequest("POST", "http://"+l.Addr().String()+"/", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Trailer = http.Header{"Client-Trailer": {"clientvalue"}}
+
+		r, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pedanticReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Shutdown(context.Background())
+
+		if s := string(b); s != "xxx clientvalue" {
+			t.Errorf("SPDY/%d: incorrect page body: %q", v.Version, s)
+		}
+	}
+}
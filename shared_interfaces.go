@@ -1,6 +1,8 @@
 package spdy
 
 import (
+	"context"
+	"crypto/x509"
 	"io"
 	"net"
 	"net/http"
@@ -57,6 +59,73 @@ type PriorityStream interface {
 var _ = PriorityStream(&spdy2.ResponseStream{})
 var _ = PriorityStream(&spdy3.ResponseStream{})
 
+// CredentialStream represents a SPDY stream with
+// client certificates.
+type CredentialStream interface {
+	Stream
+
+	// Credentials returns the client
+	// certificates for the stream.
+	Credentials() []*x509.Certificate
+}
+
+var _ = CredentialStream(&spdy2.ResponseStream{})
+var _ = CredentialStream(&spdy3.ResponseStream{})
+
+// StatsStream represents a SPDY stream which
+// can describe its state and transfer windows.
+type StatsStream interface {
+	Stream
+
+	// Stats returns a description
+	// of the stream.
+	Stats() common.StreamStats
+}
+
+var _ = StatsStream(&spdy2.PushStream{})
+var _ = StatsStream(&spdy2.RequestStream{})
+var _ = StatsStream(&spdy2.ResponseStream{})
+var _ = StatsStream(&spdy3.PushStream{})
+var _ = StatsStream(&spdy3.RequestStream{})
+var _ = StatsStream(&spdy3.ResponseStream{})
+
+// BandwidthStream represents a SPDY stream whose
+// bandwidth can be limited.
+type BandwidthStream interface {
+	Stream
+
+	// SetBandwidth limits the data sent on
+	// the stream to rate bytes per second.
+	SetBandwidth(rate int64)
+}
+
+var _ = BandwidthStream(&spdy2.PushStream{})
+var _ = BandwidthStream(&spdy2.RequestStream{})
+var _ = BandwidthStream(&spdy2.ResponseStream{})
+var _ = BandwidthStream(&spdy3.PushStream{})
+var _ = BandwidthStream(&spdy3.RequestStream{})
+var _ = BandwidthStream(&spdy3.ResponseStream{})
+
+// StatsConn represents a SPDY connection which can
+// describe itself and its active streams.
+type StatsConn interface {
+	Conn
+
+	// Stats returns a description of the
+	// connection and its active streams.
+	Stats() common.ConnStats
+}
+
+var _ = StatsConn(&spdy2.Conn{})
+var _ = StatsConn(&spdy3.Conn{})
+
+// Response streams can be used with net/http's
+// optional ResponseWriter interfaces.
+var _ = http.Flusher(&spdy2.ResponseStream{})
+var _ = http.Flusher(&spdy3.ResponseStream{})
+var _ = http.Pusher(&spdy2.ResponseStream{})
+var _ = http.Pusher(&spdy3.ResponseStream{})
+
 // Compressor is used to compress the text header of a SPDY frame.
 type Compressor interface {
 	io.Closer
@@ -94,3 +163,23 @@ type SetFlowController interface {
 }
 
 var _ = SetFlowController(&spdy3.Conn{})
+
+// ConnStater represents a connection which reports
+// its state, using the transitions reported to
+// http.Server.ConnState.
+type ConnStater interface {
+	State() http.ConnState
+	SetStateHook(func(common.Conn, http.ConnState))
+}
+
+var _ = ConnStater(&spdy2.Conn{})
+var _ = ConnStater(&spdy3.Conn{})
+
+// Shutdowner represents a connection which
+// can be shut down gracefully.
+type Shutdowner interface {
+	Shutdown(context.Context) error
+}
+
+var _ = Shutdowner(&spdy2.Conn{})
+var _ = Shutdowner(&spdy3.Conn{})
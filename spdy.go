@@ -6,6 +6,7 @@ package spdy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"net/url"
 	"strings"
@@ -114,6 +115,63 @@ func GetPriority(w http.ResponseWriter) (int, error) {
 	return 0, common.ErrNotSPDY
 }
 
+// GetCredentials returns the client certificates for the
+// given stream. With SPDY/3, a client can send CREDENTIAL
+// frames to use different certificates for each origin,
+// and the certificates returned are those for the stream's
+// credential slot. Otherwise, they are the certificates
+// from the TLS handshake.
+// If the underlying connection is using HTTP, and not SPDY,
+// GetCredentials will return the ErrNotSPDY error.
+func GetCredentials(w http.ResponseWriter) ([]*x509.Certificate, error) {
+	if stream, ok := w.(CredentialStream); ok {
+		return stream.Credentials(), nil
+	}
+	return nil, common.ErrNotSPDY
+}
+
+// GetStreamStats returns a description of the given
+// stream, including its state, priority, and transfer
+// windows, which can help when debugging a stalled
+// response.
+// If the underlying connection is using HTTP, and not SPDY,
+// GetStreamStats will return the ErrNotSPDY error.
+func GetStreamStats(w http.ResponseWriter) (common.StreamStats, error) {
+	if stream, ok := w.(StatsStream); ok {
+		return stream.Stats(), nil
+	}
+	return common.StreamStats{}, common.ErrNotSPDY
+}
+
+// GetConnStats returns a description of the connection
+// used by the given stream, and of each of its active
+// streams. With SPDY/3.1, this includes the connection's
+// transfer windows.
+// If the underlying connection is using HTTP, and not SPDY,
+// GetConnStats will return the ErrNotSPDY error.
+func GetConnStats(w http.ResponseWriter) (common.ConnStats, error) {
+	if stream, ok := w.(Stream); ok {
+		if conn, ok := stream.Conn().(StatsConn); ok {
+			return conn.Stats(), nil
+		}
+	}
+	return common.ConnStats{}, common.ErrNotSPDY
+}
+
+// SetStreamBandwidth limits the data sent on the given
+// stream to rate bytes per second, in addition to any
+// limit on its connection. A rate of zero removes the
+// stream's limit.
+// If the underlying connection is using HTTP, and not SPDY,
+// SetStreamBandwidth will return the ErrNotSPDY error.
+func SetStreamBandwidth(w http.ResponseWriter, rate int64) error {
+	if stream, ok := w.(BandwidthStream); ok {
+		stream.SetBandwidth(rate)
+		return nil
+	}
+	return common.ErrNotSPDY
+}
+
 // PingClient is used to send PINGs with SPDY servers.
 // PingClient takes a ResponseWriter and returns a channel on
 // which a spdy.Ping will be sent when the PING response is
@@ -213,7 +271,9 @@ func PingServer(c http.Client, server string) (<-chan bool, error) {
 				u.Host += ":443"
 			}
 		}
+		transport.m.Lock()
 		conn, ok := transport.spdyConns[u.Host]
+		transport.m.Unlock()
 		if !ok || conn == nil {
 			return nil, common.ErrNotConnected
 		}
@@ -229,6 +289,9 @@ func PingServer(c http.Client, server string) (<-chan bool, error) {
 // If the underlying connection is using HTTP, and not SPDY,
 // Push will return the ErrNotSPDY error.
 //
+// SPDY ResponseWriters also implement http.Pusher, which
+// serves the pushed resource using the handler.
+//
 // A simple example of pushing a file is:
 //
 //      import (
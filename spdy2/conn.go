@@ -21,7 +21,23 @@ import (
 // servers and clients, and is created with either NewServerConn,
 // or NewClientConn.
 type Conn struct {
-	PushReceiver common.Receiver // Receiver to call for server Pushes.
+	PushReceiver common.Receiver      // Receiver to call for server Pushes.
+	PushPreloads bool                 // Whether to push resources named in preload links.
+	AccessLog    common.AccessLogger  // Logger called as each served stream ends.
+	Origins      *common.OriginPolicy // If non-nil, the hosts for which requests are served.
+	Scheduler    common.Scheduler     // Orders outbound frames. This must be set before Run is called.
+	MaxDataSize  int                  // Maximum payload of each DATA frame sent; zero means DEFAULT_MAX_DATA_SIZE.
+
+	// Server stream limits. These must be set before Run is called.
+	MaxConcurrentStreams uint32               // Maximum streams the client may open; zero means DEFAULT_STREAM_LIMIT.
+	MaxHandlers          int                  // Maximum handlers executing on this connection; zero means no limit.
+	Handlers             *common.HandlerLimit // Limit on handlers executing, which may be shared between connections.
+	RefuseStreams        bool                 // Whether to refuse, rather than queue, streams over the handler limits.
+
+	// Bandwidth limits, in bytes of data per second. These must be set before Run is called.
+	Bandwidth       int64 // Maximum data sent on the connection; zero means no limit.
+	StreamBandwidth int64 // Maximum data sent on each stream; zero means no limit.
+	PeerBandwidth   bool  // Whether to also limit the connection to the peer's DOWNLOAD_BANDWIDTH setting.
 
 	// network state
 	remoteAddr  string
@@ -42,6 +58,10 @@ type Conn struct {
 	goawaySent       bool                // goaway has been sent.
 	goawayLock       sync.Mutex          // protects goawaySent and goawayReceived.
 	numBenignErrors  int                 // number of non-serious errors encountered.
+	bandwidth        *common.RateLimiter // limit on data sent on the connection.
+	throttledUntil   time.Time           // when DATA can next be sent within the bandwidth limit.
+	heldFrames       []common.Frame      // frames held back by the bandwidth limit.
+	scheduledControl int                 // frames other than DATA waiting in the Scheduler.
 	readTimeout      time.Duration       // optional timeout for network reads.
 	writeTimeout     time.Duration       // optional timeout for network writes.
 	timeoutLock      sync.Mutex          // protects changes to readTimeout and writeTimeout.
@@ -53,18 +73,32 @@ type Conn struct {
 	nextPingIDLock       sync.Mutex                            // protects nextPingID.
 	pushStreamLimit      *common.StreamLimit                   // Limit on streams started by the server.
 	pushRequests         map[common.StreamID]*http.Request     // map of requests sent in server pushes.
+	pushRequestsLock     sync.Mutex                            // protects pushRequests.
 	lastPushStreamID     common.StreamID                       // last push stream ID. (even)
 	lastPushStreamIDLock sync.Mutex                            // protects lastPushStreamID.
 	pushedResources      map[common.Stream]map[string]struct{} // prevents duplicate headers being pushed.
+	pushedResourcesLock  sync.Mutex                            // protects pushedResources.
+	preloaded            map[string]struct{}                   // resources pushed from preload links.
+	preloadedLock        sync.Mutex                            // protects preloaded.
 
 	// requests
-	lastRequestStreamID     common.StreamID     // last request stream ID. (odd)
-	lastRequestStreamIDLock sync.Mutex          // protects lastRequestStreamID.
-	streamCreation          sync.Mutex          // ensures new streams are sent in order.
-	oddity                  common.StreamID     // whether locally-sent streams are odd or even.
-	initialWindowSize       uint32              // initial transport window.
-	initialWindowSizeLock   sync.Mutex          // lock for initialWindowSize
-	requestStreamLimit      *common.StreamLimit // Limit on streams started by the client.
+	lastRequestStreamID     common.StreamID      // last request stream ID. (odd)
+	lastRequestStreamIDLock sync.Mutex           // protects lastRequestStreamID.
+	streamCreation          sync.Mutex           // ensures new streams are sent in order.
+	oddity                  common.StreamID      // whether locally-sent streams are odd or even.
+	initialWindowSize       uint32               // initial transport window.
+	initialWindowSizeLock   sync.Mutex           // lock for initialWindowSize
+	requestStreamLimit      *common.StreamLimit  // Limit on streams started by the client.
+	handlers                *common.HandlerLimit // Limit on handlers executing on this connection.
+
+	// connection state
+	netConn     net.Conn                          // underlying connection, as reported to ConnState.
+	state       http.ConnState                    // current state of the connection.
+	stateHook   func(common.Conn, http.ConnState) // called as the state changes.
+	stateLock   sync.Mutex                        // protects state, stateHook and idleTimer.
+	nextProto   bool                              // whether net/http reports StateNew and StateClosed.
+	idleTimer   *time.Timer                       // closes the connection once it has been idle for idleTimeout.
+	idleTimeout time.Duration                     // how long the connection may have no open streams (servers).
 
 	// startup and shutdown
 	stop          chan bool     // this channel is closed when the connection closes.
@@ -83,6 +117,7 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 	out.remoteAddr = conn.RemoteAddr().String()
 	out.server = server
 	out.conn = conn
+	out.netConn = conn
 	out.buf = bufio.NewReader(conn)
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		out.tlsState = new(tls.ConnectionState)
@@ -98,9 +133,11 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 	out.output[6] = make(chan common.Frame)
 	out.output[7] = make(chan common.Frame)
 	out.pings = make(map[uint32]chan<- bool)
+	out.Scheduler = common.NewWeightedScheduler()
 	out.compressor = common.NewCompressor(2)
 	out.decompressor = common.NewDecompressor(2)
 	out.receivedSettings = make(common.Settings)
+	out.bandwidth = common.NewRateLimiter(0)
 	out.lastPushStreamID = 0
 	out.lastRequestStreamID = 0
 	out.stop = make(chan bool)
@@ -113,16 +150,28 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 		out.requestStreamLimit = common.NewStreamLimit(common.DEFAULT_STREAM_LIMIT)
 		out.pushStreamLimit = common.NewStreamLimit(common.NO_STREAM_LIMIT)
 		out.init = func() {
+			limit := out.streamLimit()
+			out.requestStreamLimit.SetLimit(limit)
+			if out.MaxHandlers > 0 {
+				out.handlers = common.NewHandlerLimit(out.MaxHandlers)
+			}
+
 			// Initialise the connection by sending the connection settings.
 			settings := new(frames.SETTINGS)
-			settings.Settings = defaultServerSettings(common.DEFAULT_STREAM_LIMIT)
+			settings.Settings = defaultServerSettings(limit)
 			out.output[0] <- settings
 		}
-		if d := server.ReadTimeout; d != 0 {
-			out.SetReadTimeout(d)
+		// The server's ReadTimeout and WriteTimeout are applied
+		// to each stream, rather than the connection, so any
+		// deadlines set while negotiating are cleared. The
+		// connection is instead closed once it has had no
+		// open streams for the IdleTimeout, or ReadTimeout.
+		if server.ReadTimeout != 0 || server.WriteTimeout != 0 {
+			conn.SetDeadline(time.Time{})
 		}
-		if d := server.WriteTimeout; d != 0 {
-			out.SetWriteTimeout(d)
+		out.idleTimeout = server.IdleTimeout
+		if out.idleTimeout == 0 {
+			out.idleTimeout = server.ReadTimeout
 		}
 		out.pushedResources = make(map[common.Stream]map[string]struct{})
 
@@ -143,14 +192,57 @@ func NewConn(conn net.Conn, server *http.Server) *Conn {
 	return out
 }
 
+// maxDataSize returns the maximum payload
+// of each DATA frame sent.
+func (c *Conn) maxDataSize() int {
+	if c.MaxDataSize <= 0 {
+		return common.DEFAULT_MAX_DATA_SIZE
+	}
+	if c.MaxDataSize > common.MAX_DATA_SIZE {
+		return common.MAX_DATA_SIZE
+	}
+	return c.MaxDataSize
+}
+
+// updateBandwidth sets the connection's bandwidth limit
+// from Bandwidth and, if PeerBandwidth is set, from the
+// DOWNLOAD_BANDWIDTH setting received from the peer, which
+// is given in kilobytes per second. The lower limit is used.
+func (c *Conn) updateBandwidth() {
+	rate := c.Bandwidth
+	if setting, ok := c.receivedSettings[common.SETTINGS_DOWNLOAD_BANDWIDTH]; ok && c.PeerBandwidth && setting.Value > 0 {
+		peer := int64(setting.Value) * 1024
+		if rate <= 0 || peer < rate {
+			rate = peer
+		}
+	}
+	c.bandwidth.SetRate(rate)
+}
+
+// accessLogRecord starts recording a stream for the
+// access log, returning nil if access logging is
+// disabled.
+func (c *Conn) accessLogRecord(entry common.AccessLogEntry) *common.AccessLogRecord {
+	entry.RemoteAddr = c.remoteAddr
+	entry.Version = 2
+	return common.NewAccessLogRecord(c.AccessLog, entry)
+}
+
 // NextProto is intended for use in http.Server.TLSNextProto,
 // using SPDY/2 for the connection.
 func NextProto(s *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-	NewConn(tlsConn, s).Run()
+	conn := NewConn(tlsConn, s)
+	conn.nextProto = true
+	conn.Run()
 }
 
 func (c *Conn) Run() error {
 	defer common.Recover()
+	c.reportState(http.StateNew)
+	c.stateLock.Lock()
+	c.updateIdleTimer(true)
+	c.stateLock.Unlock()
+	c.updateBandwidth()
 	go c.send()        // Start the send loop.
 	if c.init != nil { // Must be after sending is enabled.
 		c.init() // Prepare any initialisation frames.
@@ -192,10 +284,125 @@ func (c *Conn) newStream(frame *frames.SYN_STREAM) *ResponseStream {
 		TLS:        c.tlsState,
 	}
 
+	// Requests for other origins are misdirected.
+	handler := c.server.Handler
+	if !c.Origins.Allow(url.Host) {
+		debug.Printf("Request for %q is not allowed by the origin policy.\n", url.Host)
+		handler = http.HandlerFunc(common.MisdirectedRequest)
+	}
+
 	output := c.output[frame.Priority]
 	c.streamCreation.Lock()
-	out := NewResponseStream(c, frame, output, c.server.Handler, request)
+	out := NewResponseStream(c, frame, output, handler, request)
 	c.streamCreation.Unlock()
 
 	return out
 }
+
+// recordGoaway records, for the access log, that the
+// stream was ended by the connection closing.
+func (c *Conn) recordGoaway(stream common.Stream) {
+	// SPDY/2 GOAWAY frames have no status.
+	switch stream := stream.(type) {
+	case *ResponseStream:
+		stream.record.Goaway(common.GOAWAY_OK)
+	case *PushStream:
+		stream.record.Goaway(common.GOAWAY_OK)
+	}
+}
+
+// recordReset records, for the access log, that the
+// stream was reset with the given status.
+func recordReset(stream common.Stream, status common.StatusCode) {
+	switch stream := stream.(type) {
+	case *ResponseStream:
+		stream.record.Reset(status)
+	case *PushStream:
+		stream.record.Reset(status)
+	}
+}
+
+// streamsChanged is called when a stream is opened or
+// closed, so that the connection is reported as active
+// while it has open streams, and idle otherwise.
+func (c *Conn) streamsChanged() {
+	c.stateLock.Lock()
+	c.streamsLock.Lock()
+	active := len(c.streams) > 0
+	c.streamsLock.Unlock()
+	state := http.StateIdle
+	if active {
+		state = http.StateActive
+	}
+	changed := c.state != state && c.state != http.StateClosed
+	if changed {
+		c.state = state
+		c.updateIdleTimer(!active)
+	}
+	c.stateLock.Unlock()
+
+	if changed {
+		c.reportState(state)
+	}
+}
+
+// updateIdleTimer starts the idle timer if idle is true,
+// and stops it otherwise. The state lock must be held.
+func (c *Conn) updateIdleTimer(idle bool) {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	if idle && c.idleTimeout != 0 && c.state != http.StateClosed {
+		c.idleTimer = time.AfterFunc(c.idleTimeout, c.closeIdle)
+	}
+}
+
+// closeIdle closes the connection if it still
+// has no open streams.
+func (c *Conn) closeIdle() {
+	c.streamsLock.Lock()
+	idle := len(c.streams) == 0
+	c.streamsLock.Unlock()
+	if idle && !c.Closed() {
+		debug.Printf("Closing idle connection to %s.\n", c.remoteAddr)
+		c.Close()
+	}
+}
+
+// setState sets the connection's state, reporting
+// it if it has changed.
+func (c *Conn) setState(state http.ConnState) {
+	c.stateLock.Lock()
+	changed := c.state != state && c.state != http.StateClosed
+	if changed {
+		c.state = state
+		if state == http.StateClosed {
+			c.updateIdleTimer(false)
+		}
+	}
+	c.stateLock.Unlock()
+
+	if changed {
+		c.reportState(state)
+	}
+}
+
+// reportState passes the state to the server's ConnState
+// hook and the connection's state hook. If the connection
+// was created by net/http, which reports StateNew and
+// StateClosed itself, those are not passed to ConnState.
+func (c *Conn) reportState(state http.ConnState) {
+	if c.server != nil && c.server.ConnState != nil {
+		if !c.nextProto || (state != http.StateNew && state != http.StateClosed) {
+			c.server.ConnState(c.netConn, state)
+		}
+	}
+
+	c.stateLock.Lock()
+	hook := c.stateHook
+	c.stateLock.Unlock()
+	if hook != nil {
+		hook(c, state)
+	}
+}
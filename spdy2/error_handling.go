@@ -31,6 +31,16 @@ func (c *Conn) criticalCheck(condition bool, sid common.StreamID, format string,
 	return true
 }
 
+// logf logs using the server's ErrorLog if
+// one is set, or the package logger otherwise.
+func (c *Conn) logf(format string, v ...interface{}) {
+	if c.server != nil && c.server.ErrorLog != nil {
+		c.server.ErrorLog.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
+
 func (c *Conn) _RST_STREAM(streamID common.StreamID, status common.StatusCode) {
 	rst := new(frames.RST_STREAM)
 	rst.StreamID = streamID
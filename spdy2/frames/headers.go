@@ -56,7 +56,7 @@ func (frame *HEADERS) Name() string {
 
 func (frame *HEADERS) ReadFrom(reader io.Reader) (int64, error) {
 	c := common.ReadCounter{R: reader}
-	data, err := common.ReadExactly(&c, 16)
+	data, err := common.ReadExactly(&c, 14)
 	if err != nil {
 		return c.N, err
 	}
@@ -75,7 +75,7 @@ func (frame *HEADERS) ReadFrom(reader io.Reader) (int64, error) {
 	}
 
 	// Read in data.
-	header, err := common.ReadExactly(&c, length-8)
+	header, err := common.ReadExactly(&c, length-6)
 	if err != nil {
 		return c.N, err
 	}
@@ -129,8 +129,8 @@ func (frame *HEADERS) WriteTo(writer io.Writer) (int64, error) {
 	}
 
 	header := frame.rawHeader
-	length := 4 + len(header)
-	out := make([]byte, 16)
+	length := 6 + len(header)
+	out := make([]byte, 14)
 
 	out[0] = 128                  // Control bit and Version
 	out[1] = 2                    // Version
@@ -144,6 +144,8 @@ func (frame *HEADERS) WriteTo(writer io.Writer) (int64, error) {
 	out[9] = frame.StreamID.B2()  // Stream ID
 	out[10] = frame.StreamID.B3() // Stream ID
 	out[11] = frame.StreamID.B4() // Stream ID
+	out[12] = 0                   // Unused
+	out[13] = 0                   // Unused
 
 	err := common.WriteExactly(&c, out)
 	if err != nil {
@@ -2,7 +2,10 @@ package spdy2
 
 import (
 	"net"
+	"net/http"
 	"time"
+
+	"github.com/SlyMarbo/spdy/common"
 )
 
 func (c *Conn) CloseNotify() <-chan bool {
@@ -10,9 +13,32 @@ func (c *Conn) CloseNotify() <-chan bool {
 }
 
 func (c *Conn) Conn() net.Conn {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
 	return c.conn
 }
 
+// State returns the connection's state. A connection
+// is new until its first stream opens, then active while
+// it has open streams, and idle otherwise, until it is
+// closed.
+func (c *Conn) State() http.ConnState {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
+}
+
+// SetStateHook sets a function to be called as the
+// connection changes state, with the same transitions
+// reported to http.Server.ConnState. This allows the
+// state of client connections, and server connections
+// used without an http.Server, to be tracked.
+func (c *Conn) SetStateHook(hook func(common.Conn, http.ConnState)) {
+	c.stateLock.Lock()
+	c.stateHook = hook
+	c.stateLock.Unlock()
+}
+
 func (c *Conn) SetReadTimeout(d time.Duration) {
 	c.timeoutLock.Lock()
 	c.readTimeout = d
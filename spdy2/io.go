@@ -2,6 +2,7 @@ package spdy2
 
 import (
 	"runtime"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy2/frames"
@@ -74,22 +75,8 @@ func (c *Conn) send() {
 	}()
 
 	// Enter the processing loop.
-	i := 1
 	for {
-
-		// Once per 5 frames, pick randomly.
-		var frame common.Frame
-		if i == 0 { // Ignore priority.
-			frame = c.selectFrameToSend(false)
-		} else { // Normal selection.
-			frame = c.selectFrameToSend(true)
-		}
-
-		i++
-		if i >= 5 {
-			i = 0
-		}
-
+		frame := c.selectFrameToSend()
 		if frame == nil {
 			c.Close()
 			return
@@ -107,66 +94,256 @@ func (c *Conn) send() {
 
 		// Leave the specifics of writing to the
 		// connection up to the frame.
+		conn := c.Conn()
+		if conn == nil {
+			return
+		}
 		c.refreshWriteTimeout()
-		_, err = frame.WriteTo(c.conn)
+		_, err = frame.WriteTo(conn)
 		if err != nil {
 			c.handleReadWriteError(err)
 			return
 		}
+
+		// Keep within the bandwidth limit.
+		if data, ok := frame.(*frames.DATA); ok {
+			c.throttle(len(data.Data))
+		}
 	}
 }
 
-// selectFrameToSend follows the specification's guidance
-// on frame priority, sending frames with higher priority
-// (a smaller number) first. If the given boolean is false,
-// this priority is temporarily ignored, which can be used
-// when high load is ignoring low-priority frames.
-func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
-	if c.Closed() {
-		return nil
+// throttle records that n bytes of data have been sent,
+// holding back further DATA frames as necessary to keep
+// within the connection's bandwidth limit. Other frames
+// are sent meanwhile.
+func (c *Conn) throttle(n int) {
+	if delay := c.bandwidth.Reserve(n); delay > 0 {
+		c.throttledUntil = time.Now().Add(delay)
 	}
+}
 
-	// Try in priority order first.
-	if prioritise {
-		for i := 0; i < 8; i++ {
-			select {
-			case frame = <-c.output[i]:
+// schedule passes a frame sent on the output channel
+// with the given priority to the Scheduler.
+func (c *Conn) schedule(frame common.Frame, priority common.Priority) {
+	if _, ok := frame.(*frames.DATA); !ok {
+		c.scheduledControl++
+	}
+	c.Scheduler.Push(scheduledFrame(frame, priority))
+}
+
+// nextScheduled returns the next frame chosen by the
+// Scheduler, or nil if no frames are waiting.
+func (c *Conn) nextScheduled() common.Frame {
+	frame := c.Scheduler.Pop()
+	if _, ok := frame.(*frames.DATA); !ok && frame != nil {
+		c.scheduledControl--
+	}
+	return frame
+}
+
+// holdFrame holds back a DATA frame while the bandwidth
+// limit is reached, along with any later frame on a stream
+// with frames held back, so that each stream's frames are
+// still sent in order. holdFrame returns whether it held
+// the frame.
+func (c *Conn) holdFrame(frame common.Frame, wait time.Duration) bool {
+	if _, ok := frame.(*frames.DATA); !ok || wait <= 0 {
+		id := scheduledFrame(frame, 0).StreamID
+		if id == 0 {
+			return false
+		}
+
+		held := false
+		for _, other := range c.heldFrames {
+			if scheduledFrame(other, 0).StreamID == id {
+				held = true
+				break
+			}
+		}
+		if !held {
+			return false
+		}
+	}
+
+	c.heldFrames = append(c.heldFrames, frame)
+	return true
+}
+
+// selectFrameToSend returns the next frame to send. The
+// frames waiting in the output channels are passed to the
+// connection's Scheduler, which chooses between them. If
+// no frames are waiting, selectFrameToSend waits for the
+// next, returning nil if the connection closes.
+//
+// A frame passes through up to two queues, which are
+// tried in turn for the next frame to send:
+//
+//   - heldFrames holds the frames the Scheduler chose while
+//     the bandwidth limit was reached: DATA, and any later
+//     frame on a stream with frames already held, so that
+//     each stream's frames stay in order. Held frames are
+//     released in order, one at a time, once the limit
+//     allows, and before the Scheduler is consulted again.
+//   - The Scheduler holds the frames taken from the output
+//     channels, in priority order. While the bandwidth limit
+//     is reached, it is only consulted while scheduledControl
+//     shows it holds a frame other than DATA, so the DATA
+//     behind that frame stays in priority order.
+//
+// Once the Scheduler and heldFrames hold maxScheduledFrames
+// frames between them, the output channels are not read,
+// except output[0], which carries the connection's own
+// control frames, such as PING, SETTINGS and GOAWAY, and is
+// read until they hold twice as many. Frames sent by streams,
+// such as RST_STREAM, wait in their stream's channel until
+// the Scheduler has room.
+func (c *Conn) selectFrameToSend() (frame common.Frame) {
+	for {
+		if c.Closed() {
+			return nil
+		}
+
+		// Try frames held back by the bandwidth limit first.
+		wait := time.Until(c.throttledUntil)
+		if wait <= 0 && len(c.heldFrames) > 0 {
+			frame = c.heldFrames[0]
+			c.heldFrames[0] = nil
+			c.heldFrames = c.heldFrames[1:]
+			return frame
+		}
+
+		// Then as chosen by the scheduler.
+		c.scheduleWaitingFrames()
+		for wait <= 0 || c.scheduledControl > 0 {
+			if frame = c.nextScheduled(); frame == nil {
+				break
+			}
+			if !c.holdFrame(frame, wait) {
 				return frame
-			default:
 			}
 		}
 
 		// No frames are immediately pending, so if the
 		// connection is being closed, cease sending
 		// safely.
-		c.sendingLock.Lock()
-		if c.sending != nil {
-			close(c.sending)
+		if c.Scheduler.Len() == 0 && len(c.heldFrames) == 0 {
+			c.sendingLock.Lock()
+			if c.sending != nil {
+				close(c.sending)
+				c.sendingLock.Unlock()
+				runtime.Goexit()
+			}
 			c.sendingLock.Unlock()
-			runtime.Goexit()
 		}
-		c.sendingLock.Unlock()
+
+		// Wait for any frame, or for the bandwidth limit to
+		// allow DATA to be sent. Once enough frames are waiting,
+		// further frames wait in their channels, except those on
+		// output[0], such as PINGs, up to a further limit.
+		output := c.output
+		if n := c.Scheduler.Len() + len(c.heldFrames); n >= maxScheduledFrames {
+			output = [8]chan common.Frame{}
+			if n < 2*maxScheduledFrames {
+				output[0] = c.output[0]
+			}
+		}
+		var timer *time.Timer
+		var throttled <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			throttled = timer.C
+		}
+		var priority common.Priority
+		received := true
+		select {
+		case frame = <-output[0]:
+		case frame = <-output[1]:
+			priority = 1
+		case frame = <-output[2]:
+			priority = 2
+		case frame = <-output[3]:
+			priority = 3
+		case frame = <-output[4]:
+			priority = 4
+		case frame = <-output[5]:
+			priority = 5
+		case frame = <-output[6]:
+			priority = 6
+		case frame = <-output[7]:
+			priority = 7
+		case <-throttled:
+			received = false
+		case _ = <-c.stop:
+			frame = nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !received {
+			continue
+		}
+		if frame == nil {
+			return nil
+		}
+
+		// DATA waits for the bandwidth limit
+		// with the Scheduler.
+		if _, ok := frame.(*frames.DATA); ok && wait > 0 {
+			c.schedule(frame, priority)
+			continue
+		}
+		if !c.holdFrame(frame, wait) {
+			return frame
+		}
 	}
+}
+
+// maxScheduledFrames limits the number of frames taken
+// from the output channels to be ordered by the Scheduler
+// or held back by the bandwidth limit. Further frames wait
+// in their channels, blocking their senders. output[0] is
+// read until twice as many are waiting, as described in
+// selectFrameToSend.
+const maxScheduledFrames = 32
+
+// scheduleWaitingFrames passes the frames waiting in the
+// output channels to the Scheduler.
+func (c *Conn) scheduleWaitingFrames() {
+	for i := range c.output {
+	drain:
+		for c.Scheduler.Len()+len(c.heldFrames) < maxScheduledFrames {
+			select {
+			case frame := <-c.output[i]:
+				if frame == nil {
+					break drain
+				}
+				c.schedule(frame, common.Priority(i))
+			default:
+				break drain
+			}
+		}
+	}
+}
 
-	// Wait for any frame.
-	select {
-	case frame = <-c.output[0]:
-		return frame
-	case frame = <-c.output[1]:
-		return frame
-	case frame = <-c.output[2]:
-		return frame
-	case frame = <-c.output[3]:
-		return frame
-	case frame = <-c.output[4]:
-		return frame
-	case frame = <-c.output[5]:
-		return frame
-	case frame = <-c.output[6]:
-		return frame
-	case frame = <-c.output[7]:
-		return frame
-	case _ = <-c.stop:
-		return nil
+// scheduledFrame gives the details of a frame
+// sent on the output channel with the given
+// priority, for use by the Scheduler.
+func scheduledFrame(frame common.Frame, priority common.Priority) common.ScheduledFrame {
+	out := common.ScheduledFrame{Frame: frame, Priority: priority, Size: 8}
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		out.StreamID = frame.StreamID
+		out.Size += len(frame.Data)
+	case *frames.SYN_STREAM:
+		out.StreamID = frame.StreamID
+	case *frames.SYN_REPLY:
+		out.StreamID = frame.StreamID
+	case *frames.RST_STREAM:
+		out.StreamID = frame.StreamID
+	case *frames.HEADERS:
+		out.StreamID = frame.StreamID
+	case *frames.WINDOW_UPDATE:
+		out.StreamID = frame.StreamID
 	}
+	return out
 }
@@ -44,6 +44,9 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 				c.initialWindowSize = setting.Value
 				c.initialWindowSizeLock.Unlock()
 
+			case common.SETTINGS_DOWNLOAD_BANDWIDTH:
+				c.updateBandwidth()
+
 			case common.SETTINGS_MAX_CONCURRENT_STREAMS:
 				if c.server == nil {
 					c.requestStreamLimit.SetLimit(setting.Value)
@@ -78,15 +81,24 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 
 	case *frames.GOAWAY:
 		lastProcessed := frame.LastGoodStreamID
+		var unprocessed []common.Stream
 		c.streamsLock.Lock()
 		for streamID, stream := range c.streams {
 			if streamID&1 == c.oddity && streamID > lastProcessed {
 				// Stream is locally-sent and has not been processed.
-				// TODO: Inform the server that the push has not been successful.
-				stream.Close()
+				unprocessed = append(unprocessed, stream)
 			}
 		}
 		c.streamsLock.Unlock()
+		for _, stream := range unprocessed {
+			c.recordGoaway(stream)
+			if push, ok := stream.(*PushStream); ok {
+				// Writes to the push will return ErrGoaway.
+				push.reset(common.ErrGoaway)
+			} else {
+				stream.Close()
+			}
+		}
 		c.goawayLock.Lock()
 		c.goawayReceived = true
 		c.goawayLock.Unlock()
@@ -148,8 +160,12 @@ func (c *Conn) handleHeaders(frame *frames.HEADERS) {
 	// Handle push headers.
 	if sid&1 == 0 && c.server == nil {
 		// Ignore refused push headers.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
+		if req := c.pushRequest(sid); req != nil && c.PushReceiver != nil {
 			c.PushReceiver.ReceiveHeader(req, frame.Header)
+			if frame.Flags.FIN() {
+				c.PushReceiver.ReceiveData(req, []byte{}, true)
+				c.finishPush(sid)
+			}
 		}
 		return
 	}
@@ -246,18 +262,57 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 	}
 
 	// Check whether the receiver wants this resource.
-	if c.PushReceiver != nil && !c.PushReceiver.ReceiveRequest(request) {
+	if c.PushReceiver == nil || !c.PushReceiver.ReceiveRequest(request) {
+		c.pushStreamLimit.Close()
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
 		return
 	}
 
-	// Create and start new stream.
-	if c.PushReceiver != nil {
-		c.pushRequests[sid] = request
-		c.lastPushStreamIDLock.Lock()
-		c.lastPushStreamID = sid
-		c.lastPushStreamIDLock.Unlock()
-		c.PushReceiver.ReceiveHeader(request, frame.Header)
+	c.pushRequestsLock.Lock()
+	c.pushRequests[sid] = request
+	c.pushRequestsLock.Unlock()
+	c.lastPushStreamIDLock.Lock()
+	c.lastPushStreamID = sid
+	c.lastPushStreamIDLock.Unlock()
+	c.PushReceiver.ReceiveHeader(request, frame.Header)
+
+	if frame.Flags.FIN() {
+		c.PushReceiver.ReceiveData(request, []byte{}, true)
+		c.finishPush(sid)
+	}
+}
+
+// pushRequest returns the request sent with
+// the given server push, or nil if the push
+// was refused or has finished.
+func (c *Conn) pushRequest(sid common.StreamID) *http.Request {
+	c.pushRequestsLock.Lock()
+	defer c.pushRequestsLock.Unlock()
+	return c.pushRequests[sid]
+}
+
+// finishPush cleans up once a server push
+// has been completed, returning its request.
+func (c *Conn) finishPush(sid common.StreamID) *http.Request {
+	c.pushRequestsLock.Lock()
+	req, ok := c.pushRequests[sid]
+	delete(c.pushRequests, sid)
+	c.pushRequestsLock.Unlock()
+	if ok {
+		c.pushStreamLimit.Close()
+	}
+	return req
+}
+
+// abortPush cleans up a server push which
+// has ended before being completed.
+func (c *Conn) abortPush(sid common.StreamID) {
+	req := c.finishPush(sid)
+	if req == nil {
+		return
+	}
+	if r, ok := c.PushReceiver.(common.AbortReceiver); ok {
+		r.ReceiveAbort(req)
 	}
 }
 
@@ -320,6 +375,7 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 	c.streamsLock.Lock()
 	c.streams[sid] = nextStream
 	c.streamsLock.Unlock()
+	c.streamsChanged()
 	c.lastRequestStreamIDLock.Lock()
 	c.lastRequestStreamID = sid
 	c.lastRequestStreamIDLock.Unlock()
@@ -331,9 +387,16 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 // handleRstStream performs the processing of RST_STREAM frames.
 func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 	sid := frame.StreamID
+
+	// Handle reset pushes.
+	if sid&1 == 0 && c.server == nil {
+		c.abortPush(sid)
+	}
+
 	c.streamsLock.Lock()
 	stream := c.streams[sid]
 	c.streamsLock.Unlock()
+	recordReset(stream, frame.Status)
 
 	// Determine the status code and react accordingly.
 	switch frame.Status {
@@ -353,8 +416,15 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 			return
 		}
 		fallthrough
-	case common.RST_STREAM_REFUSED_STREAM:
-		if stream != nil {
+	case common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_INTERNAL_ERROR:
+		if push, ok := stream.(*PushStream); ok && frame.Status != common.RST_STREAM_INTERNAL_ERROR {
+			// The client has refused or cancelled the push.
+			push.reset(common.ErrPushRefused)
+		} else if req, ok := stream.(*RequestStream); ok && frame.Status == common.RST_STREAM_REFUSED_STREAM {
+			// The server has refused the request.
+			req.refuse()
+		} else if stream != nil {
 			go stream.Close()
 		}
 
@@ -370,8 +440,11 @@ func (c *Conn) handleServerData(frame *frames.DATA) {
 	// Handle push data.
 	if sid&1 == 0 {
 		// Ignore refused push data.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
+		if req := c.pushRequest(sid); req != nil && c.PushReceiver != nil {
 			c.PushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
+			if frame.Flags.FIN() {
+				c.finishPush(sid)
+			}
 		}
 		return
 	}
@@ -8,6 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -22,11 +25,18 @@ type PushStream struct {
 	shutdownOnce sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	priority     common.Priority
 	origin       common.Stream
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
 	stop         <-chan bool
+	closeNotify  chan bool               // closed when the push is closed or reset.
+	err          error                   // reason the push was ended by the client.
+	record       *common.AccessLogRecord // details of the push for the access log.
+	wroteHeader  bool
+	transferred  common.Transferred
+	bandwidth    *common.RateLimiter // limit on data sent on the stream.
 }
 
 func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, output chan<- common.Frame) *PushStream {
@@ -36,6 +46,8 @@ func NewPushStream(conn *Conn, streamID common.StreamID, origin common.Stream, o
 	out.origin = origin
 	out.output = output
 	out.stop = conn.stop
+	out.bandwidth = common.NewRateLimiter(conn.StreamBandwidth)
+	out.closeNotify = make(chan bool)
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
 	return out
@@ -51,15 +63,21 @@ func (p *PushStream) Header() http.Header {
 
 // Write is used for sending data in the push.
 func (p *PushStream) Write(inputData []byte) (int, error) {
+	if err := p.resetError(); err != nil {
+		return 0, err
+	}
+
 	if p.closed() || p.state.ClosedHere() {
 		return 0, errors.New("Error: Stream already closed.")
 	}
 
-	state := p.origin.State()
-	if p.origin == nil || state.ClosedHere() {
+	if p.origin == nil || p.origin.State().ClosedHere() {
 		return 0, errors.New("Error: Origin stream is closed.")
 	}
 
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
 	p.writeHeader()
 
 	// Copy the data locally to avoid any pointer issues.
@@ -68,33 +86,63 @@ func (p *PushStream) Write(inputData []byte) (int, error) {
 
 	// Chunk the response if necessary.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
+	max := p.conn.maxDataSize()
+	for len(data) > max {
+		if !throttle(p.bandwidth, max, p.stop) {
+			p.record.BytesOut(written)
+			return written, errors.New("Error: Stream closed.")
+		}
+
 		dataFrame := new(frames.DATA)
 		dataFrame.StreamID = p.streamID
-		dataFrame.Data = data[:common.MAX_DATA_SIZE]
+		dataFrame.Data = data[:max]
 		p.output <- dataFrame
+		p.transferred.Sent(max)
 
-		written += common.MAX_DATA_SIZE
+		data = data[max:]
+		written += max
 	}
 
 	n := len(data)
 	if n == 0 {
+		p.record.BytesOut(written)
 		return written, nil
 	}
 
+	if !throttle(p.bandwidth, n, p.stop) {
+		p.record.BytesOut(written)
+		return written, errors.New("Error: Stream closed.")
+	}
+
 	dataFrame := new(frames.DATA)
 	dataFrame.StreamID = p.streamID
 	dataFrame.Data = data
 	p.output <- dataFrame
+	p.transferred.Sent(n)
 
+	p.record.BytesOut(written + n)
 	return written + n, nil
 }
 
-// WriteHeader is provided to satisfy the Stream
-// interface, but has no effect.
-func (p *PushStream) WriteHeader(int) {
+// WriteHeader sets the status of the pushed response,
+// unless it has already been set in the headers. Only
+// the first call sets the status.
+func (p *PushStream) WriteHeader(code int) {
+	if p.closed() || p.header == nil {
+		return
+	}
+	if !p.wroteHeader {
+		p.wroteHeader = true
+		if p.header.Get("status") == "" {
+			p.header.Set("status", strconv.Itoa(code))
+			p.header.Set("version", "HTTP/1.1")
+		}
+		status := strings.SplitN(p.header.Get("status"), " ", 2)[0]
+		if code, err := strconv.Atoi(status); err == nil {
+			p.record.Status(code)
+		}
+	}
 	p.writeHeader()
-	return
 }
 
 /*****************
@@ -115,10 +163,14 @@ func (p *PushStream) shutdown() {
 		p.state.Close()
 	}
 	p.conn.pushStreamLimit.Close()
-	p.origin = nil
-	p.output = nil
-	p.header = nil
-	p.stop = nil
+
+	p.conn.streamsLock.Lock()
+	delete(p.conn.streams, p.streamID)
+	p.conn.streamsLock.Unlock()
+	p.conn.streamsChanged()
+
+	close(p.closeNotify)
+	p.record.Finish()
 }
 
 /**********
@@ -149,8 +201,11 @@ func (p *PushStream) ReceiveFrame(frame common.Frame) error {
 	return nil
 }
 
+// CloseNotify returns a channel which is closed when
+// the push is closed, such as when it is refused or
+// cancelled by the client, or the connection ends.
 func (p *PushStream) CloseNotify() <-chan bool {
-	return p.stop
+	return p.closeNotify
 }
 
 func (p *PushStream) Run() error {
@@ -165,11 +220,36 @@ func (p *PushStream) StreamID() common.StreamID {
 	return p.streamID
 }
 
+// SetBandwidth limits the data sent on the stream to
+// rate bytes per second. A rate of zero means no limit,
+// other than any limit on the connection.
+func (p *PushStream) SetBandwidth(rate int64) {
+	p.bandwidth.SetRate(rate)
+}
+
+// Stats returns a description of the stream. SPDY/2
+// has no flow control, so the transfer windows are
+// always zero.
+func (p *PushStream) Stats() common.StreamStats {
+	sent, received := p.transferred.Counts()
+	return common.StreamStats{
+		StreamID:      p.streamID,
+		State:         p.state.Status(),
+		Priority:      p.priority,
+		BytesSent:     sent,
+		BytesReceived: received,
+	}
+}
+
 /**************
  * PushStream *
  **************/
 
 func (p *PushStream) Finish() {
+	if p.closed() || p.state.ClosedHere() {
+		p.Close()
+		return
+	}
 	p.writeHeader()
 	end := new(frames.DATA)
 	end.StreamID = p.streamID
@@ -179,12 +259,61 @@ func (p *PushStream) Finish() {
 	p.Close()
 }
 
+// serve produces the pushed response by calling the
+// handler with the given request, then finishes the
+// push. If the handler panics, the push is reset.
+func (p *PushStream) serve(handler http.Handler, request *http.Request) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if v != http.ErrAbortHandler {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			p.conn.logf("spdy: panic serving push stream %d for %s: %v\n%s", p.streamID, p.conn.remoteAddr, v, buf)
+		}
+		if !p.closed() && p.state.OpenHere() {
+			rst := new(frames.RST_STREAM)
+			rst.StreamID = p.streamID
+			rst.Status = common.RST_STREAM_INTERNAL_ERROR
+			p.record.Reset(rst.Status)
+			p.output <- rst
+		}
+		p.Close()
+	}()
+
+	handler.ServeHTTP(p, request)
+	p.Finish()
+}
+
+// reset is called when the client ends the push early,
+// such as by refusing or cancelling it. Any later writes
+// return err, and the push's slot in the stream limit is
+// released immediately.
+func (p *PushStream) reset(err error) {
+	p.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.Unlock()
+	p.state.Close()
+	p.Close()
+}
+
+// resetError returns the error given to reset, if any.
+func (p *PushStream) resetError() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.err
+}
+
 /**********
  * Others *
  **********/
 
 func (p *PushStream) closed() bool {
-	if p.conn == nil || p.state == nil {
+	if p.conn == nil || p.state == nil || p.state.Closed() {
 		return true
 	}
 	select {
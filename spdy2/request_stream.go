@@ -26,6 +26,7 @@ type RequestStream struct {
 	shutdownOnce sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	priority     common.Priority
 	state        *common.StreamState
 	output       chan<- common.Frame
 	header       http.Header
@@ -33,6 +34,10 @@ type RequestStream struct {
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
+	processed    chan struct{} // closed once received frames have been processed.
+	refused      bool          // whether the server refused the stream.
+	transferred  common.Transferred
+	bandwidth    *common.RateLimiter // limit on data sent on the stream.
 }
 
 func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common.Frame) *RequestStream {
@@ -41,10 +46,12 @@ func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common
 	out.streamID = streamID
 	out.output = output
 	out.stop = conn.stop
+	out.bandwidth = common.NewRateLimiter(conn.StreamBandwidth)
 	out.state = new(common.StreamState)
 	out.state.CloseHere()
 	out.header = make(http.Header)
 	out.finished = make(chan struct{})
+	out.processed = make(chan struct{})
 	out.headerChan = make(chan func(), 5)
 	go out.processFrames()
 	return out
@@ -73,13 +80,20 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 
 	// Chunk the response if necessary.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
+	max := s.conn.maxDataSize()
+	for len(data) > max {
+		if !throttle(s.bandwidth, max, s.stop) {
+			return written, errors.New("Error: Stream closed.")
+		}
+
 		dataFrame := new(frames.DATA)
 		dataFrame.StreamID = s.streamID
-		dataFrame.Data = data[:common.MAX_DATA_SIZE]
+		dataFrame.Data = data[:max]
 		s.output <- dataFrame
+		s.transferred.Sent(max)
 
-		written += common.MAX_DATA_SIZE
+		data = data[max:]
+		written += max
 	}
 
 	n := len(data)
@@ -87,10 +101,15 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 		return written, nil
 	}
 
+	if !throttle(s.bandwidth, n, s.stop) {
+		return written, errors.New("Error: Stream closed.")
+	}
+
 	dataFrame := new(frames.DATA)
 	dataFrame.StreamID = s.streamID
 	dataFrame.Data = data
 	s.output <- dataFrame
+	s.transferred.Sent(n)
 
 	return written + n, nil
 }
@@ -131,21 +150,18 @@ func (s *RequestStream) shutdown() {
 	default:
 		close(s.finished)
 	}
-	select {
-	case <-s.headerChan:
-	default:
-		close(s.headerChan)
-	}
+	s.recvMutex.Lock()
+	close(s.headerChan)
+	s.recvMutex.Unlock()
 	s.conn.requestStreamLimit.Close()
 	s.output = nil
-	s.Request = nil
-	s.Receiver = nil
 	s.header = nil
 	s.stop = nil
 
 	s.conn.streamsLock.Lock()
 	delete(s.conn.streams, s.streamID)
 	s.conn.streamsLock.Unlock()
+	s.conn.streamsChanged()
 }
 
 /**********
@@ -164,6 +180,12 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		return errors.New("Nil frame received.")
 	}
 
+	select {
+	case <-s.finished:
+		return errors.New("Error: Stream already closed.")
+	default:
+	}
+
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
@@ -173,36 +195,37 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		if data == nil {
 			data = []byte{}
 		}
+		s.transferred.Received(len(data))
 
 		// Give to the client.
-		s.headerChan <- func() {
+		s.queue(func() {
 			s.Receiver.ReceiveData(s.Request, data, frame.Flags.FIN())
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
 				s.Close()
 			}
-		}
+		})
 
 	case *frames.SYN_REPLY:
-		s.headerChan <- func() {
+		s.queue(func() {
 			s.Receiver.ReceiveHeader(s.Request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
 				s.Close()
 			}
-		}
+		})
 
 	case *frames.HEADERS:
-		s.headerChan <- func() {
+		s.queue(func() {
 			s.Receiver.ReceiveHeader(s.Request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
 				s.Close()
 			}
-		}
+		})
 
 	case *frames.WINDOW_UPDATE:
 		// Ignore.
@@ -225,12 +248,29 @@ func (s *RequestStream) CloseNotify() <-chan bool {
 func (s *RequestStream) Run() error {
 	// Receive and process inbound frames.
 	<-s.finished
+	<-s.processed
+
+	s.Lock()
+	refused := s.refused
+	s.Unlock()
+	if refused {
+		return common.ErrStreamRefused
+	}
 
 	// Clean up state.
 	s.state.CloseHere()
 	return nil
 }
 
+// refuse closes the stream after the server
+// has refused it with REFUSED_STREAM.
+func (s *RequestStream) refuse() {
+	s.Lock()
+	s.refused = true
+	s.Unlock()
+	go s.Close()
+}
+
 func (s *RequestStream) State() *common.StreamState {
 	return s.state
 }
@@ -239,6 +279,27 @@ func (s *RequestStream) StreamID() common.StreamID {
 	return s.streamID
 }
 
+// SetBandwidth limits the data sent on the stream to
+// rate bytes per second. A rate of zero means no limit,
+// other than any limit on the connection.
+func (s *RequestStream) SetBandwidth(rate int64) {
+	s.bandwidth.SetRate(rate)
+}
+
+// Stats returns a description of the stream. SPDY/2
+// has no flow control, so the transfer windows are
+// always zero.
+func (s *RequestStream) Stats() common.StreamStats {
+	sent, received := s.transferred.Counts()
+	return common.StreamStats{
+		StreamID:      s.streamID,
+		State:         s.state.Status(),
+		Priority:      s.priority,
+		BytesSent:     sent,
+		BytesReceived: received,
+	}
+}
+
 func (s *RequestStream) closed() bool {
 	if s.conn == nil || s.state == nil || s.Receiver == nil {
 		return true
@@ -270,8 +331,18 @@ func (s *RequestStream) writeHeader() {
 	s.output <- header
 }
 
+// queue is used to pass received frames to the
+// processing goroutine, unless the stream closes.
+func (s *RequestStream) queue(f func()) {
+	select {
+	case s.headerChan <- f:
+	case <-s.finished:
+	}
+}
+
 func (s *RequestStream) processFrames() {
 	defer common.Recover()
+	defer close(s.processed)
 	for f := range s.headerChan {
 		f()
 	}
@@ -70,7 +70,11 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 	// Prepare the request body, if any.
 	body := make([]*frames.DATA, 0, 1)
 	if request.Body != nil {
-		buf := make([]byte, 32*1024)
+		size := 32 * 1024
+		if max := c.maxDataSize(); max < size {
+			size = max
+		}
+		buf := make([]byte, size)
 		n, err := request.Body.Read(buf)
 		if err != nil && err != io.EOF {
 			return nil, err
@@ -100,6 +104,28 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 		syn.Flags = common.FLAG_FIN
 	}
 
+	// Prepare the request trailers, if any,
+	// which close the stream instead.
+	var trailer *frames.HEADERS
+	for name, values := range request.Trailer {
+		if len(values) == 0 {
+			continue
+		}
+		if trailer == nil {
+			trailer = new(frames.HEADERS)
+			trailer.Flags = common.FLAG_FIN
+			trailer.Header = make(http.Header)
+		}
+		trailer.Header[name] = values
+	}
+	if trailer != nil {
+		common.DeclareTrailer(syn.Header, trailer.Header)
+		syn.Flags &^= common.FLAG_FIN
+		if len(body) > 0 {
+			body[len(body)-1].Flags &^= common.FLAG_FIN
+		}
+	}
+
 	// Send.
 	c.streamCreation.Lock()
 	defer c.streamCreation.Unlock()
@@ -116,20 +142,29 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 		return nil, errors.New("Error: All client streams exhausted.")
 	}
 	c.output[0] <- syn
+	sent := 0
 	for _, frame := range body {
 		frame.StreamID = syn.StreamID
 		c.output[0] <- frame
+		sent += len(frame.Data)
+	}
+	if trailer != nil {
+		trailer.StreamID = syn.StreamID
+		c.output[0] <- trailer
 	}
 
 	// // Create the request stream.
 	out := NewRequestStream(c, syn.StreamID, c.output[0])
 	out.Request = request
 	out.Receiver = receiver
+	out.priority = priority
+	out.transferred.Sent(sent)
 
 	// Store in the connection map.
 	c.streamsLock.Lock()
 	c.streams[syn.StreamID] = out
 	c.streamsLock.Unlock()
+	c.streamsChanged()
 
 	return out, nil
 }
@@ -144,7 +179,9 @@ func (c *Conn) RequestResponse(request *http.Request, receiver common.Receiver,
 	}
 
 	// Let the request run its course.
-	stream.Run()
+	if err := stream.Run(); err == common.ErrStreamRefused {
+		return nil, err
+	}
 
 	return res.Response(), c.shutdownError
 }
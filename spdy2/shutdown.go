@@ -1,6 +1,8 @@
 package spdy2
 
 import (
+	"context"
+	"net/http"
 	"time"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -25,6 +27,59 @@ func (c *Conn) Closed() bool {
 	}
 }
 
+// shutdownPollInterval is how often Shutdown
+// checks for active streams.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully closes the connection. A GOAWAY is
+// sent, so that no new streams are accepted, then Shutdown
+// waits for the active streams to finish before closing the
+// connection. If the context expires first, the connection
+// is closed immediately and the context's error returned.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	c.goawayLock.Lock()
+	sent := c.goawaySent
+	c.goawaySent = true
+	c.goawayLock.Unlock()
+	if !sent && !c.Closed() {
+		goaway := new(frames.GOAWAY)
+		if c.server != nil {
+			c.lastRequestStreamIDLock.Lock()
+			goaway.LastGoodStreamID = c.lastRequestStreamID
+			c.lastRequestStreamIDLock.Unlock()
+		} else {
+			c.lastPushStreamIDLock.Lock()
+			goaway.LastGoodStreamID = c.lastPushStreamID
+			c.lastPushStreamIDLock.Unlock()
+		}
+		select {
+		case c.output[0] <- goaway:
+		case <-c.stop:
+		case <-ctx.Done():
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		c.streamsLock.Lock()
+		active := len(c.streams)
+		c.streamsLock.Unlock()
+		if active == 0 {
+			return c.Close()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return nil
+		case <-ctx.Done():
+			c.Close()
+			return ctx.Err()
+		}
+	}
+}
+
 func (c *Conn) shutdown() {
 	if c.Closed() {
 		return
@@ -68,7 +123,20 @@ func (c *Conn) shutdown() {
 	}
 	c.streamsLock.Unlock()
 
+	// Abort any unfinished server pushes.
+	var pushes []common.StreamID
+	c.pushRequestsLock.Lock()
+	for sid := range c.pushRequests {
+		pushes = append(pushes, sid)
+	}
+	c.pushRequestsLock.Unlock()
+
+	for _, sid := range pushes {
+		c.abortPush(sid)
+	}
+
 	for _, stream := range streams {
+		c.recordGoaway(stream)
 		if err := stream.Close(); err != nil {
 			debug.Println(err)
 		}
@@ -108,7 +176,9 @@ func (c *Conn) shutdown() {
 		compressor.Close()
 	}
 
+	c.pushedResourcesLock.Lock()
 	c.pushedResources = nil
+	c.pushedResourcesLock.Unlock()
 
 	for _, stream := range c.output {
 		select {
@@ -120,4 +190,6 @@ func (c *Conn) shutdown() {
 			close(stream)
 		}
 	}
+
+	c.setState(http.StateClosed)
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/SlyMarbo/spdy/common"
@@ -43,6 +44,17 @@ func (c *Conn) Ping() (<-chan bool, error) {
 // Push is used to issue a server push to the client. Note that this cannot be performed
 // by clients.
 func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, error) {
+	push, err := c.push(resource, origin, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return push, nil
+}
+
+// push is used to create a push stream. If method is
+// non-empty, it and header are sent to the client to
+// describe the request being pushed.
+func (c *Conn) push(resource string, origin common.Stream, method string, header http.Header) (*PushStream, error) {
 	c.goawayLock.Lock()
 	goaway := c.goawayReceived || c.goawaySent
 	c.goawayLock.Unlock()
@@ -65,15 +77,22 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 	resource = url.String()
 
 	// Ensure the resource hasn't been pushed on the given stream already.
+	c.pushedResourcesLock.Lock()
+	if c.pushedResources == nil {
+		c.pushedResourcesLock.Unlock()
+		return nil, common.ErrConnClosed
+	}
 	if c.pushedResources[origin] == nil {
 		c.pushedResources[origin] = map[string]struct{}{
 			resource: struct{}{},
 		}
-	} else if _, ok := c.pushedResources[origin][url.String()]; !ok {
+	} else if _, ok := c.pushedResources[origin][resource]; !ok {
 		c.pushedResources[origin][resource] = struct{}{}
 	} else {
+		c.pushedResourcesLock.Unlock()
 		return nil, errors.New("Error: Resource already pushed to this stream.")
 	}
+	c.pushedResourcesLock.Unlock()
 
 	// Check stream limit would allow the new stream.
 	if !c.pushStreamLimit.Add() {
@@ -92,6 +111,12 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 	push.AssocStreamID = origin.StreamID()
 	push.Priority = 3
 	push.Header = make(http.Header)
+	for name, values := range header {
+		push.Header[name] = values
+	}
+	if method != "" {
+		push.Header.Set("method", method)
+	}
 	push.Header.Set("scheme", url.Scheme)
 	push.Header.Set("host", url.Host)
 	push.Header.Set("url", path)
@@ -113,11 +138,103 @@ func (c *Conn) Push(resource string, origin common.Stream) (common.PushStream, e
 
 	// Create the PushStream.
 	out := NewPushStream(c, newID, origin, c.output[3])
+	out.priority = push.Priority
+	if method == "" {
+		method = "GET"
+	}
+	out.record = c.accessLogRecord(common.AccessLogEntry{
+		Method:   method,
+		Host:     url.Host,
+		Path:     url.RequestURI(),
+		Proto:    "HTTP/1.1",
+		StreamID: newID,
+		Priority: push.Priority,
+		Pushed:   true,
+	})
 
 	// Store in the connection map.
 	c.streamsLock.Lock()
 	c.streams[newID] = out
 	c.streamsLock.Unlock()
+	c.streamsChanged()
 
 	return out, nil
 }
+
+// preload records that the given resource is being pushed
+// because of a preload link. If it has already been pushed
+// on the connection, preload returns false. If the push
+// then fails, preloadFailed must be called, so that the
+// resource can be pushed by a later response.
+func (c *Conn) preload(resource string) bool {
+	c.preloadedLock.Lock()
+	defer c.preloadedLock.Unlock()
+	if c.preloaded == nil {
+		c.preloaded = make(map[string]struct{})
+	}
+	if _, ok := c.preloaded[resource]; ok {
+		return false
+	}
+	c.preloaded[resource] = struct{}{}
+	return true
+}
+
+// preloadFailed removes the record of a resource
+// from preload, after its push has failed.
+func (c *Conn) preloadFailed(resource string) {
+	c.preloadedLock.Lock()
+	delete(c.preloaded, resource)
+	c.preloadedLock.Unlock()
+}
+
+// Stats returns a description of the connection and
+// its active streams. SPDY/2 has no flow control, so
+// the transfer windows are always zero.
+func (c *Conn) Stats() common.ConnStats {
+	stats := common.ConnStats{Version: 2}
+
+	// Copy the streams, so their locks are
+	// not taken with streamsLock held.
+	c.streamsLock.Lock()
+	streams := make([]common.Stream, 0, len(c.streams))
+	for _, stream := range c.streams {
+		streams = append(streams, stream)
+	}
+	c.streamsLock.Unlock()
+
+	for _, stream := range streams {
+		switch stream := stream.(type) {
+		case *ResponseStream:
+			stats.Streams = append(stats.Streams, stream.Stats())
+		case *RequestStream:
+			stats.Streams = append(stats.Streams, stream.Stats())
+		case *PushStream:
+			stats.Streams = append(stats.Streams, stream.Stats())
+		}
+	}
+	sort.Slice(stats.Streams, func(i, j int) bool {
+		return stats.Streams[i].StreamID < stats.Streams[j].StreamID
+	})
+
+	return stats
+}
+
+// streamLimit returns the maximum number of streams the
+// client may open, as advertised in MAX_CONCURRENT_STREAMS.
+// If streams over the handler limits are refused, the
+// limit is no more than the number of handlers permitted.
+func (c *Conn) streamLimit() uint32 {
+	limit := c.MaxConcurrentStreams
+	if limit == 0 {
+		limit = common.DEFAULT_STREAM_LIMIT
+	}
+	if !c.RefuseStreams {
+		return limit
+	}
+	for _, n := range []int{c.MaxHandlers, c.Handlers.Limit()} {
+		if n > 0 && uint32(n) < limit {
+			limit = uint32(n)
+		}
+	}
+	return limit
+}
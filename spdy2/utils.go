@@ -5,9 +5,30 @@
 package spdy2
 
 import (
+	"time"
+
 	"github.com/SlyMarbo/spdy/common"
 )
 
+// throttle waits before n bytes of data are sent on a
+// stream, to keep within the stream's bandwidth limit.
+// throttle returns false if stop is closed first.
+func throttle(bandwidth *common.RateLimiter, n int, stop <-chan bool) bool {
+	delay := bandwidth.Reserve(n)
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case _ = <-stop:
+		return false
+	}
+}
+
 // defaultServerSettings are used in initialising the connection.
 // It takes the max concurrent streams.
 func defaultServerSettings(m uint32) common.Settings {
@@ -0,0 +1,162 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SlyMarbo/spdy/common"
+)
+
+// autoRTTInterval is how often AutoFlowControl
+// measures the round-trip time while data is
+// being received.
+const autoRTTInterval = time.Second
+
+// AutoFlowControl is a FlowControl which grows transfer
+// windows to match the bandwidth-delay product of the
+// connection. DefaultFlowControl keeps each window at its
+// initial size, so at most one window of data can be in
+// flight per round trip, which limits throughput on links
+// with high latency.
+//
+// AutoFlowControl measures the round-trip time using PINGs,
+// and the rate at which each window is used. When more than
+// half of a window's worth of data is received in a round
+// trip, the window is doubled, up to a ceiling. Windows are
+// never shrunk. This applies to each stream and, in SPDY/3.1
+// and later, the connection-level window.
+type AutoFlowControl struct {
+	sync.Mutex
+	initial  uint32
+	max      int64
+	rtt      time.Duration                   // smoothed round-trip time.
+	measured time.Time                       // when the last measurement was started.
+	windows  map[common.StreamID]*autoWindow // state for each window, by stream ID.
+}
+
+// autoWindow records the use of a single transfer window.
+type autoWindow struct {
+	size     int64     // size to which the window is regrown.
+	last     int64     // window size after the last update.
+	start    time.Time // start of the current measurement.
+	received int64     // data received since start.
+}
+
+// NewAutoFlowControl returns an AutoFlowControl, whose
+// windows start at the initial size and grow no larger
+// than max. An initial size of zero means
+// common.DEFAULT_INITIAL_WINDOW_SIZE, and a max of zero
+// means common.DEFAULT_MAX_ADAPTIVE_WINDOW_SIZE.
+func NewAutoFlowControl(initial, max uint32) *AutoFlowControl {
+	if initial == 0 {
+		initial = common.DEFAULT_INITIAL_WINDOW_SIZE
+	}
+	if max == 0 {
+		max = common.DEFAULT_MAX_ADAPTIVE_WINDOW_SIZE
+	}
+	if max > common.MAX_DELTA_WINDOW_SIZE {
+		max = common.MAX_DELTA_WINDOW_SIZE
+	}
+	if max < initial {
+		max = initial
+	}
+
+	return &AutoFlowControl{
+		initial: initial,
+		max:     int64(max),
+		windows: make(map[common.StreamID]*autoWindow),
+	}
+}
+
+func (f *AutoFlowControl) InitialWindowSize() uint32 {
+	return f.initial
+}
+
+func (f *AutoFlowControl) ReceiveData(streamID common.StreamID, initialWindowSize uint32, newWindowSize int64) uint32 {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	w := f.windows[streamID]
+	if w == nil {
+		w = &autoWindow{
+			size:  int64(initialWindowSize),
+			last:  int64(initialWindowSize),
+			start: now,
+		}
+		f.windows[streamID] = w
+	}
+
+	if newWindowSize < w.last {
+		w.received += w.last - newWindowSize
+	}
+	w.last = newWindowSize
+
+	// Once a round trip has passed, estimate the
+	// bandwidth-delay product from the data received.
+	if elapsed := now.Sub(w.start); f.rtt > 0 && elapsed >= f.rtt {
+		bdp := w.received * int64(f.rtt) / int64(elapsed)
+		if 2*bdp > w.size && w.size < f.max {
+			w.size *= 2
+			if w.size > f.max {
+				w.size = f.max
+			}
+			debug.Printf("Flow: Growing window for stream %d to %d bytes.\n", streamID, w.size)
+		}
+		w.start = now
+		w.received = 0
+	}
+
+	// Regrow the window if it's half-empty.
+	if newWindowSize < w.size/2 {
+		w.last = w.size
+		return uint32(w.size - newWindowSize)
+	}
+
+	return 0
+}
+
+// MeasureRTT returns true if the round-trip time has
+// not been measured recently.
+func (f *AutoFlowControl) MeasureRTT() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.measured) < autoRTTInterval {
+		return false
+	}
+	f.measured = now
+	return true
+}
+
+// ReceiveRTT adds a measurement of the round-trip time.
+func (f *AutoFlowControl) ReceiveRTT(rtt time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.rtt == 0 {
+		f.rtt = rtt
+	} else {
+		f.rtt = (7*f.rtt + rtt) / 8
+	}
+}
+
+// StreamClosed releases the state kept for a stream.
+func (f *AutoFlowControl) StreamClosed(streamID common.StreamID) {
+	f.Lock()
+	delete(f.windows, streamID)
+	f.Unlock()
+}
+
+// RTT returns the smoothed round-trip time, or
+// zero if it has not yet been measured.
+func (f *AutoFlowControl) RTT() time.Duration {
+	f.Lock()
+	defer f.Unlock()
+	return f.rtt
+}
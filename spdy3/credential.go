@@ -0,0 +1,255 @@
+// Copyright 2014 Jamie Hall. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package spdy3
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/SlyMarbo/spdy/spdy3/frames"
+)
+
+// credentialProofLabel is the label given to the TLS
+// keying material exporter to produce the data signed
+// in a CREDENTIAL's proof.
+const credentialProofLabel = "EXPORTER SPDY certificate proof"
+
+// credentialProofLength is the number of bytes of
+// keying material signed in a CREDENTIAL's proof.
+const credentialProofLength = 32
+
+// credentialProofInput returns the data which is signed
+// to prove possession of a certificate's private key on
+// the given TLS connection.
+func credentialProofInput(state *tls.ConnectionState) ([]byte, error) {
+	if state == nil {
+		return nil, errors.New("Error: CREDENTIAL proofs require TLS.")
+	}
+	return state.ExportKeyingMaterial(credentialProofLabel, nil, credentialProofLength)
+}
+
+// verifyProof checks that proof is a signature of input
+// by the private key matching pub. ECDSA and RSA proofs
+// sign the SHA-256 hash of the input, using ASN.1 and
+// PKCS #1 v1.5 respectively. Ed25519 proofs sign the
+// input directly.
+func verifyProof(pub crypto.PublicKey, input, proof []byte) error {
+	hash := sha256.Sum256(input)
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, hash[:], proof) {
+			return errors.New("Error: Invalid CREDENTIAL proof.")
+		}
+		return nil
+
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], proof); err != nil {
+			return errors.New("Error: Invalid CREDENTIAL proof.")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, input, proof) {
+			return errors.New("Error: Invalid CREDENTIAL proof.")
+		}
+		return nil
+
+	default:
+		return errors.New("Error: Unsupported CREDENTIAL public key type.")
+	}
+}
+
+// signProof signs input with the given private key,
+// producing a proof which verifyProof accepts.
+func signProof(key crypto.PrivateKey, input []byte) ([]byte, error) {
+	hash := sha256.Sum256(input)
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, key, hash[:])
+
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, input), nil
+
+	default:
+		return nil, errors.New("Error: Unsupported CREDENTIAL private key type.")
+	}
+}
+
+// verifyCredential checks a CREDENTIAL received from
+// the client. The proof must be signed by the first
+// certificate's key, using keying material from this
+// connection. If the server verifies the certificates
+// given in the TLS handshake, the certificates are
+// verified in the same way.
+func (c *Conn) verifyCredential(frame *frames.CREDENTIAL) error {
+	if frame.Slot == 0 {
+		return errors.New("Error: CREDENTIAL sent with slot 0.")
+	}
+	if len(frame.Certificates) == 0 {
+		return errors.New("Error: CREDENTIAL sent with no certificates.")
+	}
+
+	input, err := credentialProofInput(c.tlsState)
+	if err != nil {
+		return err
+	}
+	if err := verifyProof(frame.Certificates[0].PublicKey, input, frame.Proof); err != nil {
+		return err
+	}
+
+	config := c.server.TLSConfig
+	if config == nil || config.ClientAuth < tls.VerifyClientCertIfGiven {
+		return nil
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         config.ClientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range frame.Certificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = frame.Certificates[0].Verify(opts)
+	return err
+}
+
+// requestTLS returns the TLS state presented to handlers
+// for a request using the given credential slot. Slot 0
+// uses the certificates from the TLS handshake. Otherwise,
+// the certificates sent in the slot's CREDENTIAL are used,
+// and the returned bool is false if there are none.
+func (c *Conn) requestTLS(slot byte) (*tls.ConnectionState, bool) {
+	if slot == 0 || c.tlsState == nil {
+		return c.tlsState, slot == 0
+	}
+
+	certs := c.certificates[uint16(slot)]
+	if certs == nil {
+		return nil, false
+	}
+
+	state := new(tls.ConnectionState)
+	*state = *c.tlsState
+	state.PeerCertificates = certs
+	state.VerifiedChains = nil
+	return state, true
+}
+
+// clientCredential records the certificate
+// sent in a CREDENTIAL for an origin.
+type clientCredential struct {
+	slot uint16
+	leaf []byte // DER encoding of the certificate.
+}
+
+// maxCredentialSlot is the largest slot which
+// can be given in a SYN_STREAM.
+const maxCredentialSlot = 0xff
+
+// requestCredential returns the credential slot to use for
+// a request to the given origin. If the origin's certificate
+// is not already in the server's credential vector, the
+// CREDENTIAL to send before the request is also returned.
+// This must be called with streamCreation held, so that
+// CREDENTIALs are sent before the requests using them.
+func (c *Conn) requestCredential(origin string) (byte, *frames.CREDENTIAL, error) {
+	// CREDENTIAL proofs use the TLS keying material, so
+	// are not sent over cleartext connections.
+	if c.ClientCredentials == nil || c.Subversion > 0 || c.tlsState == nil {
+		return 0, nil, nil
+	}
+
+	cert, err := c.ClientCredentials(origin)
+	if err != nil {
+		return 0, nil, err
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return 0, nil, nil
+	}
+
+	c.credentialLock.Lock()
+	defer c.credentialLock.Unlock()
+
+	if c.vectorIndex == 0 {
+		return 0, nil, nil
+	}
+
+	// Reuse the origin's slot where possible.
+	cred, ok := c.credentialSlots[origin]
+	if ok && bytes.Equal(cred.leaf, cert.Certificate[0]) {
+		return byte(cred.slot), nil, nil
+	}
+	if !ok {
+		cred.slot = c.nextSlot
+		c.nextSlot++
+		if c.nextSlot > c.vectorIndex {
+			c.nextSlot = 1
+		}
+
+		// Replace the slot's previous origin.
+		for o, other := range c.credentialSlots {
+			if other.slot == cred.slot {
+				delete(c.credentialSlots, o)
+			}
+		}
+	}
+
+	frame := new(frames.CREDENTIAL)
+	frame.Slot = cred.slot
+	frame.Certificates = make([]*x509.Certificate, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		frame.Certificates[i], err = x509.ParseCertificate(der)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	input, err := credentialProofInput(c.tlsState)
+	if err != nil {
+		return 0, nil, err
+	}
+	frame.Proof, err = signProof(cert.PrivateKey, input)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cred.leaf = cert.Certificate[0]
+	c.credentialSlots[origin] = cred
+	return byte(cred.slot), frame, nil
+}
+
+// setVectorSize updates the size of the server's
+// credential vector. Any origins in slots beyond
+// the new size must send their CREDENTIALs again.
+func (c *Conn) setVectorSize(size uint32) {
+	if size > maxCredentialSlot {
+		size = maxCredentialSlot
+	}
+
+	c.credentialLock.Lock()
+	defer c.credentialLock.Unlock()
+
+	c.vectorIndex = uint16(size)
+	for origin, cred := range c.credentialSlots {
+		if cred.slot > c.vectorIndex {
+			delete(c.credentialSlots, origin)
+		}
+	}
+	if c.nextSlot > c.vectorIndex {
+		c.nextSlot = 1
+	}
+}
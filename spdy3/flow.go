@@ -5,8 +5,10 @@
 package spdy3
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -39,11 +41,20 @@ type flowControl struct {
 	transferWindow      int64
 	sent                uint32
 	buffer              [][]byte
+	buffered            int64 // data in buffer.
 	constrained         bool
 	initialWindowThere  uint32
 	transferWindowThere int64
 	flowControl         common.FlowControl
 	waiting             chan bool
+	done                chan struct{} // closed when the flowControl is closed.
+	closeOnce           sync.Once
+	deferUpdates        bool                // regrow the window as data is consumed, rather than received.
+	consumed            int64               // data consumed but not yet returned to the window.
+	windowThere         int64               // size to which the window is regrown as data is consumed.
+	ctx                 context.Context     // if non-nil, ends blocked writes when done.
+	bandwidth           *common.RateLimiter // limit on data sent on the stream.
+	transferred         common.Transferred
 }
 
 // AddFlowControl initialises flow control for
@@ -64,10 +75,12 @@ func (s *PushStream) AddFlowControl(f common.FlowControl) {
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
 	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.done = make(chan struct{})
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	s.flow.bandwidth = s.bandwidth
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.transferWindowThere)
 }
@@ -90,12 +103,17 @@ func (s *RequestStream) AddFlowControl(f common.FlowControl) {
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
 	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.done = make(chan struct{})
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	s.flow.bandwidth = s.bandwidth
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
+	if s.Request != nil {
+		s.flow.ctx = s.Request.Context()
+	}
 }
 
 // AddFlowControl initialises flow control for
@@ -116,12 +134,19 @@ func (s *ResponseStream) AddFlowControl(f common.FlowControl) {
 	s.flow.streamID = s.streamID
 	s.flow.output = s.output
 	s.flow.buffer = make([][]byte, 0, 10)
+	s.flow.done = make(chan struct{})
 	s.flow.initialWindow = initialWindow
 	s.flow.transferWindow = int64(initialWindow)
 	s.flow.stream = s
 	s.flow.flowControl = f
+	s.flow.bandwidth = s.bandwidth
 	s.flow.initialWindowThere = f.InitialWindowSize()
 	s.flow.transferWindowThere = int64(s.flow.initialWindowThere)
+	s.flow.windowThere = int64(s.flow.initialWindowThere)
+	s.flow.deferUpdates = true
+	if s.request != nil {
+		s.flow.ctx = s.request.Context()
+	}
 }
 
 // CheckInitialWindow is used to handle the race
@@ -154,9 +179,20 @@ func (f *flowControl) CheckInitialWindow() {
 }
 
 // Close nils any references held by the flowControl.
+// Any call to Wait will return.
 func (f *flowControl) Close() {
+	f.Lock()
 	f.buffer = nil
+	f.buffered = 0
+	f.constrained = false
 	f.stream = nil
+	f.Unlock()
+	f.closeOnce.Do(func() {
+		close(f.done)
+		if adaptive, ok := f.flowControl.(common.AdaptiveFlowControl); ok {
+			adaptive.StreamClosed(f.streamID)
+		}
+	})
 }
 
 // Flush is used to send buffered data to
@@ -166,40 +202,40 @@ func (f *flowControl) Close() {
 // sent with a single flush.
 func (f *flowControl) Flush() {
 	f.CheckInitialWindow()
-	if !f.constrained || f.transferWindow == 0 {
+	if !f.constrained || f.transferWindow <= 0 {
 		return
 	}
 
-	out := make([]byte, 0, f.transferWindow)
 	left := f.transferWindow
-	for i := 0; i < len(f.buffer); i++ {
-		if l := int64(len(f.buffer[i])); l <= left {
-			out = append(out, f.buffer[i]...)
+	if left > f.buffered {
+		left = f.buffered
+	}
+	out := make([]byte, 0, left)
+	for len(f.buffer) > 0 && left > 0 {
+		if l := int64(len(f.buffer[0])); l <= left {
+			out = append(out, f.buffer[0]...)
 			left -= l
 			f.buffer = f.buffer[1:]
 		} else {
-			out = append(out, f.buffer[i][:left]...)
-			f.buffer[i] = f.buffer[i][left:]
+			out = append(out, f.buffer[0][:left]...)
+			f.buffer[0] = f.buffer[0][left:]
 			left = 0
 		}
-
-		if left == 0 {
-			break
-		}
 	}
 
 	f.transferWindow -= int64(len(out))
+	f.buffered -= int64(len(out))
 
-	if f.transferWindow > 0 {
+	if len(f.buffer) == 0 {
 		f.constrained = false
 		debug.Printf("Stream %d is no longer constrained.\n", f.streamID)
 	}
 
-	dataFrame := new(frames.DATA)
-	dataFrame.StreamID = f.streamID
-	dataFrame.Data = out
+	if len(out) == 0 {
+		return
+	}
 
-	f.output <- dataFrame
+	f.sendData(out)
 }
 
 // Paused indicates whether there is data buffered.
@@ -207,6 +243,8 @@ func (f *flowControl) Flush() {
 // last data has been sent and then Paused returns
 // false.
 func (f *flowControl) Paused() bool {
+	f.Lock()
+	defer f.Unlock()
 	f.CheckInitialWindow()
 	return f.constrained
 }
@@ -215,27 +253,86 @@ func (f *flowControl) Paused() bool {
 // the other endpoint. This ensures that they
 // conform to the transfer window, regrows the
 // window, and sends errors if necessary.
+//
+// If the window is regrown as data is consumed,
+// Consume performs the regrowing instead.
 func (f *flowControl) Receive(data []byte) {
+	f.transferred.Received(len(data))
+	f.Lock()
+
 	// The transfer window shouldn't already be negative.
 	if f.transferWindowThere < 0 {
+		f.Unlock()
 		rst := new(frames.RST_STREAM)
 		rst.StreamID = f.streamID
 		rst.Status = common.RST_STREAM_FLOW_CONTROL_ERROR
 		f.output <- rst
+		f.Lock()
 	}
 
 	// Update the window.
 	f.transferWindowThere -= int64(len(data))
+	if f.deferUpdates {
+		f.Unlock()
+		return
+	}
 
 	// Regrow the window if it's half-empty.
 	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, f.transferWindowThere)
-	if delta != 0 {
-		grow := new(frames.WINDOW_UPDATE)
-		grow.StreamID = f.streamID
-		grow.DeltaWindowSize = delta
-		f.output <- grow
-		f.transferWindowThere += int64(grow.DeltaWindowSize)
+	f.transferWindowThere += int64(delta)
+	f.Unlock()
+
+	f.sendWindowUpdate(delta)
+}
+
+// Consume is called when received data has been
+// read by the handler. The window is regrown as
+// data is consumed, so the other endpoint cannot
+// send data faster than it is processed.
+func (f *flowControl) Consume(n int) {
+	f.Lock()
+	if !f.deferUpdates {
+		f.Unlock()
+		return
 	}
+
+	// Data which has been received but not
+	// consumed still counts against the window.
+	f.consumed += int64(n)
+	window := f.windowThere - f.consumed
+	delta := f.flowControl.ReceiveData(f.streamID, f.initialWindowThere, window)
+	if int64(delta) > f.consumed {
+		// The window has grown.
+		f.windowThere += int64(delta) - f.consumed
+		f.consumed = 0
+	} else {
+		f.consumed -= int64(delta)
+	}
+	f.transferWindowThere += int64(delta)
+	f.Unlock()
+
+	f.sendWindowUpdate(delta)
+}
+
+func (f *flowControl) sendWindowUpdate(delta uint32) {
+	if delta == 0 {
+		return
+	}
+	grow := new(frames.WINDOW_UPDATE)
+	grow.StreamID = f.streamID
+	grow.DeltaWindowSize = delta
+	f.output <- grow
+}
+
+// stats adds the stream's transfer windows
+// and the data it has sent and received.
+func (f *flowControl) stats(stats *common.StreamStats) {
+	f.Lock()
+	stats.SendWindow = f.transferWindow
+	stats.ReceiveWindow = f.transferWindowThere
+	stats.Buffered = f.buffered
+	f.Unlock()
+	stats.BytesSent, stats.BytesReceived = f.transferred.Counts()
 }
 
 // UpdateWindow is called when an UPDATE_WINDOW frame is received,
@@ -261,13 +358,96 @@ func (f *flowControl) UpdateWindow(deltaWindowSize uint32) error {
 	return nil
 }
 
+// wake prompts any call to Wait to check
+// whether buffered data can now be sent.
+func (f *flowControl) wake() {
+	f.Lock()
+	select {
+	case f.waiting <- true:
+	default:
+	}
+	f.Unlock()
+}
+
+// wakeStreams prompts every stream waiting for
+// flow control to check its transfer window. This
+// is used when the initial window is changed.
+func (c *Conn) wakeStreams() {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	for _, stream := range c.streams {
+		var f *flowControl
+		switch stream := stream.(type) {
+		case *RequestStream:
+			f = stream.flow
+		case *ResponseStream:
+			f = stream.flow
+		case *PushStream:
+			f = stream.flow
+		}
+		if f != nil {
+			f.wake()
+		}
+	}
+}
+
+// measureRTT sends a PING to measure the round-trip
+// time, if the connection's flow control adapts to it
+// and wants a new measurement.
+func (c *Conn) measureRTT() {
+	c.flowControlLock.Lock()
+	f, ok := c.flowControl.(common.AdaptiveFlowControl)
+	c.flowControlLock.Unlock()
+	if !ok {
+		return
+	}
+
+	c.pingsLock.Lock()
+	if c.measuringRTT || !f.MeasureRTT() {
+		c.pingsLock.Unlock()
+		return
+	}
+	c.measuringRTT = true
+	c.pingsLock.Unlock()
+
+	go func() {
+		defer func() {
+			c.pingsLock.Lock()
+			c.measuringRTT = false
+			c.pingsLock.Unlock()
+		}()
+
+		start := time.Now()
+		pong, err := c.Ping()
+		if err != nil {
+			return
+		}
+		select {
+		case ok := <-pong:
+			if ok {
+				f.ReceiveRTT(time.Since(start))
+			}
+		case <-c.stop:
+		}
+	}()
+}
+
 // Wait blocks until any buffered data has been sent.
 // This may involve waiting for a window update from
 // the peer.
 func (f *flowControl) Wait() error {
+	return f.waitUntil(func() bool {
+		return !f.constrained
+	})
+}
+
+// waitUntil blocks until ready returns true, sending
+// buffered data as the transfer window grows. ready
+// is called with the flowControl locked.
+func (f *flowControl) waitUntil(ready func() bool) error {
 	f.Lock()
 	f.Flush()
-	if !f.Paused() {
+	if ready() {
 		f.Unlock()
 		return nil
 	}
@@ -277,18 +457,89 @@ func (f *flowControl) Wait() error {
 		return errors.New("waiting for flow control twice")
 	}
 
-	f.waiting = make(chan bool)
+	waiting := make(chan bool, 1)
+	f.waiting = waiting
 	f.Unlock()
 
+	defer func() {
+		f.Lock()
+		f.waiting = nil
+		f.Unlock()
+	}()
+
 	for {
-		<-f.waiting
+		select {
+		case <-waiting:
+		case <-f.done:
+			return errors.New("Error: Stream closed.")
+		case <-f.contextDone():
+			return f.ctx.Err()
+		}
+		f.Lock()
 		f.Flush()
-		if !f.Paused() {
+		ok := ready()
+		f.Unlock()
+		if ok {
 			return nil
 		}
 	}
 }
 
+// contextDone returns the channel closed when
+// the stream's context is done, if any.
+func (f *flowControl) contextDone() <-chan struct{} {
+	if f.ctx == nil {
+		return nil
+	}
+	return f.ctx.Done()
+}
+
+// waitBuffered blocks while the data buffered for
+// flow control, by the stream or by the connection,
+// exceeds the connection's limit. This ensures that
+// writes to a slow peer cannot buffer without bound.
+func (f *flowControl) waitBuffered() error {
+	max := f.conn.maxBufferedData()
+	err := f.waitUntil(func() bool {
+		return f.buffered < max
+	})
+	if err != nil {
+		return err
+	}
+
+	if drained := f.conn.dataBufferFull(); drained != nil {
+		select {
+		case <-drained:
+		case <-f.done:
+			return errors.New("Error: Stream closed.")
+		case <-f.contextDone():
+			return f.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// throttle waits before n bytes of data are sent, to
+// keep within the stream's bandwidth limit.
+func (f *flowControl) throttle(n int) error {
+	delay := f.bandwidth.Reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-f.done:
+		return errors.New("Error: Stream closed.")
+	case <-f.contextDone():
+		return f.ctx.Err()
+	}
+}
+
 // Write is used to send data to the connection. This
 // takes care of the windowing. Although data may be
 // buffered, rather than actually sent, this is not
@@ -299,17 +550,22 @@ func (f *flowControl) Write(data []byte) (int, error) {
 		return 0, nil
 	}
 
-	if f.buffer == nil || f.stream == nil {
-		return 0, errors.New("Error: Stream closed.")
+	// Keep within the stream's bandwidth limit.
+	if err := f.throttle(l); err != nil {
+		return 0, err
 	}
 
 	// Transfer window processing.
+	f.Lock()
+	if f.buffer == nil || f.stream == nil {
+		f.Unlock()
+		return 0, errors.New("Error: Stream closed.")
+	}
 	f.CheckInitialWindow()
 	if f.constrained {
 		f.Flush()
 	}
 
-	f.Lock()
 	var window uint32
 	if f.transferWindow < 0 {
 		window = 0
@@ -329,20 +585,40 @@ func (f *flowControl) Write(data []byte) (int, error) {
 
 	if constrained {
 		f.buffer = append(f.buffer, data[window:])
+		f.buffered += int64(len(data) - int(window))
 		data = data[:window]
 		f.constrained = true
 		debug.Printf("Stream %d is now constrained.\n", f.streamID)
 	}
 	f.Unlock()
 
-	if len(data) == 0 {
-		return l, nil
+	if len(data) > 0 {
+		f.sendData(data)
 	}
 
-	dataFrame := new(frames.DATA)
-	dataFrame.StreamID = f.streamID
-	dataFrame.Data = data
-
-	f.output <- dataFrame
+	// Block while too much data is buffered.
+	if err := f.waitBuffered(); err != nil {
+		return l, err
+	}
 	return l, nil
 }
+
+// sendData sends data in DATA frames no larger
+// than the connection's maximum payload.
+func (f *flowControl) sendData(data []byte) {
+	max := f.conn.maxDataSize()
+	for len(data) > 0 {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+
+		dataFrame := new(frames.DATA)
+		dataFrame.StreamID = f.streamID
+		dataFrame.Data = data[:n]
+		f.output <- dataFrame
+		f.transferred.Sent(n)
+
+		data = data[n:]
+	}
+}
@@ -33,7 +33,7 @@ func (frame *CREDENTIAL) Name() string {
 
 func (frame *CREDENTIAL) ReadFrom(reader io.Reader) (int64, error) {
 	c := common.ReadCounter{R: reader}
-	data, err := common.ReadExactly(&c, 18)
+	data, err := common.ReadExactly(&c, 14)
 	if err != nil {
 		return c.N, err
 	}
@@ -51,35 +51,37 @@ func (frame *CREDENTIAL) ReadFrom(reader io.Reader) (int64, error) {
 		return c.N, common.FrameTooLarge
 	}
 
-	// Read in data.
-	certs, err := common.ReadExactly(&c, length-10)
-	if err != nil {
-		return c.N, err
-	}
-
 	frame.Slot = common.BytesToUint16(data[8:10])
 	proofLen := int(common.BytesToUint32(data[10:14]))
-	if proofLen > 0 {
-		frame.Proof = data[14 : 14+proofLen]
-	} else {
-		frame.Proof = []byte{}
+	if proofLen > length-6 {
+		return c.N, common.IncorrectDataLength(length, 6+proofLen)
 	}
 
-	numCerts := 0
-	for offset := 0; offset < length-10; {
-		offset += int(common.BytesToUint32(certs[offset:offset+4])) + 4
-		numCerts++
+	// Read in data.
+	data, err = common.ReadExactly(&c, length-6)
+	if err != nil {
+		return c.N, err
 	}
 
-	frame.Certificates = make([]*x509.Certificate, numCerts)
-	for i, offset := 0, 0; offset < length-10; i++ {
-		length := int(common.BytesToUint32(certs[offset : offset+4]))
-		rawCert := certs[offset+4 : offset+4+length]
-		frame.Certificates[i], err = x509.ParseCertificate(rawCert)
+	frame.Proof = data[:proofLen]
+	certs := data[proofLen:]
+
+	// Each certificate is preceded by its length.
+	frame.Certificates = make([]*x509.Certificate, 0, 1)
+	for len(certs) > 0 {
+		if len(certs) < 4 {
+			return c.N, common.IncorrectDataLength(length, length+4-len(certs))
+		}
+		certLen := int(common.BytesToUint32(certs[:4]))
+		if certLen > len(certs)-4 {
+			return c.N, common.IncorrectDataLength(length, length+certLen+4-len(certs))
+		}
+		cert, err := x509.ParseCertificate(certs[4 : 4+certLen])
 		if err != nil {
 			return c.N, err
 		}
-		offset += length + 4
+		frame.Certificates = append(frame.Certificates, cert)
+		certs = certs[4+certLen:]
 	}
 
 	return c.N, nil
@@ -102,10 +104,13 @@ func (frame *CREDENTIAL) WriteTo(writer io.Writer) (int64, error) {
 	proofLength := len(frame.Proof)
 	certsLength := 0
 	for _, cert := range frame.Certificates {
-		certsLength += len(cert.Raw)
+		certsLength += 4 + len(cert.Raw)
 	}
 
 	length := 6 + proofLength + certsLength
+	if length > common.MAX_FRAME_SIZE {
+		return 0, common.FrameTooLarge
+	}
 	out := make([]byte, 14)
 
 	out[0] = 128                      // Control bit and Version
@@ -135,13 +140,22 @@ func (frame *CREDENTIAL) WriteTo(writer io.Writer) (int64, error) {
 		}
 	}
 
-	written := int64(14 + len(frame.Proof))
 	for _, cert := range frame.Certificates {
+		certLength := len(cert.Raw)
+		prefix := []byte{
+			byte(certLength >> 24), // Certificate Length
+			byte(certLength >> 16), // Certificate Length
+			byte(certLength >> 8),  // Certificate Length
+			byte(certLength),       // Certificate Length
+		}
+		err = common.WriteExactly(&c, prefix)
+		if err != nil {
+			return c.N, err
+		}
 		err = common.WriteExactly(&c, cert.Raw)
 		if err != nil {
 			return c.N, err
 		}
-		written += int64(len(cert.Raw))
 	}
 
 	return c.N, nil
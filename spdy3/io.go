@@ -2,6 +2,7 @@ package spdy3
 
 import (
 	"runtime"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -66,65 +67,13 @@ func (c *Conn) send() {
 		}
 	}()
 
-	for i := 1; ; i++ {
-		if i >= 5 {
-			i = 0 // Once per 5 frames, pick randomly.
-		}
-
-		var frame common.Frame
-		if i == 0 { // Ignore priority.
-			frame = c.selectFrameToSend(false)
-		} else { // Normal selection.
-			frame = c.selectFrameToSend(true)
-		}
-
+	for {
+		frame := c.selectFrameToSend()
 		if frame == nil {
 			c.Close()
 			return
 		}
 
-		// Process connection-level flow control.
-		if c.Subversion > 0 {
-			c.connectionWindowLock.Lock()
-			if frame, ok := frame.(*frames.DATA); ok {
-				size := int64(len(frame.Data))
-				constrained := false
-				sending := size
-				if sending > c.connectionWindowSize {
-					sending = c.connectionWindowSize
-					constrained = true
-				}
-				if sending < 0 {
-					sending = 0
-				}
-
-				c.connectionWindowSize -= sending
-
-				if constrained {
-					// Chop off what we can send now.
-					partial := new(frames.DATA)
-					partial.Flags = frame.Flags
-					partial.StreamID = frame.StreamID
-					partial.Data = make([]byte, int(sending))
-					copy(partial.Data, frame.Data[:sending])
-					frame.Data = frame.Data[sending:]
-
-					// Buffer this frame and try again.
-					if c.dataBuffer == nil {
-						c.dataBuffer = []*frames.DATA{frame}
-					} else {
-						buffer := make([]*frames.DATA, 1, len(c.dataBuffer)+1)
-						buffer[0] = frame
-						buffer = append(buffer, c.dataBuffer...)
-						c.dataBuffer = buffer
-					}
-
-					frame = partial
-				}
-			}
-			c.connectionWindowLock.Unlock()
-		}
-
 		// Compress any name/value header blocks.
 		err := frame.Compress(c.compressor)
 		if err != nil {
@@ -138,84 +87,380 @@ func (c *Conn) send() {
 
 		// Leave the specifics of writing to the
 		// connection up to the frame.
+		conn := c.Conn()
+		if conn == nil {
+			return
+		}
 		c.refreshWriteTimeout()
-		if _, err = frame.WriteTo(c.conn); err != nil {
+		if _, err = frame.WriteTo(conn); err != nil {
 			c.handleReadWriteError(err)
 			return
 		}
+
+		// Keep within the bandwidth limit.
+		if data, ok := frame.(*frames.DATA); ok {
+			c.throttle(len(data.Data))
+		}
 	}
 }
 
-// selectFrameToSend follows the specification's guidance
-// on frame priority, sending frames with higher priority
-// (a smaller number) first. If the given boolean is false,
-// this priority is temporarily ignored, which can be used
-// when high load is ignoring low-priority frames.
-func (c *Conn) selectFrameToSend(prioritise bool) (frame common.Frame) {
-	if c.Closed() {
-		return nil
+// throttle records that n bytes of data have been sent,
+// holding back further DATA frames as necessary to keep
+// within the connection's bandwidth limit. Other frames
+// are sent meanwhile.
+func (c *Conn) throttle(n int) {
+	if delay := c.bandwidth.Reserve(n); delay > 0 {
+		c.throttledUntil = time.Now().Add(delay)
 	}
+}
 
-	// Try buffered DATA frames first.
-	if c.Subversion > 0 {
-		if c.dataBuffer != nil {
-			if len(c.dataBuffer) == 0 {
-				c.dataBuffer = nil
-			} else {
-				first := c.dataBuffer[0]
-				if c.connectionWindowSize >= int64(8+len(first.Data)) {
-					if len(c.dataBuffer) > 1 {
-						c.dataBuffer = c.dataBuffer[1:]
-					} else {
-						c.dataBuffer = nil
-					}
-					return first
-				}
+// schedule passes a frame sent on the output channel
+// with the given priority to the Scheduler.
+func (c *Conn) schedule(frame common.Frame, priority common.Priority) {
+	if _, ok := frame.(*frames.DATA); !ok {
+		c.scheduledControl++
+	}
+	c.Scheduler.Push(scheduledFrame(frame, priority))
+}
+
+// nextScheduled returns the next frame chosen by the
+// Scheduler, or nil if no frames are waiting.
+func (c *Conn) nextScheduled() common.Frame {
+	frame := c.Scheduler.Pop()
+	if _, ok := frame.(*frames.DATA); !ok && frame != nil {
+		c.scheduledControl--
+	}
+	return frame
+}
+
+// holdFrame holds back a DATA frame while the bandwidth
+// limit is reached, along with any later frame on a stream
+// with frames held back, so that each stream's frames are
+// still sent in order. holdFrame returns whether it held
+// the frame.
+func (c *Conn) holdFrame(frame common.Frame, wait time.Duration) bool {
+	if _, ok := frame.(*frames.DATA); !ok || wait <= 0 {
+		id := scheduledFrame(frame, 0).StreamID
+		if id == 0 {
+			return false
+		}
+
+		held := false
+		for _, other := range c.heldFrames {
+			if scheduledFrame(other, 0).StreamID == id {
+				held = true
+				break
 			}
 		}
+		if !held {
+			return false
+		}
 	}
 
-	// Then in priority order.
-	if prioritise {
-		for i := 0; i < 8; i++ {
-			select {
-			case frame = <-c.output[i]:
+	c.heldFrames = append(c.heldFrames, frame)
+	return true
+}
+
+// selectFrameToSend returns the next frame to send. The
+// frames waiting in the output channels are passed to the
+// connection's Scheduler, which chooses between them. If
+// no frames are waiting, selectFrameToSend waits for the
+// next, returning nil if the connection closes.
+//
+// A frame passes through up to three queues, which are
+// tried in turn for the next frame to send:
+//
+//   - dataBuffer holds DATA withheld for the connection
+//     window. Its first frame is sent as soon as the window
+//     and the bandwidth limit allow. Only DATA enters it, so
+//     other frames never wait for the connection window.
+//   - heldFrames holds the frames the Scheduler chose while
+//     the bandwidth limit was reached: DATA, and any later
+//     frame on a stream with frames already held, so that
+//     each stream's frames stay in order. Held frames are
+//     released in order, one at a time, once the limit
+//     allows, and before the Scheduler is consulted again.
+//   - The Scheduler holds the frames taken from the output
+//     channels, in priority order. While the bandwidth limit
+//     is reached, it is only consulted while scheduledControl
+//     shows it holds a frame other than DATA, so the DATA
+//     behind that frame stays in priority order.
+//
+// Once the Scheduler and heldFrames hold maxScheduledFrames
+// frames between them, the output channels are not read,
+// except output[0], which carries the connection's own
+// control frames, such as PING, SETTINGS and GOAWAY, and is
+// read until they hold twice as many. Frames sent by streams,
+// such as RST_STREAM and WINDOW_UPDATE, wait in their stream's
+// channel until the Scheduler has room, as DATA withheld for
+// the connection window does not count towards the limit.
+func (c *Conn) selectFrameToSend() (frame common.Frame) {
+	for {
+		if c.Closed() {
+			return nil
+		}
+
+		wait := time.Until(c.throttledUntil)
+		if wait <= 0 {
+			// Try DATA frames withheld for flow control first.
+			if frame = c.nextWithheldData(); frame != nil {
+				return frame
+			}
+
+			// Then frames held back by the bandwidth limit.
+			if len(c.heldFrames) > 0 {
+				frame = c.heldFrames[0]
+				c.heldFrames[0] = nil
+				c.heldFrames = c.heldFrames[1:]
+				if frame = c.withholdData(frame); frame != nil {
+					return frame
+				}
+				continue
+			}
+		}
+
+		// Then as chosen by the scheduler.
+		c.scheduleWaitingFrames()
+		for wait <= 0 || c.scheduledControl > 0 {
+			if frame = c.nextScheduled(); frame == nil {
+				break
+			}
+			if c.holdFrame(frame, wait) {
+				continue
+			}
+			if frame = c.withholdData(frame); frame != nil {
 				return frame
-			default:
 			}
 		}
 
 		// No frames are immediately pending, so if the
-		// cection is being closed, cease sending
+		// connection is being closed, cease sending
 		// safely.
-		c.sendingLock.Lock()
-		if c.sending != nil {
-			close(c.sending)
+		if c.Scheduler.Len() == 0 && len(c.heldFrames) == 0 {
+			c.sendingLock.Lock()
+			if c.sending != nil {
+				close(c.sending)
+				c.sendingLock.Unlock()
+				runtime.Goexit()
+			}
 			c.sendingLock.Unlock()
-			runtime.Goexit()
 		}
-		c.sendingLock.Unlock()
+
+		// Wait for any frame, for the connection window
+		// to grow, or for the bandwidth limit to
+		// allow DATA to be sent. Once enough frames are waiting,
+		// further frames wait in their channels, except those on
+		// output[0], such as PINGs, up to a further limit.
+		output := c.output
+		if n := c.Scheduler.Len() + len(c.heldFrames); n >= maxScheduledFrames {
+			output = [8]chan common.Frame{}
+			if n < 2*maxScheduledFrames {
+				output[0] = c.output[0]
+			}
+		}
+		var timer *time.Timer
+		var throttled <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			throttled = timer.C
+		}
+		var priority common.Priority
+		received := true
+		select {
+		case frame = <-output[0]:
+		case frame = <-output[1]:
+			priority = 1
+		case frame = <-output[2]:
+			priority = 2
+		case frame = <-output[3]:
+			priority = 3
+		case frame = <-output[4]:
+			priority = 4
+		case frame = <-output[5]:
+			priority = 5
+		case frame = <-output[6]:
+			priority = 6
+		case frame = <-output[7]:
+			priority = 7
+		case <-c.connectionWindowGrown:
+			received = false
+		case <-throttled:
+			received = false
+		case _ = <-c.stop:
+			frame = nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !received {
+			continue
+		}
+		if frame == nil {
+			return nil
+		}
+
+		// DATA waits for the bandwidth limit
+		// with the Scheduler.
+		if _, ok := frame.(*frames.DATA); ok && wait > 0 {
+			c.schedule(frame, priority)
+			continue
+		}
+		if c.holdFrame(frame, wait) {
+			continue
+		}
+		if frame = c.withholdData(frame); frame != nil {
+			return frame
+		}
 	}
+}
 
-	// Wait for any frame.
-	select {
-	case frame = <-c.output[0]:
-		return frame
-	case frame = <-c.output[1]:
-		return frame
-	case frame = <-c.output[2]:
-		return frame
-	case frame = <-c.output[3]:
-		return frame
-	case frame = <-c.output[4]:
-		return frame
-	case frame = <-c.output[5]:
-		return frame
-	case frame = <-c.output[6]:
-		return frame
-	case frame = <-c.output[7]:
+// withholdData applies SPDY/3.1's connection-level flow
+// control to a frame about to be sent. DATA frames are
+// queued behind any DATA already waiting for the connection
+// window, so the frame returned may be an earlier DATA frame,
+// or nil if no data can be sent yet.
+func (c *Conn) withholdData(frame common.Frame) common.Frame {
+	data, ok := frame.(*frames.DATA)
+	if !ok || c.Subversion == 0 {
 		return frame
-	case _ = <-c.stop:
+	}
+
+	c.connectionWindowLock.Lock()
+	c.dataBuffer = append(c.dataBuffer, data)
+	c.dataBuffered += int64(len(data.Data))
+	c.connectionWindowLock.Unlock()
+	return c.nextWithheldData()
+}
+
+// nextWithheldData returns as much of the first DATA frame
+// withheld for flow control as the connection window allows,
+// or nil if none can be sent.
+func (c *Conn) nextWithheldData() common.Frame {
+	if len(c.dataBuffer) == 0 {
 		return nil
 	}
+
+	c.connectionWindowLock.Lock()
+	defer c.connectionWindowLock.Unlock()
+
+	first := c.dataBuffer[0]
+	size := int64(len(first.Data))
+	if size <= c.connectionWindowSize || size == 0 {
+		c.connectionWindowSize -= size
+		c.dataBuffer[0] = nil
+		c.dataBuffer = c.dataBuffer[1:]
+		if len(c.dataBuffer) == 0 {
+			c.dataBuffer = nil
+		}
+		c.drainDataBuffer(size)
+		return first
+	}
+	if c.connectionWindowSize <= 0 {
+		return nil
+	}
+
+	// Send what the window allows now, and the
+	// rest of the frame once the window grows.
+	partial := new(frames.DATA)
+	partial.StreamID = first.StreamID
+	partial.Data = first.Data[:c.connectionWindowSize]
+	first.Data = first.Data[c.connectionWindowSize:]
+	c.drainDataBuffer(c.connectionWindowSize)
+	c.connectionWindowSize = 0
+	return partial
+}
+
+// drainDataBuffer records that withheld data has
+// been sent, releasing any writes blocked by the
+// data buffered. This must be called with
+// connectionWindowLock held.
+func (c *Conn) drainDataBuffer(n int64) {
+	c.dataBuffered -= n
+	if c.dataBufferDrained != nil && c.dataBuffered < c.maxBufferedData() {
+		close(c.dataBufferDrained)
+		c.dataBufferDrained = nil
+	}
+}
+
+// dataBufferFull returns nil if the DATA withheld by
+// SPDY/3.1's connection-level flow control is within
+// the limit, or a channel which is closed once it has
+// been drained sufficiently.
+func (c *Conn) dataBufferFull() <-chan struct{} {
+	if c.Subversion == 0 {
+		return nil
+	}
+
+	c.connectionWindowLock.Lock()
+	defer c.connectionWindowLock.Unlock()
+
+	if c.dataBuffered < c.maxBufferedData() {
+		return nil
+	}
+	if c.dataBufferDrained == nil {
+		c.dataBufferDrained = make(chan struct{})
+	}
+	return c.dataBufferDrained
+}
+
+// growConnectionWindow wakes the sending goroutine
+// when the connection window grows, so that any DATA
+// withheld for flow control can be sent.
+func (c *Conn) growConnectionWindow() {
+	select {
+	case c.connectionWindowGrown <- struct{}{}:
+	default:
+	}
+}
+
+// maxScheduledFrames limits the number of frames taken
+// from the output channels to be ordered by the Scheduler
+// or held back by the bandwidth limit. Further frames wait
+// in their channels, blocking their senders. output[0] is
+// read until twice as many are waiting, as described in
+// selectFrameToSend.
+const maxScheduledFrames = 32
+
+// scheduleWaitingFrames passes the frames waiting in the
+// output channels to the Scheduler.
+func (c *Conn) scheduleWaitingFrames() {
+	for i := range c.output {
+	drain:
+		for c.Scheduler.Len()+len(c.heldFrames) < maxScheduledFrames {
+			select {
+			case frame := <-c.output[i]:
+				if frame == nil {
+					break drain
+				}
+				c.schedule(frame, common.Priority(i))
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// scheduledFrame gives the details of a frame
+// sent on the output channel with the given
+// priority, for use by the Scheduler.
+func scheduledFrame(frame common.Frame, priority common.Priority) common.ScheduledFrame {
+	out := common.ScheduledFrame{Frame: frame, Priority: priority, Size: 8}
+	switch frame := frame.(type) {
+	case *frames.DATA:
+		out.StreamID = frame.StreamID
+		out.Size += len(frame.Data)
+	case *frames.SYN_STREAM:
+		out.StreamID = frame.StreamID
+	case *frames.SYN_STREAMV3_1:
+		out.StreamID = frame.StreamID
+	case *frames.SYN_REPLY:
+		out.StreamID = frame.StreamID
+	case *frames.RST_STREAM:
+		out.StreamID = frame.StreamID
+	case *frames.HEADERS:
+		out.StreamID = frame.StreamID
+	case *frames.WINDOW_UPDATE:
+		out.StreamID = frame.StreamID
+	}
+	return out
 }
@@ -55,6 +55,7 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 			switch setting.ID {
 			case common.SETTINGS_INITIAL_WINDOW_SIZE:
 				c.initialWindowSizeLock.Lock()
+				c.connectionWindowLock.Lock()
 				initial := int64(c.initialWindowSize)
 				current := c.connectionWindowSize
 				inbound := int64(setting.Value)
@@ -66,7 +67,13 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 					}
 					c.initialWindowSize = setting.Value
 				}
+				c.connectionWindowLock.Unlock()
 				c.initialWindowSizeLock.Unlock()
+				c.growConnectionWindow()
+				c.wakeStreams()
+
+			case common.SETTINGS_DOWNLOAD_BANDWIDTH:
+				c.updateBandwidth()
 
 			case common.SETTINGS_MAX_CONCURRENT_STREAMS:
 				if c.server == nil {
@@ -74,6 +81,11 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 				} else {
 					c.pushStreamLimit.SetLimit(setting.Value)
 				}
+
+			case common.SETTINGS_CLIENT_CERTIFICATE_VECTOR_SIZE:
+				if c.server == nil {
+					c.setVectorSize(setting.Value)
+				}
 			}
 		}
 
@@ -99,16 +111,30 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 
 	case *frames.GOAWAY:
 		lastProcessed := frame.LastGoodStreamID
+		var unprocessed []common.Stream
 		c.streamsLock.Lock()
 		for streamID, stream := range c.streams {
 			if streamID&1 == c.oddity && streamID > lastProcessed {
 				// Stream is locally-sent and has not been processed.
-				// TODO: Inform the server that the push has not been successful.
-				stream.Close()
+				unprocessed = append(unprocessed, stream)
 			}
 		}
 		c.streamsLock.Unlock()
-		c.shutdownError = frame
+		c.goawayLock.Lock()
+		c.goawayStatus = frame.Status
+		c.goawayLock.Unlock()
+		for _, stream := range unprocessed {
+			c.recordGoaway(stream)
+			if push, ok := stream.(*PushStream); ok {
+				// Writes to the push will return ErrGoaway.
+				push.reset(common.ErrGoaway)
+			} else {
+				stream.Close()
+			}
+		}
+		if frame.Status != common.GOAWAY_OK {
+			c.shutdownError = frame
+		}
 		c.goawayLock.Lock()
 		c.goawayReceived = true
 		c.goawayLock.Unlock()
@@ -127,6 +153,10 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 			log.Println("Ignored unexpected CREDENTIAL.")
 			return false
 		}
+		if err := c.verifyCredential(frame); err != nil {
+			log.Printf("Ignored invalid CREDENTIAL for slot %d: %v\n", frame.Slot, err)
+			return false
+		}
 		if frame.Slot >= c.vectorIndex {
 			setting := new(frames.SETTINGS)
 			setting.Settings = common.Settings{
@@ -141,25 +171,32 @@ func (c *Conn) processFrame(frame common.Frame) bool {
 		c.certificates[frame.Slot] = frame.Certificates
 
 	case *frames.DATA:
+		c.measureRTT()
 		if c.Subversion > 0 {
 			// The transfer window shouldn't already be negative.
+			c.connectionWindowLock.Lock()
 			if c.connectionWindowSizeThere < 0 {
+				c.connectionWindowLock.Unlock()
 				c._GOAWAY(common.GOAWAY_FLOW_CONTROL_ERROR)
 				return false
 			}
 
 			c.connectionWindowSizeThere -= int64(len(frame.Data))
+			window := c.connectionWindowSizeThere
+			c.connectionWindowLock.Unlock()
 
 			c.flowControlLock.Lock()
 			f := c.flowControl
 			c.flowControlLock.Unlock()
-			delta := f.ReceiveData(0, c.initialWindowSizeThere, c.connectionWindowSizeThere)
+			delta := f.ReceiveData(0, c.initialWindowSizeThere, window)
 			if delta != 0 {
 				grow := new(frames.WINDOW_UPDATE)
 				grow.StreamID = 0
 				grow.DeltaWindowSize = delta
 				c.output[0] <- grow
+				c.connectionWindowLock.Lock()
 				c.connectionWindowSizeThere += int64(grow.DeltaWindowSize)
+				c.connectionWindowLock.Unlock()
 			}
 		}
 		if c.server == nil {
@@ -211,8 +248,12 @@ func (c *Conn) handleHeaders(frame *frames.HEADERS) {
 	// Handle push headers.
 	if sid&1 == 0 && c.server == nil {
 		// Ignore refused push headers.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
+		if req := c.pushRequest(sid); req != nil && c.PushReceiver != nil {
 			c.PushReceiver.ReceiveHeader(req, frame.Header)
+			if frame.Flags.FIN() {
+				c.PushReceiver.ReceiveData(req, []byte{}, true)
+				c.finishPush(sid)
+			}
 		}
 		return
 	}
@@ -303,17 +344,57 @@ func (c *Conn) handlePush(frame *frames.SYN_STREAM) {
 	}
 
 	// Check whether the receiver wants this resource.
-	if c.PushReceiver != nil && !c.PushReceiver.ReceiveRequest(request) {
+	if c.PushReceiver == nil || !c.PushReceiver.ReceiveRequest(request) {
+		c.pushStreamLimit.Close()
 		c._RST_STREAM(sid, common.RST_STREAM_REFUSED_STREAM)
 		return
 	}
 
-	if c.PushReceiver != nil {
-		c.pushRequests[sid] = request
-		c.lastPushStreamIDLock.Lock()
-		c.lastPushStreamID = sid
-		c.lastPushStreamIDLock.Unlock()
-		c.PushReceiver.ReceiveHeader(request, frame.Header)
+	c.pushRequestsLock.Lock()
+	c.pushRequests[sid] = request
+	c.pushRequestsLock.Unlock()
+	c.lastPushStreamIDLock.Lock()
+	c.lastPushStreamID = sid
+	c.lastPushStreamIDLock.Unlock()
+	c.PushReceiver.ReceiveHeader(request, frame.Header)
+
+	if frame.Flags.FIN() {
+		c.PushReceiver.ReceiveData(request, []byte{}, true)
+		c.finishPush(sid)
+	}
+}
+
+// pushRequest returns the request sent with
+// the given server push, or nil if the push
+// was refused or has finished.
+func (c *Conn) pushRequest(sid common.StreamID) *http.Request {
+	c.pushRequestsLock.Lock()
+	defer c.pushRequestsLock.Unlock()
+	return c.pushRequests[sid]
+}
+
+// finishPush cleans up once a server push
+// has been completed, returning its request.
+func (c *Conn) finishPush(sid common.StreamID) *http.Request {
+	c.pushRequestsLock.Lock()
+	req, ok := c.pushRequests[sid]
+	delete(c.pushRequests, sid)
+	c.pushRequestsLock.Unlock()
+	if ok {
+		c.pushStreamLimit.Close()
+	}
+	return req
+}
+
+// abortPush cleans up a server push which
+// has ended before being completed.
+func (c *Conn) abortPush(sid common.StreamID) {
+	req := c.finishPush(sid)
+	if req == nil {
+		return
+	}
+	if r, ok := c.PushReceiver.(common.AbortReceiver); ok {
+		r.ReceiveAbort(req)
 	}
 }
 
@@ -361,6 +442,13 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 		return
 	}
 
+	// Check the client has sent the credentials for the slot.
+	if _, ok := c.requestTLS(frame.Slot); !ok {
+		c.requestStreamLimit.Close()
+		c._RST_STREAM(sid, common.RST_STREAM_INVALID_CREDENTIALS)
+		return
+	}
+
 	// Create and start new stream.
 	nextStream := c.newStream(frame)
 	if nextStream == nil {
@@ -370,6 +458,7 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 	c.streamsLock.Lock()
 	c.streams[sid] = nextStream
 	c.streamsLock.Unlock()
+	c.streamsChanged()
 	c.lastRequestStreamIDLock.Lock()
 	c.lastRequestStreamID = sid
 	c.lastRequestStreamIDLock.Unlock()
@@ -379,9 +468,16 @@ func (c *Conn) handleRequest(frame *frames.SYN_STREAM) {
 // handleRstStream performs the processing of RST_STREAM frames.
 func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 	sid := frame.StreamID
+
+	// Handle reset pushes.
+	if sid&1 == 0 && c.server == nil {
+		c.abortPush(sid)
+	}
+
 	c.streamsLock.Lock()
 	stream := c.streams[sid]
 	c.streamsLock.Unlock()
+	recordReset(stream, frame.Status)
 
 	// Determine the status code and react accordingly.
 	switch frame.Status {
@@ -399,8 +495,15 @@ func (c *Conn) handleRstStream(frame *frames.RST_STREAM) {
 			return
 		}
 		fallthrough
-	case common.RST_STREAM_REFUSED_STREAM:
-		if stream != nil {
+	case common.RST_STREAM_REFUSED_STREAM,
+		common.RST_STREAM_INTERNAL_ERROR:
+		if push, ok := stream.(*PushStream); ok && frame.Status != common.RST_STREAM_INTERNAL_ERROR {
+			// The client has refused or cancelled the push.
+			push.reset(common.ErrPushRefused)
+		} else if req, ok := stream.(*RequestStream); ok && frame.Status == common.RST_STREAM_REFUSED_STREAM {
+			// The server has refused the request.
+			req.refuse()
+		} else if stream != nil {
 			go stream.Close()
 		}
 
@@ -424,8 +527,11 @@ func (c *Conn) handleServerData(frame *frames.DATA) {
 
 	if sid&1 == 0 { // Handle push data.
 		// Ignore refused push data.
-		if req := c.pushRequests[sid]; req != nil && c.PushReceiver != nil {
+		if req := c.pushRequest(sid); req != nil && c.PushReceiver != nil {
 			c.PushReceiver.ReceiveData(req, frame.Data, frame.Flags.FIN())
+			if frame.Flags.FIN() {
+				c.finishPush(sid)
+			}
 		}
 		return
 	}
@@ -506,6 +612,7 @@ func (c *Conn) handleWindowUpdate(frame *frames.WINDOW_UPDATE) {
 			return
 		}
 		c.connectionWindowSize += int64(delta)
+		c.growConnectionWindow()
 		return
 	}
 
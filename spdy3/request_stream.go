@@ -26,6 +26,7 @@ type RequestStream struct {
 	shutdownOnce sync.Once
 	conn         *Conn
 	streamID     common.StreamID
+	priority     common.Priority
 	flow         *flowControl
 	state        *common.StreamState
 	output       chan<- common.Frame
@@ -34,6 +35,9 @@ type RequestStream struct {
 	responseCode int
 	stop         <-chan bool
 	finished     chan struct{}
+	processed    chan struct{}       // closed once received frames have been processed.
+	refused      bool                // whether the server refused the stream.
+	bandwidth    *common.RateLimiter // limit on data sent on the stream.
 }
 
 func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common.Frame) *RequestStream {
@@ -42,15 +46,46 @@ func NewRequestStream(conn *Conn, streamID common.StreamID, output chan<- common
 	out.streamID = streamID
 	out.output = output
 	out.stop = conn.stop
+	out.bandwidth = common.NewRateLimiter(conn.StreamBandwidth)
 	out.state = new(common.StreamState)
-	out.state.CloseHere()
 	out.header = make(http.Header)
 	out.finished = make(chan struct{})
+	out.processed = make(chan struct{})
 	out.headerChan = make(chan func(), 5)
 	go out.processFrames()
 	return out
 }
 
+// sendBody sends the request body, abiding by the
+// server's transfer window, followed by the request
+// trailers, if any. The final frame closes the stream.
+func (s *RequestStream) sendBody(body []*frames.DATA, trailer *frames.HEADERS) {
+	defer common.Recover()
+
+	for _, frame := range body {
+		if _, err := s.flow.Write(frame.Data); err != nil {
+			debug.Printf("Failed to send request body on stream %d: %v\n", s.streamID, err)
+			return
+		}
+	}
+	if err := s.flow.Wait(); err != nil {
+		debug.Printf("Failed to send request body on stream %d: %v\n", s.streamID, err)
+		return
+	}
+
+	if trailer != nil {
+		trailer.StreamID = s.streamID
+		s.output <- trailer
+	} else {
+		fin := new(frames.DATA)
+		fin.StreamID = s.streamID
+		fin.Flags = common.FLAG_FIN
+		fin.Data = []byte{}
+		s.output <- fin
+	}
+	s.state.CloseHere()
+}
+
 /***********************
  * http.ResponseWriter *
  ***********************/
@@ -76,13 +111,14 @@ func (s *RequestStream) Write(inputData []byte) (int, error) {
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
-		n, err := s.flow.Write(data[:common.MAX_DATA_SIZE])
+	max := s.conn.maxDataSize()
+	for len(data) > max {
+		n, err := s.flow.Write(data[:max])
 		if err != nil {
 			return written, err
 		}
 		written += n
-		data = data[common.MAX_DATA_SIZE:]
+		data = data[max:]
 	}
 
 	if len(data) > 0 {
@@ -134,21 +170,18 @@ func (s *RequestStream) shutdown() {
 	default:
 		close(s.finished)
 	}
-	select {
-	case <-s.headerChan:
-	default:
-		close(s.headerChan)
-	}
+	s.recvMutex.Lock()
+	close(s.headerChan)
+	s.recvMutex.Unlock()
 	s.conn.requestStreamLimit.Close()
 	s.output = nil
-	s.Request = nil
-	s.Receiver = nil
 	s.header = nil
 	s.stop = nil
 
 	s.conn.streamsLock.Lock()
 	delete(s.conn.streams, s.streamID)
 	s.conn.streamsLock.Unlock()
+	s.conn.streamsChanged()
 }
 
 /**********
@@ -167,6 +200,12 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 		return errors.New("Nil frame received.")
 	}
 
+	select {
+	case <-s.finished:
+		return errors.New("Error: Stream already closed.")
+	default:
+	}
+
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
@@ -179,34 +218,34 @@ func (s *RequestStream) ReceiveFrame(frame common.Frame) error {
 
 		// Give to the client.
 		s.flow.Receive(frame.Data)
-		s.headerChan <- func() {
+		s.queue(func() {
 			s.Receiver.ReceiveData(s.Request, data, frame.Flags.FIN())
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
 				s.Close()
 			}
-		}
+		})
 
 	case *frames.SYN_REPLY:
-		s.headerChan <- func() {
+		s.queue(func() {
 			s.Receiver.ReceiveHeader(s.Request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
 				s.Close()
 			}
-		}
+		})
 
 	case *frames.HEADERS:
-		s.headerChan <- func() {
+		s.queue(func() {
 			s.Receiver.ReceiveHeader(s.Request, frame.Header)
 
 			if frame.Flags.FIN() {
 				s.state.CloseThere()
 				s.Close()
 			}
-		}
+		})
 
 	case *frames.WINDOW_UPDATE:
 		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
@@ -235,6 +274,14 @@ func (s *RequestStream) CloseNotify() <-chan bool {
 func (s *RequestStream) Run() error {
 	// Receive and process inbound frames.
 	<-s.finished
+	<-s.processed
+
+	s.Lock()
+	refused := s.refused
+	s.Unlock()
+	if refused {
+		return common.ErrStreamRefused
+	}
 
 	// Make sure any queued data has been sent.
 	if s.flow.Paused() {
@@ -246,6 +293,15 @@ func (s *RequestStream) Run() error {
 	return nil
 }
 
+// refuse closes the stream after the server
+// has refused it with REFUSED_STREAM.
+func (s *RequestStream) refuse() {
+	s.Lock()
+	s.refused = true
+	s.Unlock()
+	go s.Close()
+}
+
 func (s *RequestStream) State() *common.StreamState {
 	return s.state
 }
@@ -254,6 +310,27 @@ func (s *RequestStream) StreamID() common.StreamID {
 	return s.streamID
 }
 
+// SetBandwidth limits the data sent on the stream to
+// rate bytes per second. A rate of zero means no limit,
+// other than any limit on the connection.
+func (s *RequestStream) SetBandwidth(rate int64) {
+	s.bandwidth.SetRate(rate)
+}
+
+// Stats returns a description of the stream,
+// including its transfer windows.
+func (s *RequestStream) Stats() common.StreamStats {
+	stats := common.StreamStats{
+		StreamID: s.streamID,
+		State:    s.state.Status(),
+		Priority: s.priority,
+	}
+	if s.flow != nil {
+		s.flow.stats(&stats)
+	}
+	return stats
+}
+
 func (s *RequestStream) closed() bool {
 	if s.conn == nil || s.state == nil || s.Receiver == nil {
 		return true
@@ -288,8 +365,18 @@ func (s *RequestStream) writeHeader() {
 	s.output <- header
 }
 
+// queue is used to pass received frames to the
+// processing goroutine, unless the stream closes.
+func (s *RequestStream) queue(f func()) {
+	select {
+	case s.headerChan <- f:
+	case <-s.finished:
+	}
+}
+
 func (s *RequestStream) processFrames() {
 	defer common.Recover()
+	defer close(s.processed)
 	for f := range s.headerChan {
 		f()
 	}
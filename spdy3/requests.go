@@ -87,22 +87,51 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 			total += n
 		}
 
-		// Half-close the stream.
+		// Half-close the stream. If there is a body,
+		// the stream is closed once it has been sent.
 		if len(body) == 0 {
 			syn.Flags = common.FLAG_FIN
 		} else {
 			syn.Header.Set("Content-Length", fmt.Sprint(total))
-			body[len(body)-1].Flags = common.FLAG_FIN
 		}
 		request.Body.Close()
 	} else {
 		syn.Flags = common.FLAG_FIN
 	}
 
+	// Prepare the request trailers, if any,
+	// which close the stream instead.
+	var trailer *frames.HEADERS
+	for name, values := range request.Trailer {
+		if len(values) == 0 {
+			continue
+		}
+		if trailer == nil {
+			trailer = new(frames.HEADERS)
+			trailer.Flags = common.FLAG_FIN
+			trailer.Header = make(http.Header)
+		}
+		trailer.Header[name] = values
+	}
+	if trailer != nil {
+		common.DeclareTrailer(syn.Header, trailer.Header)
+		syn.Flags &^= common.FLAG_FIN
+	}
+
 	// Send.
 	c.streamCreation.Lock()
 	defer c.streamCreation.Unlock()
 
+	// Send any CREDENTIAL needed for the request's origin.
+	slot, credential, err := c.requestCredential(url.Scheme + "://" + host)
+	if err != nil {
+		return nil, err
+	}
+	if credential != nil {
+		c.output[0] <- credential
+	}
+	syn.Slot = slot
+
 	c.lastRequestStreamIDLock.Lock()
 	if c.lastRequestStreamID == 0 {
 		c.lastRequestStreamID = 1
@@ -115,19 +144,25 @@ func (c *Conn) Request(request *http.Request, receiver common.Receiver, priority
 		return nil, errors.New("Error: All client streams exhausted.")
 	}
 	c.output[0] <- syn
-	for _, frame := range body {
-		frame.StreamID = syn.StreamID
-		c.output[0] <- frame
-	}
 
 	// Create the request stream.
 	out := NewRequestStream(c, syn.StreamID, c.output[0])
+	out.priority = syn.Priority
 	out.Request = request
 	out.Receiver = receiver
 	out.AddFlowControl(c.flowControl)
+	if syn.Flags.FIN() {
+		out.state.CloseHere()
+	}
 	c.streamsLock.Lock()
 	c.streams[syn.StreamID] = out // Store in the connection map.
 	c.streamsLock.Unlock()
+	c.streamsChanged()
+
+	// Send the body, abiding by flow control.
+	if len(body) > 0 || trailer != nil {
+		go out.sendBody(body, trailer)
+	}
 
 	return out, nil
 }
@@ -142,7 +177,9 @@ func (c *Conn) RequestResponse(request *http.Request, receiver common.Receiver,
 	}
 
 	// Let the request run its course.
-	stream.Run()
+	if err := stream.Run(); err == common.ErrStreamRefused {
+		return nil, err
+	}
 
 	return res.Response(), c.shutdownError
 }
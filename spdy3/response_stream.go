@@ -5,12 +5,17 @@
 package spdy3
 
 import (
-	"bytes"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/SlyMarbo/spdy/common"
 	"github.com/SlyMarbo/spdy/spdy3/frames"
@@ -26,7 +31,7 @@ type ResponseStream struct {
 	conn           *Conn
 	streamID       common.StreamID
 	flow           *flowControl
-	requestBody    *bytes.Buffer
+	requestBody    *common.Pipe
 	state          *common.StreamState
 	output         chan<- common.Frame
 	request        *http.Request
@@ -35,9 +40,20 @@ type ResponseStream struct {
 	priority       common.Priority
 	unidirectional bool
 	responseCode   int
+	trailers       []string // trailer names declared in the response headers.
 	stop           chan bool
-	ready          chan struct{}
+	closeNotify    chan bool               // closed when the stream is closed or reset.
+	notifyOnce     sync.Once               // closes closeNotify.
+	pushes         sync.WaitGroup          // pushes being served by the handler.
+	deadlineLock   sync.Mutex              // protects the deadline timers, timedOut, cancelled and finished.
+	readTimer      *time.Timer             // fires at the read deadline.
+	writeTimer     *time.Timer             // fires at the write deadline.
+	timedOut       bool                    // whether the write deadline has passed.
+	cancelled      bool                    // whether a deadline has reset the stream.
+	finished       bool                    // whether Run has finished with the stream.
+	record         *common.AccessLogRecord // details of the stream for the access log.
 	wroteHeader    bool
+	bandwidth      *common.RateLimiter // limit on data sent on the stream.
 }
 
 func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- common.Frame, handler http.Handler, request *http.Request) *ResponseStream {
@@ -52,18 +68,40 @@ func NewResponseStream(conn *Conn, frame *frames.SYN_STREAM, output chan<- commo
 	out.request = request
 	out.priority = frame.Priority
 	out.stop = conn.stop
+	out.bandwidth = common.NewRateLimiter(conn.StreamBandwidth)
+	out.closeNotify = make(chan bool)
 	out.unidirectional = frame.Flags.UNIDIRECTIONAL()
-	out.requestBody = new(bytes.Buffer)
+	out.requestBody = common.NewPipe(out.consumed)
 	out.state = new(common.StreamState)
 	out.header = make(http.Header)
 	out.responseCode = 0
-	out.ready = make(chan struct{})
 	out.wroteHeader = false
+	out.record = conn.accessLogRecord(common.AccessLogEntry{
+		Method:    request.Method,
+		Host:      request.Host,
+		Path:      request.RequestURI,
+		Proto:     request.Proto,
+		Referer:   request.Referer(),
+		UserAgent: request.UserAgent(),
+		StreamID:  frame.StreamID,
+		Priority:  frame.Priority,
+	})
 	if frame.Flags.FIN() {
-		close(out.ready)
+		out.requestBody.CloseWithError(io.EOF)
 		out.state.CloseThere()
+		out.request.Body = http.NoBody
+	} else {
+		out.request.Body = out.requestBody
+
+		// The declared trailers are known up front. Their
+		// values are filled in by the handler's goroutine
+		// once it reads the body to EOF.
+		out.request.Trailer = make(http.Header)
+		for _, key := range common.TrailerKeys(request.Header) {
+			out.request.Trailer[key] = nil
+		}
+		out.requestBody.SetTrailer(out.request.Trailer)
 	}
-	out.request.Body = &common.ReadCloser{out.requestBody}
 	return out
 }
 
@@ -81,6 +119,10 @@ func (s *ResponseStream) Write(inputData []byte) (int, error) {
 		return 0, errors.New("Error: Stream is unidirectional.")
 	}
 
+	if s.writeTimedOut() {
+		return 0, &common.TimeoutError{Op: "writing response"}
+	}
+
 	if s.closed() || s.state.ClosedHere() {
 		return 0, errors.New("Error: Stream already closed.")
 	}
@@ -101,19 +143,25 @@ func (s *ResponseStream) Write(inputData []byte) (int, error) {
 	// Data is sent to the flow control to
 	// ensure that the protocol is followed.
 	written := 0
-	for len(data) > common.MAX_DATA_SIZE {
-		n, err := s.flow.Write(data[:common.MAX_DATA_SIZE])
+	max := s.conn.maxDataSize()
+	for len(data) > max {
+		n, err := s.flow.Write(data[:max])
+		s.record.BytesOut(n)
 		if err != nil {
-			return written, err
+			return written, s.writeError(err)
 		}
 		written += n
-		data = data[common.MAX_DATA_SIZE:]
+		data = data[max:]
 	}
 
 	n, err := s.flow.Write(data)
+	s.record.BytesOut(n)
 	written += n
+	if err != nil {
+		return written, s.writeError(err)
+	}
 
-	return written, err
+	return written, nil
 }
 
 // WriteHeader is used to set the HTTP status code.
@@ -130,16 +178,29 @@ func (s *ResponseStream) WriteHeader(code int) {
 
 	s.wroteHeader = true
 	s.responseCode = code
+	s.record.Status(code)
+
+	// These responses have no body, so nothing is pushed.
+	if code != 204 && code != 304 && code/100 != 1 {
+		s.pushPreloads()
+	}
 	s.header.Set(":status", strconv.Itoa(code))
 	s.header.Set(":version", "HTTP/1.1")
 
+	s.trailers = common.TrailerKeys(s.header)
+
 	// Create the response SYN_REPLY.
 	synReply := new(frames.SYN_REPLY)
 	synReply.StreamID = s.streamID
 	synReply.Header = make(http.Header)
 
 	// Clear the headers that have been sent.
+	// Trailers are held back until the end
+	// of the response.
 	for name, values := range s.header {
+		if common.IsTrailer(name, s.trailers) {
+			continue
+		}
 		for _, value := range values {
 			synReply.Header.Add(name, value)
 		}
@@ -155,6 +216,324 @@ func (s *ResponseStream) WriteHeader(code int) {
 	s.output <- synReply
 }
 
+/****************
+ * http.Flusher *
+ ****************/
+
+// Flush sends any buffered headers, along with as
+// much buffered data as the transfer window allows.
+func (s *ResponseStream) Flush() {
+	if s.unidirectional || s.closed() || s.state.ClosedHere() {
+		return
+	}
+
+	// Default to 200 response.
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+
+	s.writeHeader()
+
+	s.flow.Lock()
+	s.flow.Flush()
+	s.flow.Unlock()
+}
+
+/***************
+ * http.Pusher *
+ ***************/
+
+// Push implements http.Pusher. The target, which is
+// either an absolute URL or an absolute path, is pushed
+// to the client. The pushed response is produced by
+// calling the handler with a synthetic request, using
+// the method and headers in opts.
+func (s *ResponseStream) Push(target string, opts *http.PushOptions) error {
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	if method != "GET" && method != "HEAD" {
+		return errors.New("Error: Pushed requests must use GET or HEAD.")
+	}
+
+	if strings.HasPrefix(target, "/") {
+		target = s.request.URL.Scheme + "://" + s.request.Host + target
+	}
+
+	header := make(http.Header)
+	for name, values := range opts.Header {
+		header[name] = append([]string(nil), values...)
+	}
+
+	push, err := s.conn.push(target, s, method, header)
+	if err != nil {
+		return err
+	}
+
+	url, err := url.Parse(target)
+	if err != nil {
+		push.Close()
+		return err
+	}
+
+	request := &http.Request{
+		Method:     method,
+		URL:        url,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		RemoteAddr: s.request.RemoteAddr,
+		Header:     header,
+		Body:       http.NoBody,
+		Host:       url.Host,
+		RequestURI: url.RequestURI(),
+		TLS:        s.request.TLS,
+	}
+
+	s.pushes.Add(1)
+	go func() {
+		defer s.pushes.Done()
+		push.serve(s.handler, request)
+	}()
+	return nil
+}
+
+// pushPreloads pushes the same-origin resources named in
+// the response's preload links, if enabled on the
+// connection. Each resource is pushed at most once per
+// connection.
+func (s *ResponseStream) pushPreloads() {
+	if !s.conn.PushPreloads {
+		return
+	}
+
+	base := s.request.URL
+	for _, target := range common.PreloadLinks(s.header) {
+		ref, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		u := base.ResolveReference(ref)
+		u.Fragment = ""
+		if u.Scheme != base.Scheme || !strings.EqualFold(u.Host, base.Host) {
+			continue
+		}
+		if !s.conn.preload(u.String()) {
+			continue
+		}
+		if err := s.Push(u.String(), nil); err != nil {
+			debug.Printf("Failed to push preload %q: %v\n", u, err)
+			s.conn.preloadFailed(u.String())
+		}
+	}
+}
+
+/*************
+ * Deadlines *
+ *************/
+
+// SetReadDeadline sets the deadline for receiving the
+// request body, as with http.ResponseController. If the
+// body has not been received by the deadline, reads
+// return a timeout error and the stream is reset. Other
+// streams on the connection are unaffected. A zero value
+// means no deadline.
+func (s *ResponseStream) SetReadDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	if s.readTimer != nil {
+		s.readTimer.Stop()
+		s.readTimer = nil
+	}
+	if !t.IsZero() {
+		s.readTimer = time.AfterFunc(time.Until(t), s.readTimeout)
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for sending the
+// response, as with http.ResponseController. If the
+// response has not been sent by the deadline, writes
+// return a timeout error and the stream is reset. Other
+// streams on the connection are unaffected. A zero value
+// means no deadline.
+func (s *ResponseStream) SetWriteDeadline(t time.Time) error {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	if s.writeTimer != nil {
+		s.writeTimer.Stop()
+		s.writeTimer = nil
+	}
+	if !t.IsZero() {
+		s.writeTimer = time.AfterFunc(time.Until(t), s.writeTimeout)
+	}
+	return nil
+}
+
+// readTimeout is called when the read deadline passes.
+func (s *ResponseStream) readTimeout() {
+	if s.state.ClosedThere() {
+		return
+	}
+	debug.Printf("Read deadline exceeded on stream %d.\n", s.streamID)
+	s.cancel(&common.TimeoutError{Op: "reading request body"})
+}
+
+// writeTimeout is called when the write deadline passes.
+func (s *ResponseStream) writeTimeout() {
+	if s.state.ClosedHere() {
+		return
+	}
+	debug.Printf("Write deadline exceeded on stream %d.\n", s.streamID)
+	s.deadlineLock.Lock()
+	s.timedOut = true
+	s.deadlineLock.Unlock()
+	s.cancel(errors.New("Error: Stream closed."))
+}
+
+// cancel resets the stream once a deadline has passed,
+// ending the request body with err and waking any blocked
+// writes. As it is called by the deadline timers, while
+// the handler may still be using the stream's headers, the
+// stream is closed by Run once the handler has returned,
+// unless Run has finished already.
+func (s *ResponseStream) cancel(err error) {
+	s.deadlineLock.Lock()
+	cancelled, finished := s.cancelled, s.finished
+	s.cancelled = true
+	s.deadlineLock.Unlock()
+	if cancelled {
+		return
+	}
+
+	s.record.Reset(common.RST_STREAM_CANCEL)
+	if !s.state.Closed() {
+		rst := new(frames.RST_STREAM)
+		rst.StreamID = s.streamID
+		rst.Status = common.RST_STREAM_CANCEL
+		s.output <- rst
+	}
+	s.state.Close()
+	s.requestBody.CloseWithError(err)
+	if s.flow != nil {
+		s.flow.Close()
+	}
+	s.notifyClosed()
+
+	if finished {
+		s.Close()
+	}
+}
+
+// finish records that Run has finished with the
+// stream, returning whether a deadline has reset
+// it, in which case Run must close the stream.
+func (s *ResponseStream) finish() bool {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	s.finished = true
+	return s.cancelled
+}
+
+// notifyClosed closes the CloseNotify channel.
+func (s *ResponseStream) notifyClosed() {
+	s.notifyOnce.Do(func() {
+		close(s.closeNotify)
+	})
+}
+
+// deadlineCancelled returns whether a deadline
+// has reset the stream.
+func (s *ResponseStream) deadlineCancelled() bool {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	return s.cancelled
+}
+
+func (s *ResponseStream) writeTimedOut() bool {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	return s.timedOut
+}
+
+// writeError returns the error reported by a failed
+// write, which is a timeout if the write deadline has
+// passed while the write was blocked.
+func (s *ResponseStream) writeError(err error) error {
+	if s.writeTimedOut() {
+		return &common.TimeoutError{Op: "writing response"}
+	}
+	return err
+}
+
+// stopTimers stops any deadline timers.
+func (s *ResponseStream) stopTimers() {
+	s.deadlineLock.Lock()
+	if s.readTimer != nil {
+		s.readTimer.Stop()
+	}
+	if s.writeTimer != nil {
+		s.writeTimer.Stop()
+	}
+	s.deadlineLock.Unlock()
+}
+
+// reset ends the stream with RST_STREAM, leaving the
+// rest of the connection unaffected.
+func (s *ResponseStream) reset(status common.StatusCode) {
+	s.record.Reset(status)
+	if !s.state.Closed() {
+		rst := new(frames.RST_STREAM)
+		rst.StreamID = s.streamID
+		rst.Status = status
+		s.output <- rst
+	}
+	s.state.Close()
+	s.Close()
+}
+
+// startHandler is called before the handler is started,
+// returning whether it may start. If the connection's or
+// server's handler limit has been reached, the stream is
+// refused if the connection refuses streams, or waits in
+// priority order until the stream is closed.
+func (s *ResponseStream) startHandler() bool {
+	conn, server := s.conn.handlers, s.conn.Handlers
+	if s.conn.RefuseStreams {
+		if !conn.Add() {
+			s.reset(common.RST_STREAM_REFUSED_STREAM)
+			return false
+		}
+		if !server.Add() {
+			conn.Close()
+			s.reset(common.RST_STREAM_REFUSED_STREAM)
+			return false
+		}
+		return true
+	}
+
+	if !conn.Wait(s.priority, s.closeNotify) {
+		return false
+	}
+	if !server.Wait(s.priority, s.closeNotify) {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// finishHandler is called once the handler has
+// returned, allowing the next handler to start.
+func (s *ResponseStream) finishHandler() {
+	s.conn.Handlers.Close()
+	s.conn.handlers.Close()
+}
+
 /*****************
  * io.Closer *
  *****************/
@@ -168,7 +547,9 @@ func (s *ResponseStream) Close() error {
 }
 
 func (s *ResponseStream) shutdown() {
-	s.writeHeader()
+	if !s.deadlineCancelled() {
+		s.writeHeader()
+	}
 	if s.state != nil {
 		s.state.Close()
 	}
@@ -176,17 +557,26 @@ func (s *ResponseStream) shutdown() {
 		s.flow.Close()
 	}
 	if s.requestBody != nil {
-		s.requestBody.Reset()
-		s.requestBody = nil
+		s.requestBody.CloseWithError(errors.New("Error: Stream closed."))
 	}
+	s.notifyClosed()
+	s.stopTimers()
 	s.conn.requestStreamLimit.Close()
-	s.request = nil
-	s.handler = nil
-	s.stop = nil
 
 	s.conn.streamsLock.Lock()
 	delete(s.conn.streams, s.streamID)
 	s.conn.streamsLock.Unlock()
+	s.conn.streamsChanged()
+
+	s.record.Finish()
+}
+
+// consumed is called as the handler reads the
+// request body, to regrow the transfer window.
+func (s *ResponseStream) consumed(n int) {
+	if s.flow != nil && !s.state.ClosedThere() {
+		s.flow.Consume(n)
+	}
 }
 
 /**********
@@ -208,29 +598,28 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	// Process the frame depending on its type.
 	switch frame := frame.(type) {
 	case *frames.DATA:
+		s.record.BytesIn(len(frame.Data))
 		s.requestBody.Write(frame.Data)
 		s.flow.Receive(frame.Data)
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.CloseWithError(io.EOF)
 			s.state.CloseThere()
 		}
 
 	case *frames.SYN_REPLY:
 		if frame.Flags.FIN() {
-			select {
-			case <-s.ready:
-			default:
-				close(s.ready)
-			}
+			s.requestBody.CloseWithError(io.EOF)
 			s.state.CloseThere()
 		}
 
 	case *frames.HEADERS:
-		return errors.New("Received unexpected HEADERS frame")
+		// Headers sent after the request
+		// are trailers.
+		s.requestBody.AddTrailer(frame.Header, frame.Flags.FIN())
+		if frame.Flags.FIN() {
+			s.requestBody.CloseWithError(io.EOF)
+			s.state.CloseThere()
+		}
 
 	case *frames.WINDOW_UPDATE:
 		err := s.flow.UpdateWindow(frame.DeltaWindowSize)
@@ -249,8 +638,11 @@ func (s *ResponseStream) ReceiveFrame(frame common.Frame) error {
 	return nil
 }
 
+// CloseNotify returns a channel which is closed when
+// the stream is closed, such as when it is reset by
+// the client or the connection ends.
 func (s *ResponseStream) CloseNotify() <-chan bool {
-	return s.stop
+	return s.closeNotify
 }
 
 // run is the main control path of
@@ -268,19 +660,36 @@ func (s *ResponseStream) Run() error {
 		}
 	}()
 
-	// Make sure Request is prepared.
-	if s.requestBody == nil || s.request.Body == nil {
-		s.requestBody = new(bytes.Buffer)
-		s.request.Body = &common.ReadCloser{s.requestBody}
+	// Wait for the connection's and server's
+	// handler limits to permit the handler.
+	if !s.startHandler() {
+		return nil
 	}
 
-	// Wait until the full request has been received.
-	<-s.ready
+	// Apply the server's timeouts to the stream.
+	if d := s.conn.server.ReadTimeout; d > 0 {
+		s.SetReadDeadline(time.Now().Add(d))
+	}
+	if d := s.conn.server.WriteTimeout; d > 0 {
+		s.SetWriteDeadline(time.Now().Add(d))
+	}
 
+	// The handler is started immediately, with
+	// the request body streamed as it arrives.
 	/***************
 	 *** HANDLER ***
 	 ***************/
-	s.handler.ServeHTTP(s, s.request)
+	ok := s.serveHTTP()
+	s.finishHandler()
+	if !ok {
+		return nil
+	}
+
+	// Discard any unread request body.
+	s.requestBody.Close()
+
+	// Pushes must be sent before the stream is closed.
+	s.pushes.Wait()
 
 	// Make sure any queued data has been sent.
 	if err := s.flow.Wait(); err != nil {
@@ -301,22 +710,39 @@ func (s *ResponseStream) Run() error {
 			}
 
 			h.Set(":status", "200")
+			s.record.Status(http.StatusOK)
 			h.Set(":version", "HTTP/1.1")
 
-			// Create the response SYN_REPLY.
+			// Create the response SYN_REPLY. As there is
+			// no body, any trailers are sent straight after
+			// the headers, so they are declared first.
+			trailer := common.SplitTrailer(h)
 			synReply := new(frames.SYN_REPLY)
-			synReply.Flags = common.FLAG_FIN
 			synReply.StreamID = s.streamID
-			synReply.Header = make(http.Header)
-
-			for name, values := range h {
-				for _, value := range values {
-					synReply.Header.Add(name, value)
-				}
-				h.Del(name)
+			synReply.Header = h.Clone()
+			if len(trailer) == 0 {
+				synReply.Flags = common.FLAG_FIN
 			}
 
 			s.output <- synReply
+
+			if len(trailer) > 0 {
+				// Send the trailers, closing the stream.
+				header := new(frames.HEADERS)
+				header.Flags = common.FLAG_FIN
+				header.StreamID = s.streamID
+				header.Header = trailer
+
+				s.output <- header
+			}
+		} else if s.state.OpenHere() && len(s.header) > 0 {
+			// Send any trailers, closing the stream.
+			header := new(frames.HEADERS)
+			header.Flags = common.FLAG_FIN
+			header.StreamID = s.streamID
+			header.Header = common.TakeTrailer(s.header)
+
+			s.output <- header
 		} else if s.state.OpenHere() {
 			// Create the DATA.
 			data := new(frames.DATA)
@@ -331,13 +757,77 @@ func (s *ResponseStream) Run() error {
 	// Clean up state.
 	s.state.CloseHere()
 
-	if s.state.Closed() {
+	if s.finish() || s.state.Closed() {
 		return s.Close()
 	}
 
 	return nil
 }
 
+// serveHTTP calls the handler, recovering any panic so
+// that other streams on the connection are unaffected.
+// If the handler panics, the stream is ended and false
+// is returned.
+func (s *ResponseStream) serveHTTP() (ok bool) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		ok = false
+		if v != http.ErrAbortHandler {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			s.conn.logf("spdy: panic serving stream %d for %s: %v\n%s", s.streamID, s.conn.remoteAddr, v, buf)
+		}
+		s.abort(v != http.ErrAbortHandler)
+	}()
+
+	s.handler.ServeHTTP(s, s.request)
+	return true
+}
+
+// abort ends the stream after the handler has panicked.
+// If no headers have been sent and reply is true, the
+// stream is closed with a 500 response. Otherwise, it
+// is reset with INTERNAL_ERROR.
+func (s *ResponseStream) abort(reply bool) {
+	// Any headers set by the handler are discarded.
+	s.Lock()
+	wroteHeader := s.wroteHeader
+	s.header = make(http.Header)
+	s.Unlock()
+
+	// Discard any data still queued.
+	if s.flow != nil {
+		s.flow.Close()
+	}
+
+	if s.state.OpenHere() && !s.unidirectional {
+		if reply && !wroteHeader {
+			s.record.Status(http.StatusInternalServerError)
+			synReply := new(frames.SYN_REPLY)
+			synReply.Flags = common.FLAG_FIN
+			synReply.StreamID = s.streamID
+			synReply.Header = make(http.Header)
+			synReply.Header.Set(":status", "500")
+			synReply.Header.Set(":version", "HTTP/1.1")
+
+			s.output <- synReply
+		} else {
+			rst := new(frames.RST_STREAM)
+			rst.StreamID = s.streamID
+			rst.Status = common.RST_STREAM_INTERNAL_ERROR
+			s.record.Reset(rst.Status)
+
+			s.output <- rst
+		}
+	}
+
+	s.state.Close()
+	s.Close()
+}
+
 func (s *ResponseStream) State() *common.StreamState {
 	return s.state
 }
@@ -346,8 +836,29 @@ func (s *ResponseStream) StreamID() common.StreamID {
 	return s.streamID
 }
 
+// SetBandwidth limits the data sent on the stream to
+// rate bytes per second. A rate of zero means no limit,
+// other than any limit on the connection.
+func (s *ResponseStream) SetBandwidth(rate int64) {
+	s.bandwidth.SetRate(rate)
+}
+
+// Stats returns a description of the stream,
+// including its transfer windows.
+func (s *ResponseStream) Stats() common.StreamStats {
+	stats := common.StreamStats{
+		StreamID: s.streamID,
+		State:    s.state.Status(),
+		Priority: s.priority,
+	}
+	if s.flow != nil {
+		s.flow.stats(&stats)
+	}
+	return stats
+}
+
 func (s *ResponseStream) closed() bool {
-	if s.conn == nil || s.state == nil || s.handler == nil {
+	if s.conn == nil || s.state == nil || s.state.Closed() {
 		return true
 	}
 	select {
@@ -371,12 +882,19 @@ func (s *ResponseStream) writeHeader() {
 
 	// Clear the headers that have been sent.
 	for name, values := range s.header {
+		if common.IsTrailer(name, s.trailers) {
+			continue
+		}
 		for _, value := range values {
 			header.Header.Add(name, value)
 		}
 		s.header.Del(name)
 	}
 
+	if len(header.Header) == 0 {
+		return
+	}
+
 	s.output <- header
 }
 
@@ -387,3 +905,18 @@ func (s *ResponseStream) writeHeader() {
 func (s *ResponseStream) Priority() common.Priority {
 	return s.priority
 }
+
+/********************
+ * CredentialStream *
+ ********************/
+
+// Credentials returns the client certificates for the
+// stream. These are from the CREDENTIAL for the slot
+// given in the stream's SYN_STREAM, or from the TLS
+// handshake if no slot was given.
+func (s *ResponseStream) Credentials() []*x509.Certificate {
+	if s.request == nil || s.request.TLS == nil {
+		return nil
+	}
+	return s.request.TLS.PeerCertificates
+}
@@ -9,13 +9,13 @@ import (
 )
 
 // defaultServerSettings are used in initialising the connection.
-// It takes the max concurrent streams.
-func defaultServerSettings(m uint32) common.Settings {
+// It takes the max concurrent streams and the initial window size.
+func defaultServerSettings(m, window uint32) common.Settings {
 	return common.Settings{
 		common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{
 			Flags: common.FLAG_SETTINGS_PERSIST_VALUE,
 			ID:    common.SETTINGS_INITIAL_WINDOW_SIZE,
-			Value: common.DEFAULT_INITIAL_WINDOW_SIZE,
+			Value: window,
 		},
 		common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
 			Flags: common.FLAG_SETTINGS_PERSIST_VALUE,
@@ -26,12 +26,12 @@ func defaultServerSettings(m uint32) common.Settings {
 }
 
 // defaultClientSettings are used in initialising the connection.
-// It takes the max concurrent streams.
-func defaultClientSettings(m uint32) common.Settings {
+// It takes the max concurrent streams and the initial window size.
+func defaultClientSettings(m, window uint32) common.Settings {
 	return common.Settings{
 		common.SETTINGS_INITIAL_WINDOW_SIZE: &common.Setting{
 			ID:    common.SETTINGS_INITIAL_WINDOW_SIZE,
-			Value: common.DEFAULT_INITIAL_CLIENT_WINDOW_SIZE,
+			Value: window,
 		},
 		common.SETTINGS_MAX_CONCURRENT_STREAMS: &common.Setting{
 			ID:    common.SETTINGS_MAX_CONCURRENT_STREAMS,
@@ -5,18 +5,21 @@
 package spdy
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/SlyMarbo/spdy/common"
+	"github.com/SlyMarbo/spdy/spdy2"
+	"github.com/SlyMarbo/spdy/spdy3"
 )
 
 // A Transport is an HTTP/SPDY http.RoundTripper.
@@ -32,7 +35,7 @@ type Transport struct {
 	// Dial specifies the dial function for creating TCP
 	// connections.
 	// If Dial is nil, net.Dial is used.
-	Dial func(network, addr string) (net.Conn, error) // TODO: use
+	Dial func(network, addr string) (net.Conn, error)
 
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
@@ -54,7 +57,8 @@ type Transport struct {
 
 	// MaxIdleConnsPerHost, if non-zero, controls the maximum idle
 	// (keep-alive) to keep per-host.  If zero,
-	// DefaultMaxIdleConnsPerHost is used.
+	// DefaultMaxIdleConnsPerHost is used. This also limits the
+	// number of connections open to each host at once.
 	MaxIdleConnsPerHost int
 
 	// ResponseHeaderTimeout, if non-zero, specifies the amount of
@@ -63,9 +67,28 @@ type Transport struct {
 	// time does not include the time to read the response body.
 	ResponseHeaderTimeout time.Duration
 
+	// RequestTimeout, if non-zero, specifies the maximum amount
+	// of time a single request may take, from when RoundTrip is
+	// called to when the response has been received. For SPDY,
+	// this includes the response body. For HTTP, the deadline
+	// continues to apply while the body is read. Any deadline
+	// set on the Request's context is also honoured.
+	RequestTimeout time.Duration
+
+	// IdleConnTimeout, if non-zero, specifies the maximum amount
+	// of time an idle HTTP connection will remain idle before
+	// closing itself. If zero, idle connections are kept until
+	// the server closes them or CloseIdleConnections is called.
+	IdleConnTimeout time.Duration
+
 	spdyConns map[string]common.Conn   // SPDY connections mapped to host:port.
-	tcpConns  map[string]chan net.Conn // Non-SPDY connections mapped to host:port.
 	connLimit map[string]chan struct{} // Used to enforce the TCP conn limit.
+	dialing   map[string]chan struct{} // Closed when a connection to host:port has been made.
+	coalesced map[string]bool          // Hosts whose SPDY connection was made to another host.
+
+	idleM     sync.Mutex
+	idleConns map[string][]*httpConn   // Idle HTTP connections mapped to host:port.
+	idleReady map[string]chan struct{} // Signals that an idle connection is available.
 
 	// Priority is used to determine the request priority of SPDY
 	// requests. If nil, spdy.DefaultPriority is used.
@@ -81,6 +104,75 @@ type Transport struct {
 	// sent with the server push. See Receiver for more detail on
 	// its methods.
 	PushReceiver common.Receiver
+
+	// PushCache, if non-nil, is used to store server pushes and
+	// to serve later requests for the pushed resources. If
+	// PushReceiver is also set, pushes are passed to both.
+	PushCache *PushCache
+
+	// PriorKnowledge maps hosts to the version of SPDY they are
+	// known to speak. Connections to these hosts use SPDY from
+	// the outset, without NPN, over plain TCP for http URLs and
+	// TLS for https URLs. Hosts may be given as "host:port" or
+	// "host", and the key "*" matches all hosts. This is used
+	// with servers like those run by ListenAndServeSPDYNoNPN.
+	PriorKnowledge map[string]KnownVersion
+
+	// ClientCredentials, if non-nil, selects the client certificate
+	// to present to each origin, given as "scheme://host". With
+	// SPDY/3, the certificate is sent in a CREDENTIAL frame, so each
+	// origin sharing a connection can use its own certificate. If
+	// it returns a nil certificate, the certificate from the TLS
+	// handshake is used, if any. See spdy3.Conn.ClientCredentials.
+	ClientCredentials func(origin string) (*tls.Certificate, error)
+
+	// Coalesce, if true, allows a SPDY connection made to one
+	// host to be used for requests to another host, provided
+	// the connection uses TLS, the certificate presented by the
+	// server covers the other host, and the other host resolves
+	// to the address the connection was made to. Servers can
+	// reject requests for hosts they do not serve with 421
+	// Misdirected Request, in which case requests without a
+	// body are retried on a new connection to the host; see
+	// Server.ValidateOrigins.
+	Coalesce bool
+
+	// NewScheduler, if non-nil, returns the Scheduler used to
+	// order the frames sent on each SPDY connection. If nil,
+	// each connection uses common.NewWeightedScheduler.
+	NewScheduler func() common.Scheduler
+
+	// MaxDataSize, if non-zero, is the maximum payload of each
+	// DATA frame sent on SPDY connections. The default is
+	// common.DEFAULT_MAX_DATA_SIZE.
+	MaxDataSize int
+
+	// MaxBufferedData, if non-zero, is the maximum data each
+	// stream buffers while waiting for flow control, before
+	// writes block. The default is
+	// common.DEFAULT_MAX_BUFFERED_DATA.
+	MaxBufferedData int
+
+	// NewFlowControl, if non-nil, returns the FlowControl used
+	// by each connection using SPDY/3 or later. If nil, each
+	// connection uses spdy3.DefaultFlowControl.
+	NewFlowControl func() common.FlowControl
+
+	// Bandwidth, if non-zero, limits the data sent on each SPDY
+	// connection to that many bytes per second. StreamBandwidth,
+	// if non-zero, similarly limits each stream. If PeerBandwidth
+	// is true, each connection is also limited to the server's
+	// SETTINGS_DOWNLOAD_BANDWIDTH, if sent.
+	Bandwidth       int64
+	StreamBandwidth int64
+	PeerBandwidth   bool
+}
+
+// KnownVersion is a version of SPDY which a server is known
+// to speak. See Transport.PriorKnowledge.
+type KnownVersion struct {
+	Version    int // SPDY version, such as 3.
+	Subversion int // SPDY subversion, such as 1 for SPDY/3.1.
 }
 
 // NewTransport gives a simple initialised Transport.
@@ -93,9 +185,11 @@ func NewTransport(insecureSkipVerify bool) *Transport {
 	}
 }
 
-// dial makes the connection to an endpoint.
-func (t *Transport) dial(u *url.URL) (conn net.Conn, err error) {
+// dial makes the connection to an endpoint. TLS connections
+// only offer NPN if negotiate is true.
+func (t *Transport) dial(u *url.URL, negotiate bool) (net.Conn, error) {
 
+	t.m.Lock()
 	if t.TLSClientConfig == nil {
 		t.TLSClientConfig = &tls.Config{
 			NextProtos: npn(),
@@ -103,51 +197,162 @@ func (t *Transport) dial(u *url.URL) (conn net.Conn, err error) {
 	} else if t.TLSClientConfig.NextProtos == nil {
 		t.TLSClientConfig.NextProtos = npn()
 	}
-
-	// Wait for a connection slot to become available.
-	<-t.connLimit[u.Host]
+	t.m.Unlock()
 
 	switch u.Scheme {
 	case "http":
-		conn, err = net.Dial("tcp", u.Host)
+		return t.dialTCP(u.Host)
+
 	case "https":
-		conn, err = tls.Dial("tcp", u.Host, t.TLSClientConfig)
+		conn, err := t.dialTCP(u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		config := t.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(u.Host); err == nil {
+				config.ServerName = host
+			} else {
+				config.ServerName = u.Host
+			}
+		}
+		if !negotiate {
+			config.NextProtos = nil
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+
 	default:
-		err = errors.New(fmt.Sprintf("Error: URL has invalid scheme %q.", u.Scheme))
+		return nil, errors.New(fmt.Sprintf("Error: URL has invalid scheme %q.", u.Scheme))
 	}
+}
 
-	if err != nil {
-		// The connection never happened, which frees up a slot.
-		t.connLimit[u.Host] <- struct{}{}
+// dialTCP makes a TCP connection, using the Transport's
+// Dial function if provided.
+func (t *Transport) dialTCP(addr string) (net.Conn, error) {
+	if t.Dial != nil {
+		return t.Dial("tcp", addr)
 	}
+	return net.Dial("tcp", addr)
+}
 
-	return conn, err
+// priorKnowledge returns the SPDY version the given URL's
+// host is known to speak, or nil if it must be negotiated.
+func (t *Transport) priorKnowledge(u *url.URL) *KnownVersion {
+	if t.PriorKnowledge == nil {
+		return nil
+	}
+	if v, ok := t.PriorKnowledge[u.Host]; ok {
+		return &v
+	}
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		if v, ok := t.PriorKnowledge[host]; ok {
+			return &v
+		}
+	}
+	if v, ok := t.PriorKnowledge["*"]; ok {
+		return &v
+	}
+	return nil
 }
 
-// doHTTP is used to process an HTTP(S) request, using the TCP connection pool.
-func (t *Transport) doHTTP(conn net.Conn, req *http.Request) (*http.Response, error) {
+// doHTTP is used to process an HTTP(S) request, using the HTTP connection pool.
+func (t *Transport) doHTTP(conn *httpConn, req *http.Request) (*http.Response, error) {
 	debug.Printf("Requesting %q over HTTP.\n", req.URL.String())
+	return conn.do(req)
+}
 
-	// Create the HTTP ClientConn, which handles the
-	// HTTP details.
-	httpConn := httputil.NewClientConn(conn, nil)
-	res, err := httpConn.Do(req)
+// doSPDY is used to process a SPDY request, enforcing any
+// timeouts set on the Transport or the request's context.
+// If a timeout expires, the stream is reset with CANCEL.
+func (t *Transport) doSPDY(conn common.Conn, req *http.Request) (*http.Response, error) {
+	debug.Printf("Requesting %q over SPDY.\n", req.URL.String())
+
+	// Determine the request priority.
+	var priority common.Priority
+	if t.Priority != nil {
+		priority = t.Priority(req.URL)
+	} else {
+		priority = common.DefaultPriority(req.URL)
+	}
+
+	// Without any deadlines, the connection can handle the details.
+	if t.ResponseHeaderTimeout == 0 && t.RequestTimeout == 0 && req.Context().Done() == nil {
+		return conn.RequestResponse(req, t.Receiver, priority)
+	}
+
+	ctx, cancel := t.requestContext(req)
+	defer cancel()
+
+	res := common.NewResponse(req, t.Receiver)
+	stream, err := conn.Request(req, res, priority)
 	if err != nil {
 		return nil, err
 	}
 
-	if !res.Close {
-		t.tcpConns[req.URL.Host] <- conn
-	} else {
-		// This connection is closing, so another can be used.
-		t.connLimit[req.URL.Host] <- struct{}{}
-		err = httpConn.Close()
-		if err != nil {
-			return nil, err
+	var runErr error
+	finished := make(chan struct{})
+	go func() {
+		runErr = stream.Run()
+		close(finished)
+	}()
+
+	// The request has now been sent, so the
+	// response header timeout begins.
+	var headerTimeout <-chan time.Time
+	if d := t.ResponseHeaderTimeout; d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		headerTimeout = timer.C
+	}
+
+	headerReceived := res.HeaderReceived()
+	for {
+		select {
+		case <-finished:
+			if runErr == common.ErrStreamRefused {
+				return nil, runErr
+			}
+			select {
+			case <-res.HeaderReceived():
+			default:
+				if conn.Closed() {
+					return nil, common.ErrConnClosed
+				}
+			}
+			return res.Response(), nil
+
+		case <-headerReceived:
+			headerReceived = nil
+			headerTimeout = nil
+
+		case <-headerTimeout:
+			stream.Close()
+			return nil, &common.TimeoutError{Op: "awaiting response headers", Limit: t.ResponseHeaderTimeout}
+
+		case <-ctx.Done():
+			stream.Close()
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, &common.TimeoutError{Op: "completing request", Limit: t.RequestTimeout}
+			}
+			return nil, ctx.Err()
 		}
 	}
+}
 
-	return res, nil
+// requestContext returns the request's context, with
+// the Transport's RequestTimeout applied.
+func (t *Transport) requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	if t.RequestTimeout > 0 {
+		return context.WithTimeout(req.Context(), t.RequestTimeout)
+	}
+	return context.WithCancel(req.Context())
 }
 
 // RoundTrip handles the actual request; ensuring a connection is
@@ -167,166 +372,431 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
-	conn, tcpConn, err := t.process(req)
-	if err != nil {
-		return nil, err
+	// Try the push cache.
+	if t.PushCache != nil {
+		if res := t.PushCache.Response(req); res != nil {
+			return res, nil
+		}
+	}
+
+	coalesce := true
+	for retried := false; ; retried = true {
+		conn, httpConn, err := t.process(req, coalesce)
+		if err != nil {
+			return nil, err
+		}
+		if httpConn == nil {
+			// A server may refuse requests for other hosts
+			// on a shared connection, so retry once on a
+			// connection to the host itself.
+			res, err := t.doSPDY(conn, req)
+			if err == nil && res.StatusCode == http.StatusMisdirectedRequest && !retried &&
+				(req.Body == nil || req.Body == http.NoBody) && t.misdirected(u, conn) {
+				debug.Printf("Retrying %q on a new connection after 421 response.\n", req.URL.String())
+				res.Body.Close()
+				coalesce = false
+				continue
+			}
+			return res, err
+		}
+
+		// The server may have closed an idle connection
+		// just as it was reused, so retry once on a new
+		// connection if it is safe to do so.
+		res, err := t.doHTTP(httpConn, req)
+		if err != nil && httpConn.reused && !retried && retryableHTTPError(req, err) {
+			debug.Printf("Retrying %q after error on reused connection: %v\n", req.URL.String(), err)
+			continue
+		}
+		return res, err
+	}
+}
+
+// pushReceiver returns the Receiver used for server
+// pushes on a new connection to the given URL.
+func (t *Transport) pushReceiver(u *url.URL) common.Receiver {
+	if t.PushCache == nil {
+		return t.PushReceiver
+	}
+	cache := t.PushCache.Receiver(u)
+	if t.PushReceiver == nil {
+		return cache
 	}
-	if tcpConn != nil {
-		return t.doHTTP(tcpConn, req)
+	return &pushReceivers{
+		receivers: []common.Receiver{cache, t.PushReceiver},
+		accepted:  make(map[*http.Request][]common.Receiver),
 	}
+}
 
-	// The connection has now been established.
+// maxIdleConnsPerHost returns the limit on connections
+// to each host.
+func (t *Transport) maxIdleConnsPerHost() int {
+	if t.MaxIdleConnsPerHost > 0 {
+		return t.MaxIdleConnsPerHost
+	}
+	return http.DefaultMaxIdleConnsPerHost
+}
 
-	debug.Printf("Requesting %q over SPDY.\n", u.String())
+// process returns the connection to use for the request,
+// making a new one if necessary. If coalesce is false, a
+// connection made to another host is not used. The
+// Transport's lock is not held while waiting for a
+// connection slot, resolving or dialling, so a busy host
+// does not delay requests to other hosts.
+func (t *Transport) process(req *http.Request, coalesce bool) (common.Conn, *httpConn, error) {
+	u := req.URL
+	ctx := req.Context()
+	known := t.priorKnowledge(u)
 
-	// Determine the request priority.
-	var priority common.Priority
-	if t.Priority != nil {
-		priority = t.Priority(req.URL)
-	} else {
-		priority = common.DefaultPriority(req.URL)
+	for {
+		t.m.Lock()
+
+		// Initialise structures if necessary.
+		if t.spdyConns == nil {
+			t.spdyConns = make(map[string]common.Conn)
+		}
+		if t.connLimit == nil {
+			t.connLimit = make(map[string]chan struct{})
+		}
+		if t.dialing == nil {
+			t.dialing = make(map[string]chan struct{})
+		}
+		if t.coalesced == nil {
+			t.coalesced = make(map[string]bool)
+		}
+		slots, ok := t.connLimit[u.Host]
+		if !ok {
+			limit := t.maxIdleConnsPerHost()
+			slots = make(chan struct{}, limit)
+			t.connLimit[u.Host] = slots
+			for i := 0; i < limit; i++ {
+				slots <- struct{}{}
+			}
+		}
+
+		// Check the non-SPDY connection pool.
+		if httpConn := t.getIdle(u.Host); httpConn != nil {
+			t.m.Unlock()
+			return nil, httpConn, nil
+		}
+
+		// Check the SPDY connection pool.
+		if conn := t.pooled(u, known, coalesce); conn != nil {
+			t.m.Unlock()
+			return conn, nil, nil
+		}
+
+		var candidates []common.Conn
+		if coalesce {
+			candidates = t.coalesceCandidates(u)
+		}
+		wait, isDialing := t.dialing[u.Host]
+		t.m.Unlock()
+
+		// Reuse a connection made to another host, if allowed.
+		if conn := t.coalesce(ctx, u, candidates); conn != nil {
+			t.m.Lock()
+			t.spdyConns[u.Host] = conn
+			t.coalesced[u.Host] = true
+			t.m.Unlock()
+			return conn, nil, nil
+		}
+
+		// If a connection to the host is already being made,
+		// wait to see whether it can be shared.
+		if isDialing {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+
+		// Wait for a connection slot to become available,
+		// or for a connection to be returned to the pool.
+		httpConn, err := t.waitForSlot(ctx, u.Host, slots)
+		if err != nil {
+			return nil, nil, err
+		}
+		if httpConn != nil {
+			return nil, httpConn, nil
+		}
+
+		// Another request may have made or started making
+		// a connection while we were waiting, so check
+		// again before dialling.
+		t.m.Lock()
+		if _, ok := t.dialing[u.Host]; ok || t.pooled(u, known, coalesce) != nil {
+			t.m.Unlock()
+			slots <- struct{}{}
+			continue
+		}
+		dialing := make(chan struct{})
+		t.dialing[u.Host] = dialing
+		t.m.Unlock()
+
+		conn, httpConn, err := t.connect(req, slots, known)
+
+		t.m.Lock()
+		delete(t.dialing, u.Host)
+		t.m.Unlock()
+		close(dialing)
+
+		return conn, httpConn, err
 	}
+}
 
-	res, err := conn.RequestResponse(req, t.Receiver, priority)
-	if conn.Closed() {
-		t.connLimit[u.Host] <- struct{}{}
+// pooled returns the pooled SPDY connection to u's host,
+// or nil if there is none. Plain TCP connections only
+// use SPDY with prior knowledge, and connections made to
+// another host are only used if coalesce is true. This
+// must be called with t.m held.
+func (t *Transport) pooled(u *url.URL, known *KnownVersion, coalesce bool) common.Conn {
+	if !coalesce && t.coalesced[u.Host] {
+		return nil
 	}
+	conn, ok := t.spdyConns[u.Host]
+	if ok && (u.Scheme != "http" || known != nil) && conn != nil && !conn.Closed() {
+		return conn
+	}
+	return nil
+}
+
+// connect makes a new connection for the request, using
+// a connection slot which has already been taken. If the
+// connection fails, the slot is freed.
+func (t *Transport) connect(req *http.Request, slots chan struct{}, known *KnownVersion) (common.Conn, *httpConn, error) {
+	tcpConn, err := t.dial(req.URL, known == nil)
 	if err != nil {
-		return nil, err
+		// The connection never happened, which frees up a slot.
+		slots <- struct{}{}
+		return nil, nil, err
+	}
+
+	conn, httpConn, err := t.setup(req, tcpConn, slots, known)
+	if err != nil {
+		tcpConn.Close()
+		slots <- struct{}{}
+		return nil, nil, err
 	}
 
-	return res, nil
+	return conn, httpConn, nil
 }
 
-func (t *Transport) process(req *http.Request) (common.Conn, net.Conn, error) {
-	t.m.Lock()
-	defer t.m.Unlock()
+// coalesceCandidates returns the existing SPDY connections
+// which could be used for requests to u's host, if the host
+// resolves to the address they are connected to. This must
+// be called with t.m held.
+func (t *Transport) coalesceCandidates(u *url.URL) []common.Conn {
+	if !t.Coalesce || u.Scheme != "https" || len(t.spdyConns) == 0 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil
+	}
 
-	u := req.URL
+	var candidates []common.Conn
+	for _, conn := range t.spdyConns {
+		if conn == nil || conn.Closed() {
+			continue
+		}
+		tlsConn, ok := conn.Conn().(*tls.Conn)
+		if !ok {
+			continue
+		}
 
-	// Initialise structures if necessary.
-	if t.spdyConns == nil {
-		t.spdyConns = make(map[string]common.Conn)
+		// The connection must be to the same port, and
+		// the server's certificate must cover the host.
+		remote, ok := tlsConn.RemoteAddr().(*net.TCPAddr)
+		if !ok || strconv.Itoa(remote.Port) != port {
+			continue
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) == 0 || certs[0].VerifyHostname(host) != nil {
+			continue
+		}
+		candidates = append(candidates, conn)
 	}
-	if t.tcpConns == nil {
-		t.tcpConns = make(map[string]chan net.Conn)
+
+	return candidates
+}
+
+// coalesce returns the first of the candidate connections
+// whose address u's host resolves to, or nil if there is
+// none. The host is resolved using the given context.
+func (t *Transport) coalesce(ctx context.Context, u *url.URL, candidates []common.Conn) common.Conn {
+	if len(candidates) == 0 {
+		return nil
 	}
-	if t.connLimit == nil {
-		t.connLimit = make(map[string]chan struct{})
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil
 	}
-	if t.MaxIdleConnsPerHost == 0 {
-		t.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		debug.Printf("Failed to resolve %q for coalescing: %v\n", host, err)
+		return nil
 	}
-	if _, ok := t.connLimit[u.Host]; !ok {
-		limitChan := make(chan struct{}, t.MaxIdleConnsPerHost)
-		t.connLimit[u.Host] = limitChan
-		for i := 0; i < t.MaxIdleConnsPerHost; i++ {
-			limitChan <- struct{}{}
+
+	for _, conn := range candidates {
+		if conn.Closed() {
+			continue
+		}
+		remote := conn.Conn().RemoteAddr().(*net.TCPAddr)
+		for _, addr := range addrs {
+			if addr.IP.Equal(remote.IP) {
+				return conn
+			}
 		}
 	}
 
-	// Check the non-SPDY connection pool.
-	if connChan, ok := t.tcpConns[u.Host]; ok {
-		select {
-		case tcpConn := <-connChan:
-			// Use a connection from the pool.
-			return nil, tcpConn, nil
-		default:
+	return nil
+}
+
+// misdirected is called when a request on the given SPDY
+// connection is answered with 421 Misdirected Request. If
+// the connection was made to another host, it is no longer
+// used for u's host, and true is returned, so the request
+// can be retried on a new connection.
+func (t *Transport) misdirected(u *url.URL, conn common.Conn) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if !t.coalesced[u.Host] || t.spdyConns[u.Host] != conn {
+		return false
+	}
+	delete(t.spdyConns, u.Host)
+	delete(t.coalesced, u.Host)
+	return true
+}
+
+// setup determines the protocol to use on a new connection,
+// returning either a running SPDY connection or an HTTP
+// connection. If known is non-nil, its version of SPDY is
+// used without negotiation.
+func (t *Transport) setup(req *http.Request, tcpConn net.Conn, slots chan struct{}, known *KnownVersion) (common.Conn, *httpConn, error) {
+	u := req.URL
+
+	tlsConn, ok := tcpConn.(*tls.Conn)
+	if !ok {
+		// Handle cleartext SPDY requests.
+		if known != nil {
+			return t.newSPDYConn(u, tcpConn, slots, known.Version, known.Subversion)
 		}
-	} else {
-		t.tcpConns[u.Host] = make(chan net.Conn, t.MaxIdleConnsPerHost)
+
+		// Handle HTTP requests.
+		return nil, newHTTPConn(t, u.Host, tcpConn, slots), nil
 	}
 
-	// Check the SPDY connection pool.
-	conn, ok := t.spdyConns[u.Host]
-	if !ok || u.Scheme == "http" || (conn != nil && conn.Closed()) {
-		tcpConn, err := t.dial(req.URL)
+	// Handle HTTPS/SPDY requests.
+	state := tlsConn.ConnectionState()
+
+	// Complete handshake if necessary.
+	if !state.HandshakeComplete {
+		err := tlsConn.Handshake()
 		if err != nil {
 			return nil, nil, err
 		}
+		state = tlsConn.ConnectionState()
+	}
 
-		if tlsConn, ok := tcpConn.(*tls.Conn); !ok {
-			// Handle HTTP requests.
-			return nil, tcpConn, nil
-		} else {
-			// Handle HTTPS/SPDY requests.
-			state := tlsConn.ConnectionState()
-
-			// Complete handshake if necessary.
-			if !state.HandshakeComplete {
-				err = tlsConn.Handshake()
-				if err != nil {
-					return nil, nil, err
-				}
+	// Verify hostname, unless requested not to.
+	if !t.TLSClientConfig.InsecureSkipVerify {
+		err := tlsConn.VerifyHostname(u.Host)
+		if err != nil {
+			// Also try verifying the hostname with/without a port number.
+			i := strings.Index(u.Host, ":")
+			err = tlsConn.VerifyHostname(u.Host[:i])
+			if err != nil {
+				return nil, nil, err
 			}
+		}
+	}
 
-			// Verify hostname, unless requested not to.
-			if !t.TLSClientConfig.InsecureSkipVerify {
-				err = tlsConn.VerifyHostname(req.URL.Host)
-				if err != nil {
-					// Also try verifying the hostname with/without a port number.
-					i := strings.Index(req.URL.Host, ":")
-					err = tlsConn.VerifyHostname(req.URL.Host[:i])
-					if err != nil {
-						return nil, nil, err
-					}
-				}
-			}
+	// Handle SPDY requests without negotiation.
+	if known != nil {
+		return t.newSPDYConn(u, tlsConn, slots, known.Version, known.Subversion)
+	}
 
-			// If a protocol could not be negotiated, assume HTTPS.
-			if !state.NegotiatedProtocolIsMutual {
-				return nil, tcpConn, nil
-			}
+	// If a protocol could not be negotiated, assume HTTPS.
+	if !state.NegotiatedProtocolIsMutual {
+		return nil, newHTTPConn(t, u.Host, tcpConn, slots), nil
+	}
 
-			// Scan the list of supported NPN strings.
-			supported := false
-			for _, proto := range npn() {
-				if state.NegotiatedProtocol == proto {
-					supported = true
-					break
-				}
-			}
+	// Scan the list of supported NPN strings.
+	supported := false
+	for _, proto := range npn() {
+		if state.NegotiatedProtocol == proto {
+			supported = true
+			break
+		}
+	}
 
-			// Ensure the negotiated protocol is supported.
-			if !supported && state.NegotiatedProtocol != "" {
-				msg := fmt.Sprintf("Error: Unsupported negotiated protocol %q.", state.NegotiatedProtocol)
-				return nil, nil, errors.New(msg)
-			}
+	// Ensure the negotiated protocol is supported.
+	if !supported && state.NegotiatedProtocol != "" {
+		msg := fmt.Sprintf("Error: Unsupported negotiated protocol %q.", state.NegotiatedProtocol)
+		return nil, nil, errors.New(msg)
+	}
 
-			// Handle the protocol.
-			switch state.NegotiatedProtocol {
-			case "http/1.1", "":
-				return nil, tcpConn, nil
+	// Handle the protocol.
+	var version, subversion int
+	switch state.NegotiatedProtocol {
+	case "http/1.1", "":
+		return nil, newHTTPConn(t, u.Host, tcpConn, slots), nil
 
-			case "spdy/3.1":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 3, 1)
-				if err != nil {
-					return nil, nil, err
-				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
-				conn = newConn
-
-			case "spdy/3":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 3, 0)
-				if err != nil {
-					return nil, nil, err
-				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
-				conn = newConn
-
-			case "spdy/2":
-				newConn, err := NewClientConn(tlsConn, t.PushReceiver, 2, 0)
-				if err != nil {
-					return nil, nil, err
-				}
-				go newConn.Run()
-				t.spdyConns[u.Host] = newConn
-				conn = newConn
-			}
+	case "spdy/3.1":
+		version, subversion = 3, 1
+
+	case "spdy/3":
+		version, subversion = 3, 0
+
+	case "spdy/2":
+		version, subversion = 2, 0
+	}
+
+	return t.newSPDYConn(u, tlsConn, slots, version, subversion)
+}
+
+// newSPDYConn starts a SPDY connection and adds it to the
+// pool. Once the connection ends, its slot is freed.
+func (t *Transport) newSPDYConn(u *url.URL, netConn net.Conn, slots chan struct{}, version, subversion int) (common.Conn, *httpConn, error) {
+	conn, err := NewClientConn(netConn, t.pushReceiver(u), version, subversion)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch c := conn.(type) {
+	case *spdy3.Conn:
+		c.ClientCredentials = t.ClientCredentials
+		if t.NewScheduler != nil {
+			c.Scheduler = t.NewScheduler()
+		}
+		c.MaxDataSize = t.MaxDataSize
+		c.MaxBufferedData = t.MaxBufferedData
+		if t.NewFlowControl != nil {
+			c.SetFlowControl(t.NewFlowControl())
 		}
+		c.Bandwidth = t.Bandwidth
+		c.StreamBandwidth = t.StreamBandwidth
+		c.PeerBandwidth = t.PeerBandwidth
+	case *spdy2.Conn:
+		if t.NewScheduler != nil {
+			c.Scheduler = t.NewScheduler()
+		}
+		c.MaxDataSize = t.MaxDataSize
+		c.Bandwidth = t.Bandwidth
+		c.StreamBandwidth = t.StreamBandwidth
+		c.PeerBandwidth = t.PeerBandwidth
 	}
+	go func() {
+		conn.Run()
+		slots <- struct{}{}
+	}()
+	t.m.Lock()
+	t.spdyConns[u.Host] = conn
+	delete(t.coalesced, u.Host)
+	t.m.Unlock()
 
 	return conn, nil, nil
 }
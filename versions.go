@@ -53,6 +53,20 @@ func npn() []string {
 	return s
 }
 
+// npnVersion returns the SPDY version and subversion
+// for the given NPN string, or false if it is not a
+// supported SPDY version.
+func npnVersion(proto string) (version, subversion int, ok bool) {
+	for v, str := range npnStrings {
+		if str == proto && SupportedVersion(v) {
+			version = int(v)
+			subversion = int(v*10) % 10
+			return version, subversion, true
+		}
+	}
+	return 0, 0, false
+}
+
 // SupportedVersion determines if the provided SPDY version is
 // supported by this instance of the library. This can be modified
 // with EnableSpdyVersion and DisableSpdyVersion.